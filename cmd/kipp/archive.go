@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/uhthomas/kipp/internal/archive"
+	"github.com/uhthomas/kipp/internal/databaseutil"
+	"github.com/uhthomas/kipp/internal/filesystemutil"
+)
+
+// exportCommand writes every entry and file to an archive.
+func exportCommand(ctx context.Context) error {
+	set := flag.NewFlagSet("export", flag.ExitOnError)
+	dbf := set.String("database", "badger", "database - see docs for more information")
+	fsf := set.String("filesystem", "files", "filesystem - see docs for more information")
+	out := set.String("output", "-", "archive to write, or - for stdout")
+	set.Parse(os.Args[2:])
+
+	fs, err := filesystemutil.Parse(ctx, *fsf)
+	if err != nil {
+		return fmt.Errorf("parse filesystem: %w", err)
+	}
+
+	db, err := databaseutil.Parse(ctx, *dbf)
+	if err != nil {
+		return fmt.Errorf("parse database: %w", err)
+	}
+	defer db.Close(ctx)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("create: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+
+	res, err := archive.Export(ctx, bw, db, fs)
+	res.Log(log.Printf)
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// importCommand restores every entry and file from an archive.
+func importCommand(ctx context.Context) error {
+	set := flag.NewFlagSet("import", flag.ExitOnError)
+	dbf := set.String("database", "badger", "database - see docs for more information")
+	fsf := set.String("filesystem", "files", "filesystem - see docs for more information")
+	in := set.String("input", "-", "archive to read, or - for stdin")
+	skipExpired := set.Bool("skip-expired", false, "skip entries which have expired")
+	set.Parse(os.Args[2:])
+
+	fs, err := filesystemutil.Parse(ctx, *fsf)
+	if err != nil {
+		return fmt.Errorf("parse filesystem: %w", err)
+	}
+
+	db, err := databaseutil.Parse(ctx, *dbf)
+	if err != nil {
+		return fmt.Errorf("parse database: %w", err)
+	}
+	defer db.Close(ctx)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("open: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	res, err := archive.Import(ctx, bufio.NewReader(r), db, fs, archive.ImportOptions{
+		SkipExpired: *skipExpired,
+	})
+	res.Log(log.Printf)
+	if err != nil {
+		return err
+	}
+	if len(res.Conflicts) > 0 || len(res.Failed) > 0 || len(res.Missing) > 0 {
+		return errors.New("some entries were not imported")
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/uhthomas/kipp/internal/databaseutil"
+	"github.com/uhthomas/kipp/internal/filesystemutil"
+	"github.com/uhthomas/kipp/internal/gc"
+)
+
+// gcCommand removes expired entries and their files, and files with no entry.
+func gcCommand(ctx context.Context) error {
+	set := flag.NewFlagSet("gc", flag.ExitOnError)
+	dbf := set.String("database", "badger", "database - see docs for more information")
+	fsf := set.String("filesystem", "files", "filesystem - see docs for more information")
+	grace := set.Duration("grace", 24*time.Hour, "how long a file must be unmodified before it's considered orphaned")
+	dryRun := set.Bool("dry-run", false, "report what would be removed, without removing anything")
+	set.Parse(os.Args[2:])
+
+	fs, err := filesystemutil.Parse(ctx, *fsf)
+	if err != nil {
+		return fmt.Errorf("parse filesystem: %w", err)
+	}
+
+	db, err := databaseutil.Parse(ctx, *dbf)
+	if err != nil {
+		return fmt.Errorf("parse database: %w", err)
+	}
+	defer db.Close(ctx)
+
+	res, err := (&gc.Collector{
+		Database:   db,
+		FileSystem: fs,
+		Grace:      *grace,
+		DryRun:     *dryRun,
+	}).Collect(ctx)
+	res.Log(log.Printf)
+	return err
+}
@@ -22,6 +22,18 @@ func Main(ctx context.Context) error {
 	switch cmd {
 	case "", "serve":
 		return serve(ctx)
+	case "export":
+		return exportCommand(ctx)
+	case "gc":
+		return gcCommand(ctx)
+	case "import":
+		return importCommand(ctx)
+	case "migrate-data":
+		return migrateData(ctx)
+	case "rekey":
+		return rekey(ctx)
+	case "scrub":
+		return scrubCommand(ctx)
 	default:
 		fmt.Printf("unknown command: %s\n", cmd)
 		return nil
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/uhthomas/kipp/internal/databaseutil"
+	"github.com/uhthomas/kipp/internal/filesystemutil"
+	"github.com/uhthomas/kipp/internal/migrate"
+)
+
+// migrateData copies every entry and file from one database and filesystem to
+// another.
+func migrateData(ctx context.Context) error {
+	set := flag.NewFlagSet("migrate-data", flag.ExitOnError)
+	fromDB := set.String("from-database", "", "database to copy from - see docs for more information")
+	fromFS := set.String("from-filesystem", "", "filesystem to copy from - see docs for more information")
+	toDB := set.String("to-database", "", "database to copy to - see docs for more information")
+	toFS := set.String("to-filesystem", "", "filesystem to copy to - see docs for more information")
+	concurrency := set.Int("concurrency", 4, "number of files to copy at once")
+	dryRun := set.Bool("dry-run", false, "report what would be copied, without copying anything")
+	set.Parse(os.Args[2:])
+
+	if *fromDB == "" || *fromFS == "" || *toDB == "" || *toFS == "" {
+		return errors.New("--from-database, --from-filesystem, --to-database and --to-filesystem are required")
+	}
+
+	m := &migrate.Migrator{Concurrency: *concurrency, DryRun: *dryRun}
+	var err error
+	if m.FromFileSystem, err = filesystemutil.Parse(ctx, *fromFS); err != nil {
+		return fmt.Errorf("parse from filesystem: %w", err)
+	}
+	if m.ToFileSystem, err = filesystemutil.Parse(ctx, *toFS); err != nil {
+		return fmt.Errorf("parse to filesystem: %w", err)
+	}
+	if m.FromDatabase, err = databaseutil.Parse(ctx, *fromDB); err != nil {
+		return fmt.Errorf("parse from database: %w", err)
+	}
+	defer m.FromDatabase.Close(ctx)
+	if m.ToDatabase, err = databaseutil.Parse(ctx, *toDB); err != nil {
+		return fmt.Errorf("parse to database: %w", err)
+	}
+	defer m.ToDatabase.Close(ctx)
+
+	res, err := m.Migrate(ctx)
+	res.Log(log.Printf)
+	if err != nil {
+		return err
+	}
+	if len(res.Conflicts) > 0 || len(res.Failed) > 0 {
+		return errors.New("some entries were not copied; run again to retry")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/encrypt"
+	"github.com/uhthomas/kipp/internal/filesystemutil"
+)
+
+// rekey rewraps the data keys of the files of an encrypted filesystem with its
+// primary key. Every file is rekeyed if no names are given as arguments, or
+// the names are read one per line from stdin if the only argument is "-".
+// Files which fail are logged, and the rest are still rekeyed.
+func rekey(ctx context.Context) error {
+	set := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fsf := set.String("filesystem", "", "encrypted filesystem, whose first key is the new key")
+	set.Parse(os.Args[2:])
+
+	fs, err := filesystemutil.Parse(ctx, *fsf)
+	if err != nil {
+		return fmt.Errorf("parse filesystem: %w", err)
+	}
+	efs, ok := fs.(*encrypt.FileSystem)
+	if !ok {
+		return fmt.Errorf("filesystem %q is not encrypted", *fsf)
+	}
+
+	names := set.Args()
+	switch {
+	case len(names) == 0:
+		// The names are listed first, as rekeying rewrites the files.
+		if err := filesystem.Walk(ctx, efs, func(o filesystem.Object) error {
+			names = append(names, o.Name)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("walk: %w", err)
+		}
+	case len(names) == 1 && names[0] == "-":
+		names = nil
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if name := s.Text(); name != "" {
+				names = append(names, name)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("read names: %w", err)
+		}
+	}
+
+	var n, skipped, failed int
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok, err := efs.Rekey(ctx, name)
+		switch {
+		case errors.Is(err, encrypt.ErrNotEncrypted):
+			skipped++
+		case err != nil:
+			log.Printf("rekey %s: %v", name, err)
+			failed++
+		case ok:
+			n++
+		}
+	}
+	log.Printf("rekeyed %d of %d files, skipped %d which weren't encrypted", n, len(names), skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to rekey", failed)
+	}
+	return nil
+}
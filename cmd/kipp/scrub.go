@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/uhthomas/kipp/internal/databaseutil"
+	"github.com/uhthomas/kipp/internal/filesystemutil"
+	"github.com/uhthomas/kipp/internal/scrub"
+)
+
+// scrubCommand verifies every file against the sum and size of its entry, and
+// reports corrupt, missing and orphaned files.
+func scrubCommand(ctx context.Context) error {
+	set := flag.NewFlagSet("scrub", flag.ExitOnError)
+	dbf := set.String("database", "badger", "database - see docs for more information")
+	fsf := set.String("filesystem", "files", "filesystem - see docs for more information")
+	quarantine := set.Bool("quarantine", false, "quarantine corrupt files, and remove their entries")
+	set.Parse(os.Args[2:])
+
+	fs, err := filesystemutil.Parse(ctx, *fsf)
+	if err != nil {
+		return fmt.Errorf("parse filesystem: %w", err)
+	}
+
+	db, err := databaseutil.Parse(ctx, *dbf)
+	if err != nil {
+		return fmt.Errorf("parse database: %w", err)
+	}
+	defer db.Close(ctx)
+
+	res, err := (&scrub.Scrubber{
+		Database:   db,
+		FileSystem: fs,
+		Quarantine: *quarantine,
+	}).Scrub(ctx)
+	res.Log(log.Printf)
+	if err != nil {
+		return err
+	}
+	if !res.OK() {
+		return errors.New("scrub found problems")
+	}
+	return nil
+}
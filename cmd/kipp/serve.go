@@ -8,12 +8,15 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/uhthomas/kipp"
 	"github.com/uhthomas/kipp/internal/databaseutil"
 	"github.com/uhthomas/kipp/internal/filesystemutil"
+	"github.com/uhthomas/kipp/internal/gc"
+	"github.com/uhthomas/kipp/internal/scrub"
 )
 
 func serve(ctx context.Context) error {
@@ -23,6 +26,19 @@ func serve(ctx context.Context) error {
 	web := flag.String("web", "web", "web directory")
 	limit := flagBytesValue("limit", 150<<20, "upload limit")
 	lifetime := flag.Duration("lifetime", 24*time.Hour, "file lifetime")
+	redirect := flag.Duration("redirect", 0, "redirect downloads to URLs which expire after this long, if the filesystem supports it, or 0 to disable")
+	directUpload := flag.Duration("direct-upload", 0, "let clients upload directly to URLs which expire after this long, if the filesystem supports it, or 0 to disable")
+	gcInterval := flag.Duration("gc", 0, "interval to remove expired entries and orphaned files at, or 0 to disable")
+	gcGrace := flag.Duration("gc-grace", 24*time.Hour, "how long a file must be unmodified before it's considered orphaned")
+	scrubInterval := flag.Duration("scrub", 0, "interval to scrub files at, or 0 to disable")
+	quarantine := flag.Bool("quarantine", false, "quarantine corrupt files found while scrubbing")
+	slugs := flag.String("slugs", "random", "how slugs are generated - random, words (longer, and easier to read aloud, but easier to guess), sequential or sum")
+	uploadersFile := flag.String("uploaders", "", "file of uploaders, who may choose slugs, and their tokens - see docs for more information")
+	linkPreview := flag.Bool("link-preview", false, "show the targets of links on a page, rather than redirecting to them")
+	baseURL := flag.String("base-url", "", "URL kipp is served from, such as https://kipp.example.com, for links in embeds, or empty to use the host of each request")
+	previewOrigin := flag.String("preview-origin", "", "origin to serve previews from, such as https://preview.example.com, or empty to serve them from any")
+	unfurl := flag.Bool("unfurl", false, "serve pages describing files, rather than the files, to the bots which unfurl links, and anything else with their user agents")
+	slugLength := flag.Int("slug-length", 0, "length of random and sum slugs, or 0 for the default")
 	flag.Parse()
 
 	for k, v := range mimeTypes {
@@ -33,7 +49,7 @@ func serve(ctx context.Context) error {
 		}
 	}
 
-	fs, err := filesystemutil.Parse(*fsf)
+	fs, err := filesystemutil.Parse(ctx, *fsf)
 	if err != nil {
 		return fmt.Errorf("parse filesystem: %w", err)
 	}
@@ -44,16 +60,75 @@ func serve(ctx context.Context) error {
 	}
 	defer db.Close(ctx)
 
+	var slugGenerator kipp.SlugGenerator
+	switch *slugs {
+	case "random":
+		slugGenerator = kipp.RandomSlugs{Length: *slugLength}
+	case "words":
+		slugGenerator = kipp.WordSlugs{}
+	case "sequential":
+		if slugGenerator, err = kipp.NewSequentialSlugs(ctx, db); err != nil {
+			return fmt.Errorf("new sequential slugs: %w", err)
+		}
+	case "sum":
+		slugGenerator = kipp.SumSlugs{Length: *slugLength}
+	default:
+		return fmt.Errorf("invalid slugs: %s", *slugs)
+	}
+
+	var uploaders map[string]string
+	if *uploadersFile != "" {
+		if uploaders, err = readUploaders(*uploadersFile); err != nil {
+			return fmt.Errorf("read uploaders: %w", err)
+		}
+	}
+
+	if *baseURL != "" {
+		if u, err := url.Parse(*baseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid base url: %s", *baseURL)
+		}
+	}
+
+	if *previewOrigin != "" {
+		if u, err := url.Parse(*previewOrigin); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid preview origin: %s", *previewOrigin)
+		}
+	}
+
+	if *gcInterval > 0 {
+		go (&gc.Collector{
+			Database:   db,
+			FileSystem: fs,
+			Grace:      *gcGrace,
+		}).Loop(ctx, *gcInterval)
+	}
+
+	if *scrubInterval > 0 {
+		go (&scrub.Scrubber{
+			Database:   db,
+			FileSystem: fs,
+			Quarantine: *quarantine,
+		}).Loop(ctx, *scrubInterval)
+	}
+
 	log.Printf("listening on %s", *addr)
 
 	return (&http.Server{
 		Addr: *addr,
 		Handler: &kipp.Server{
-			Database:   db,
-			FileSystem: fs,
-			Limit:      int64(*limit),
-			Lifetime:   *lifetime,
-			PublicPath: *web,
+			Database:      db,
+			FileSystem:    fs,
+			Limit:         int64(*limit),
+			Lifetime:      *lifetime,
+			PublicPath:    *web,
+			Redirect:      *redirect,
+			DirectUpload:  *directUpload,
+			Slugs:         slugGenerator,
+			Uploaders:     uploaders,
+			LinkPreview:   *linkPreview,
+			PreviewOrigin: *previewOrigin,
+			BaseURL:       *baseURL,
+			Unfurl:        *unfurl,
 		},
 		// ReadTimeout:  5 * time.Second,
 		// WriteTimeout: 10 * time.Second,
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readUploaders reads the named file of uploaders, which has a name and a
+// bearer token on each line, separated by whitespace. Empty lines, and lines
+// starting with "#", are ignored.
+func readUploaders(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	uploaders := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want a name and a token", n)
+		}
+		if _, ok := uploaders[fields[1]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate token", n)
+		}
+		uploaders[fields[1]] = fields[0]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(uploaders) == 0 {
+		return nil, errors.New("no uploaders")
+	}
+	return uploaders, nil
+}
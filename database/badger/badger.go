@@ -3,6 +3,7 @@ package badger
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -24,17 +25,82 @@ func Open(name string) (*Database, error) {
 	return &Database{db: db}, nil
 }
 
-// Create sets the key, slug with the gob encoded value of e.
+// Create sets the key, slug with the gob encoded value of e, unless it's
+// already set.
 func (db *Database) Create(_ context.Context, e database.Entry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return fmt.Errorf("gob encode: %w", err)
+	}
+	if err := db.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(e.Slug)); err == nil {
+			return database.ErrExists
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return fmt.Errorf("get: %w", err)
+		}
+		return txn.Set([]byte(e.Slug), buf.Bytes())
+	}); err != nil {
+		// The transaction conflicts with another which set the key.
+		if errors.Is(err, badger.ErrConflict) {
+			return database.ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+// Update sets the key, slug with the gob encoded value of e, if it's already
+// set.
+func (db *Database) Update(_ context.Context, e database.Entry) error {
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
 		return fmt.Errorf("gob encode: %w", err)
 	}
 	return db.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(e.Slug)); errors.Is(err, badger.ErrKeyNotFound) {
+			return database.ErrNoResults
+		} else if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
 		return txn.Set([]byte(e.Slug), buf.Bytes())
 	})
 }
 
+// Swap sets the key, slug with the gob encoded value of e, if its File is
+// file.
+func (db *Database) Swap(_ context.Context, e database.Entry, file string) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return fmt.Errorf("gob encode: %w", err)
+	}
+	for {
+		err := db.db.Update(func(txn *badger.Txn) error {
+			v, err := txn.Get([]byte(e.Slug))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return database.ErrConflict
+			} else if err != nil {
+				return fmt.Errorf("get: %w", err)
+			}
+			var existing database.Entry
+			if err := v.Value(func(b []byte) error {
+				return gob.NewDecoder(bytes.NewReader(b)).Decode(&existing)
+			}); err != nil {
+				return fmt.Errorf("gob decode: %w", err)
+			}
+			if existing.File != file {
+				return database.ErrConflict
+			}
+			return txn.Set([]byte(e.Slug), buf.Bytes())
+		})
+		// The transaction conflicts with another which set the key, so
+		// check it again.
+		if errors.Is(err, badger.ErrConflict) {
+			continue
+		}
+		return err
+	}
+}
+
 // Remove removes the key with the given slug.
 func (db *Database) Remove(_ context.Context, slug string) error {
 	return db.db.Update(func(txn *badger.Txn) error {
@@ -42,6 +108,36 @@ func (db *Database) Remove(_ context.Context, slug string) error {
 	})
 }
 
+// Discard removes the key with the given slug, if its File is file.
+func (db *Database) Discard(_ context.Context, slug, file string) error {
+	for {
+		err := db.db.Update(func(txn *badger.Txn) error {
+			v, err := txn.Get([]byte(slug))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return database.ErrConflict
+			} else if err != nil {
+				return fmt.Errorf("get: %w", err)
+			}
+			var existing database.Entry
+			if err := v.Value(func(b []byte) error {
+				return gob.NewDecoder(bytes.NewReader(b)).Decode(&existing)
+			}); err != nil {
+				return fmt.Errorf("gob decode: %w", err)
+			}
+			if existing.File != file {
+				return database.ErrConflict
+			}
+			return txn.Delete([]byte(slug))
+		})
+		// The transaction conflicts with another which set the key, so
+		// check it again.
+		if errors.Is(err, badger.ErrConflict) {
+			continue
+		}
+		return err
+	}
+}
+
 // Lookup looks up the named entry.
 func (db *Database) Lookup(_ context.Context, slug string) (e database.Entry, err error) {
 	var b []byte
@@ -61,5 +157,91 @@ func (db *Database) Lookup(_ context.Context, slug string) (e database.Entry, er
 	return e, gob.NewDecoder(bytes.NewReader(b)).Decode(&e)
 }
 
+// walkPage is the number of entries Walk reads in each transaction.
+const walkPage = 256
+
+// Walk iterates over every key, decoding each value as an entry. Entries are
+// read a page at a time, in short transactions, so fn may be slow without
+// holding a transaction open.
+func (db *Database) Walk(ctx context.Context, fn func(database.Entry) error) error {
+	var after []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var page []database.Entry
+		if err := db.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Seek(after); it.Valid() && len(page) < walkPage; it.Next() {
+				k := it.Item().Key()
+				if after != nil && bytes.Equal(k, after) || bytes.HasPrefix(k, []byte(counterPrefix)) {
+					continue
+				}
+				var e database.Entry
+				if err := it.Item().Value(func(b []byte) error {
+					return gob.NewDecoder(bytes.NewReader(b)).Decode(&e)
+				}); err != nil {
+					return fmt.Errorf("gob decode %s: %w", k, err)
+				}
+				page = append(page, e)
+				after = it.Item().KeyCopy(nil)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, e := range page {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if len(page) < walkPage {
+			return nil
+		}
+	}
+}
+
+// counterPrefix is the prefix of the keys of counters. Slugs never contain
+// "/", so they can't collide with entries.
+const counterPrefix = "counter/"
+
+// Add adds delta to the named counter, and returns its new value. Counters
+// are stored as big endian integers.
+func (db *Database) Add(_ context.Context, name string, delta uint64) (uint64, error) {
+	key := []byte(counterPrefix + name)
+	for {
+		var n uint64
+		err := db.db.Update(func(txn *badger.Txn) error {
+			if v, err := txn.Get(key); err == nil {
+				if err := v.Value(func(b []byte) error {
+					if len(b) != 8 {
+						return fmt.Errorf("invalid counter %s", name)
+					}
+					n = binary.BigEndian.Uint64(b)
+					return nil
+				}); err != nil {
+					return err
+				}
+			} else if !errors.Is(err, badger.ErrKeyNotFound) {
+				return fmt.Errorf("get: %w", err)
+			}
+			n += delta
+			var b [8]byte
+			binary.BigEndian.PutUint64(b[:], n)
+			return txn.Set(key, b[:])
+		})
+		// The transaction conflicts with another which added to the
+		// counter, so try again.
+		if errors.Is(err, badger.ErrConflict) {
+			continue
+		}
+		return n, err
+	}
+}
+
 // Close closes the database.
 func (db *Database) Close(_ context.Context) error { return db.db.Close() }
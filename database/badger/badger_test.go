@@ -0,0 +1,52 @@
+package badger_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/badger"
+	"github.com/uhthomas/kipp/database/databasetest"
+)
+
+func TestDatabase(t *testing.T) {
+	databasetest.TestDatabase(t, func(t *testing.T) database.Database {
+		db, err := badger.Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestDatabaseWalkPages(t *testing.T) {
+	db, err := badger.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	ctx := context.Background()
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := db.Create(ctx, database.Entry{Slug: fmt.Sprintf("%04d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entries are removed as they're walked, which mustn't affect those
+	// which are yet to be walked.
+	var i int
+	if err := db.Walk(ctx, func(e database.Entry) error {
+		if want := fmt.Sprintf("%04d", i); e.Slug != want {
+			t.Fatalf("unexpected slug; got %q, want %q", e.Slug, want)
+		}
+		i++
+		return db.Remove(ctx, e.Slug)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Fatalf("unexpected number of entries; got %d, want %d", i, n)
+	}
+}
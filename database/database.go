@@ -9,20 +9,48 @@ import (
 // ErrNoResults is returned when there are no results for the given query.
 var ErrNoResults = errors.New("no results")
 
+// ErrExists is returned by Create when an entry with the same slug exists.
+var ErrExists = errors.New("entry exists")
+
+// ErrConflict is returned by Swap and Discard when the entry has changed.
+var ErrConflict = errors.New("entry changed")
+
 // A Database stores and manages data.
 type Database interface {
 	// Create persists the entry to the underlying database, returning
-	// any errors if present.
+	// any errors if present. Slugs are unique, so it returns ErrExists if
+	// the slug is taken.
 	Create(ctx context.Context, e Entry) error
+	// Update replaces the entry with the same slug as e, returning
+	// ErrNoResults if there isn't one.
+	Update(ctx context.Context, e Entry) error
+	// Swap replaces the entry with the same slug as e, so long as its File
+	// is file. Otherwise, as the entry has been replaced or removed since
+	// it was looked up, it returns ErrConflict.
+	Swap(ctx context.Context, e Entry, file string) error
 	// Remove removes the named entry.
 	Remove(ctx context.Context, slug string) error
+	// Discard removes the named entry, so long as its File is file.
+	// Otherwise, it returns ErrConflict, as with Swap.
+	Discard(ctx context.Context, slug, file string) error
 	// Lookup looks up the named entry.
 	Lookup(ctx context.Context, slug string) (Entry, error)
+	// Walk calls fn for each entry, in no particular order, stopping at
+	// and returning the first error returned by fn.
+	Walk(ctx context.Context, fn func(Entry) error) error
 	// Close closes the database.
 	Close(ctx context.Context) error
 }
 
-// An Entry stores relevant metadata for files.
+// A Counter is a Database which also stores counters, which outlive the
+// entries they were counted for.
+type Counter interface {
+	// Add adds delta to the named counter, which is initially zero, and
+	// returns its new value.
+	Add(ctx context.Context, name string, delta uint64) (uint64, error)
+}
+
+// An Entry stores relevant metadata for files, or links.
 type Entry struct {
 	Slug      string
 	Name      string
@@ -30,4 +58,22 @@ type Entry struct {
 	Size      int64
 	Lifetime  *time.Time
 	Timestamp time.Time
+	// Uploader is the name of the authorised uploader who created the
+	// entry, if any.
+	Uploader string
+	// URL, if set, is the URL the entry links to. Links have no file, so
+	// their Name, Sum and Size are empty.
+	URL string
+	// File, if set, is the name of the entry's file, which is otherwise
+	// its slug. Files which replace others are written under new names,
+	// so an entry never refers to a file written for another.
+	File string
+}
+
+// FileName returns the name of the entry's file.
+func (e Entry) FileName() string {
+	if e.File != "" {
+		return e.File
+	}
+	return e.Slug
 }
@@ -0,0 +1,395 @@
+package databasetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+)
+
+// TestDatabase runs a suite of conformance tests against the databases
+// returned by open. Each subtest opens a new, empty database, and closes it
+// once finished.
+func TestDatabase(t *testing.T, open func(t *testing.T) database.Database) {
+	for _, tt := range []struct {
+		name string
+		f    func(t *testing.T, db database.Database)
+	}{
+		{name: "CreateLookup", f: testCreateLookup},
+		{name: "CreateExists", f: testCreateExists},
+		{name: "LookupNotFound", f: testLookupNotFound},
+		{name: "Update", f: testUpdate},
+		{name: "UpdateNotFound", f: testUpdateNotFound},
+		{name: "Swap", f: testSwap},
+		{name: "SwapConflict", f: testSwapConflict},
+		{name: "Remove", f: testRemove},
+		{name: "RemoveNotFound", f: testRemoveNotFound},
+		{name: "Discard", f: testDiscard},
+		{name: "Walk", f: testWalk},
+		{name: "WalkStop", f: testWalkStop},
+		{name: "Concurrent", f: testConcurrent},
+		{name: "Counter", f: testCounter},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			db := open(t)
+			defer func() {
+				if err := db.Close(context.Background()); err != nil {
+					t.Errorf("close: %v", err)
+				}
+			}()
+			tt.f(t, db)
+		})
+	}
+}
+
+// entry returns a valid entry for the given slug. Times are truncated, and in
+// UTC, so they survive a round trip through any of the backends.
+func entry(slug string, lifetime bool) database.Entry {
+	now := time.Now().UTC().Truncate(time.Second)
+	e := database.Entry{
+		Slug:      slug,
+		Name:      slug + ".txt",
+		Sum:       "sum-" + slug,
+		Size:      int64(len(slug)),
+		Timestamp: now,
+	}
+	if lifetime {
+		l := now.Add(time.Hour)
+		e.Lifetime = &l
+	}
+	return e
+}
+
+func checkEntry(t *testing.T, got, want database.Entry) {
+	t.Helper()
+	if got.Slug != want.Slug || got.Name != want.Name || got.Sum != want.Sum || got.Size != want.Size || got.Uploader != want.Uploader || got.URL != want.URL || got.File != want.File {
+		t.Fatalf("unexpected entry; got %+v, want %+v", got, want)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Fatalf("unexpected timestamp; got %s, want %s", got.Timestamp, want.Timestamp)
+	}
+	switch {
+	case got.Lifetime == nil && want.Lifetime == nil:
+	case got.Lifetime == nil || want.Lifetime == nil, !got.Lifetime.Equal(*want.Lifetime):
+		t.Fatalf("unexpected lifetime; got %v, want %v", got.Lifetime, want.Lifetime)
+	}
+}
+
+func testCreateLookup(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	uploaded := entry("uploaded", false)
+	uploaded.Uploader = "some-uploader"
+	link := database.Entry{
+		Slug:      "link",
+		Timestamp: uploaded.Timestamp,
+		URL:       "https://example.com/some/page?q=1",
+	}
+	for _, want := range []database.Entry{
+		entry("permanent", false),
+		entry("temporary", true),
+		uploaded,
+		link,
+	} {
+		if err := db.Create(ctx, want); err != nil {
+			t.Fatalf("create %s: %v", want.Slug, err)
+		}
+		got, err := db.Lookup(ctx, want.Slug)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", want.Slug, err)
+		}
+		checkEntry(t, got, want)
+	}
+}
+
+func testCreateExists(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	want := entry("exists", false)
+	if err := db.Create(ctx, want); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	other := entry("exists", true)
+	other.Sum = "other"
+	if err := db.Create(ctx, other); !errors.Is(err, database.ErrExists) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrExists)
+	}
+	got, err := db.Lookup(ctx, want.Slug)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	checkEntry(t, got, want)
+}
+
+func testUpdate(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	if err := db.Create(ctx, entry("update", false)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	want := entry("update", true)
+	want.Name, want.Sum, want.Size, want.Uploader = "new.txt", "new-sum", 42, "some-uploader"
+	want.URL, want.File = "https://example.com", "update.file"
+	if err := db.Update(ctx, want); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	got, err := db.Lookup(ctx, want.Slug)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	checkEntry(t, got, want)
+}
+
+func testUpdateNotFound(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	if err := db.Update(ctx, entry("missing", false)); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+	if _, err := db.Lookup(ctx, "missing"); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("update created an entry; got %v, want %v", err, database.ErrNoResults)
+	}
+}
+
+func testSwap(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	if err := db.Create(ctx, entry("swap", false)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, file := range []string{"swap.first", "swap.second"} {
+		existing, err := db.Lookup(ctx, "swap")
+		if err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+		want := entry("swap", true)
+		want.Sum, want.File = "sum-"+file, file
+		if err := db.Swap(ctx, want, existing.File); err != nil {
+			t.Fatalf("swap %s: %v", file, err)
+		}
+		got, err := db.Lookup(ctx, want.Slug)
+		if err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+		checkEntry(t, got, want)
+	}
+}
+
+func testSwapConflict(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	want := entry("conflict", false)
+	want.File = "conflict.file"
+	if err := db.Create(ctx, want); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// The entry was replaced, so its file is no longer "".
+	other := entry("conflict", true)
+	other.Sum, other.File = "other", "conflict.other"
+	if err := db.Swap(ctx, other, ""); !errors.Is(err, database.ErrConflict) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrConflict)
+	}
+	got, err := db.Lookup(ctx, want.Slug)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	checkEntry(t, got, want)
+
+	// The entry was removed.
+	if err := db.Swap(ctx, entry("missing", false), ""); !errors.Is(err, database.ErrConflict) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrConflict)
+	}
+	if _, err := db.Lookup(ctx, "missing"); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("swap created an entry; got %v, want %v", err, database.ErrNoResults)
+	}
+}
+
+func testDiscard(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	want := entry("discard", false)
+	want.File = "discard.file"
+	if err := db.Create(ctx, want); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// The entry was replaced, so its file is no longer "".
+	if err := db.Discard(ctx, want.Slug, ""); !errors.Is(err, database.ErrConflict) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrConflict)
+	}
+	got, err := db.Lookup(ctx, want.Slug)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	checkEntry(t, got, want)
+
+	if err := db.Discard(ctx, want.Slug, want.File); err != nil {
+		t.Fatalf("discard: %v", err)
+	}
+	if _, err := db.Lookup(ctx, want.Slug); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+	// The entry was removed.
+	if err := db.Discard(ctx, want.Slug, want.File); !errors.Is(err, database.ErrConflict) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrConflict)
+	}
+}
+
+func testLookupNotFound(t *testing.T, db database.Database) {
+	if _, err := db.Lookup(context.Background(), "missing"); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+}
+
+func testRemove(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	keep, remove := entry("keep", false), entry("remove", false)
+	for _, e := range []database.Entry{keep, remove} {
+		if err := db.Create(ctx, e); err != nil {
+			t.Fatalf("create %s: %v", e.Slug, err)
+		}
+	}
+	if err := db.Remove(ctx, remove.Slug); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := db.Lookup(ctx, remove.Slug); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+	got, err := db.Lookup(ctx, keep.Slug)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	checkEntry(t, got, keep)
+}
+
+func testRemoveNotFound(t *testing.T, db database.Database) {
+	if err := db.Remove(context.Background(), "missing"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+}
+
+func testWalk(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	want := map[string]database.Entry{}
+	for i := 0; i < 8; i++ {
+		e := entry(fmt.Sprintf("walk%d", i), i%2 == 0)
+		if err := db.Create(ctx, e); err != nil {
+			t.Fatalf("create %s: %v", e.Slug, err)
+		}
+		want[e.Slug] = e
+	}
+	if err := db.Walk(ctx, func(got database.Entry) error {
+		e, ok := want[got.Slug]
+		if !ok {
+			return fmt.Errorf("unexpected entry %s", got.Slug)
+		}
+		checkEntry(t, got, e)
+		delete(want, got.Slug)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	for slug := range want {
+		t.Errorf("entry %s was not walked", slug)
+	}
+}
+
+func testWalkStop(t *testing.T, db database.Database) {
+	ctx := context.Background()
+	for _, slug := range []string{"a", "b", "c"} {
+		if err := db.Create(ctx, entry(slug, false)); err != nil {
+			t.Fatalf("create %s: %v", slug, err)
+		}
+	}
+	stop := errors.New("stop")
+	var n int
+	if err := db.Walk(ctx, func(database.Entry) error {
+		n++
+		return stop
+	}); err != stop {
+		t.Fatalf("unexpected error; got %v, want %v", err, stop)
+	}
+	if n != 1 {
+		t.Fatalf("fn called %d times after returning an error", n)
+	}
+}
+
+func testConcurrent(t *testing.T, db database.Database) {
+	ctx := context.Background()
+
+	const n = 16
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(e database.Entry) {
+			defer wg.Done()
+			if err := db.Create(ctx, e); err != nil {
+				errs <- fmt.Errorf("create %s: %w", e.Slug, err)
+				return
+			}
+			got, err := db.Lookup(ctx, e.Slug)
+			if err != nil {
+				errs <- fmt.Errorf("lookup %s: %w", e.Slug, err)
+				return
+			}
+			if got.Sum != e.Sum {
+				errs <- fmt.Errorf("lookup %s: got sum %q, want %q", e.Slug, got.Sum, e.Sum)
+				return
+			}
+			if err := db.Remove(ctx, e.Slug); err != nil {
+				errs <- fmt.Errorf("remove %s: %w", e.Slug, err)
+			}
+		}(entry(fmt.Sprintf("concurrent%d", i), i%2 == 0))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testCounter(t *testing.T, db database.Database) {
+	c, ok := db.(database.Counter)
+	if !ok {
+		t.Skip("database.Counter is not implemented")
+	}
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name        string
+		delta, want uint64
+	}{
+		{name: "a", delta: 0, want: 0},
+		{name: "a", delta: 2, want: 2},
+		{name: "b", delta: 1, want: 1},
+		{name: "a", delta: 1, want: 3},
+	} {
+		got, err := c.Add(ctx, tt.name, tt.delta)
+		if err != nil {
+			t.Fatalf("add %d to %s: %v", tt.delta, tt.name, err)
+		}
+		if got != tt.want {
+			t.Fatalf("add %d to %s; got %d, want %d", tt.delta, tt.name, got, tt.want)
+		}
+	}
+
+	const n = 16
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Add(ctx, "concurrent", 1); err != nil {
+				t.Errorf("add: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, err := c.Add(ctx, "concurrent", 0); err != nil || got != n {
+		t.Fatalf("unexpected count; got (%d, %v), want (%d, nil)", got, err, n)
+	}
+
+	// Counters aren't entries.
+	if err := db.Walk(ctx, func(e database.Entry) error {
+		return fmt.Errorf("unexpected entry %s", e.Slug)
+	}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+}
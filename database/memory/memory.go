@@ -0,0 +1,162 @@
+package memory
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/uhthomas/kipp/database"
+)
+
+// A Database is an in-memory database, useful for tests and ephemeral
+// instances. It is safe for concurrent use.
+type Database struct {
+	mu      sync.Mutex
+	max     int
+	ll      *list.List
+	entries map[string]*list.Element
+	// counters are never evicted.
+	counters map[string]uint64
+}
+
+// New creates a new Database which holds at most max entries. Once full, the
+// least recently used entry is evicted. A max of zero or less means there is
+// no limit.
+func New(max int) *Database {
+	return &Database{
+		max:      max,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+		counters: make(map[string]uint64),
+	}
+}
+
+// Create stores e, unless there's an entry with the same slug.
+func (db *Database) Create(_ context.Context, e database.Entry) error {
+	e = clone(e)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.entries[e.Slug]; ok {
+		return database.ErrExists
+	}
+	db.entries[e.Slug] = db.ll.PushFront(e)
+	for db.max > 0 && db.ll.Len() > db.max {
+		el := db.ll.Back()
+		db.ll.Remove(el)
+		delete(db.entries, el.Value.(database.Entry).Slug)
+	}
+	return nil
+}
+
+// Update replaces the entry with the same slug as e.
+func (db *Database) Update(_ context.Context, e database.Entry) error {
+	e = clone(e)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	el, ok := db.entries[e.Slug]
+	if !ok {
+		return database.ErrNoResults
+	}
+	el.Value = e
+	db.ll.MoveToFront(el)
+	return nil
+}
+
+// Swap replaces the entry with the same slug as e, if its File is file.
+func (db *Database) Swap(_ context.Context, e database.Entry, file string) error {
+	e = clone(e)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	el, ok := db.entries[e.Slug]
+	if !ok || el.Value.(database.Entry).File != file {
+		return database.ErrConflict
+	}
+	el.Value = e
+	db.ll.MoveToFront(el)
+	return nil
+}
+
+// Remove removes the entry with the given slug.
+func (db *Database) Remove(_ context.Context, slug string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if el, ok := db.entries[slug]; ok {
+		db.ll.Remove(el)
+		delete(db.entries, slug)
+	}
+	return nil
+}
+
+// Discard removes the entry with the given slug, if its File is file.
+func (db *Database) Discard(_ context.Context, slug, file string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	el, ok := db.entries[slug]
+	if !ok || el.Value.(database.Entry).File != file {
+		return database.ErrConflict
+	}
+	db.ll.Remove(el)
+	delete(db.entries, slug)
+	return nil
+}
+
+// Lookup looks up the entry with the given slug, and marks it as recently
+// used.
+func (db *Database) Lookup(_ context.Context, slug string) (database.Entry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	el, ok := db.entries[slug]
+	if !ok {
+		return database.Entry{}, database.ErrNoResults
+	}
+	db.ll.MoveToFront(el)
+	return clone(el.Value.(database.Entry)), nil
+}
+
+// Walk calls fn for a snapshot of the entries, so fn may modify the
+// database. Entries are not marked as recently used.
+func (db *Database) Walk(_ context.Context, fn func(database.Entry) error) error {
+	db.mu.Lock()
+	entries := make([]database.Entry, 0, db.ll.Len())
+	for el := db.ll.Front(); el != nil; el = el.Next() {
+		entries = append(entries, clone(el.Value.(database.Entry)))
+	}
+	db.mu.Unlock()
+
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add adds delta to the named counter, and returns its new value.
+func (db *Database) Add(_ context.Context, name string, delta uint64) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.counters[name] += delta
+	return db.counters[name], nil
+}
+
+// Close is a no-op; the contents of the database remain available.
+func (db *Database) Close(context.Context) error { return nil }
+
+// clone returns a copy of e which does not share memory with e.
+func clone(e database.Entry) database.Entry {
+	if e.Lifetime != nil {
+		l := *e.Lifetime
+		e.Lifetime = &l
+	}
+	return e
+}
@@ -0,0 +1,44 @@
+package memory_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/databasetest"
+	"github.com/uhthomas/kipp/database/memory"
+)
+
+func TestDatabase(t *testing.T) {
+	databasetest.TestDatabase(t, func(t *testing.T) database.Database {
+		return memory.New(0)
+	})
+}
+
+func TestDatabaseEviction(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New(2)
+	for _, slug := range []string{"a", "b"} {
+		if err := db.Create(ctx, database.Entry{Slug: slug}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Mark a as recently used, so b is evicted instead.
+	if _, err := db.Lookup(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(ctx, database.Entry{Slug: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Lookup(ctx, "b"); !errors.Is(err, database.ErrNoResults) {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+	for _, slug := range []string{"a", "c"} {
+		if _, err := db.Lookup(ctx, slug); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
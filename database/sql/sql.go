@@ -12,23 +12,77 @@ import (
 // A Database is a wrapper around a sql db which provides high level
 // functions defined in database.Database.
 type Database struct {
-	db         *sql.DB
-	createStmt *sql.Stmt
-	removeStmt *sql.Stmt
-	lookupStmt *sql.Stmt
+	db          *sql.DB
+	createStmt  *sql.Stmt
+	updateStmt  *sql.Stmt
+	swapStmt    *sql.Stmt
+	removeStmt  *sql.Stmt
+	discardStmt *sql.Stmt
+	lookupStmt  *sql.Stmt
+	addStmt     *sql.Stmt
 }
 
 const initQuery = `CREATE TABLE IF NOT EXISTS entries (
 	id SERIAL PRIMARY KEY NOT NULL,
-	slug VARCHAR(16) NOT NULL,
+	slug VARCHAR(64) NOT NULL,
 	name VARCHAR(255) NOT NULL,
 	sum varchar(87) NOT NULL, -- len(b64([64]byte))
 	size INTEGER NOT NULL,
 	lifetime TIMESTAMP,
-	timestamp TIMESTAMP NOT NULL
+	timestamp TIMESTAMP NOT NULL,
+	uploader VARCHAR(255) NOT NULL DEFAULT '',
+	url TEXT NOT NULL DEFAULT '',
+	file VARCHAR(255) NOT NULL DEFAULT ''
 );
 
-CREATE UNIQUE INDEX IF NOT EXISTS idx_slug ON entries (slug)`
+CREATE UNIQUE INDEX IF NOT EXISTS idx_slug ON entries (slug);
+
+CREATE TABLE IF NOT EXISTS counters (
+	name VARCHAR(64) PRIMARY KEY NOT NULL,
+	value BIGINT NOT NULL
+);
+
+-- Altering the table locks it, even if there's nothing to alter, so columns
+-- are only altered or added if they need to be.
+DO $$
+BEGIN
+	-- Slugs were at most 16 characters before they could be generated
+	-- in other ways.
+	IF EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema()
+			AND table_name = 'entries'
+			AND column_name = 'slug'
+			AND character_maximum_length < 64
+	) THEN
+		ALTER TABLE entries ALTER COLUMN slug TYPE VARCHAR(64);
+	END IF;
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema()
+			AND table_name = 'entries'
+			AND column_name = 'uploader'
+	) THEN
+		ALTER TABLE entries ADD COLUMN uploader VARCHAR(255) NOT NULL DEFAULT '';
+	END IF;
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema()
+			AND table_name = 'entries'
+			AND column_name = 'url'
+	) THEN
+		ALTER TABLE entries ADD COLUMN url TEXT NOT NULL DEFAULT '';
+	END IF;
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema()
+			AND table_name = 'entries'
+			AND column_name = 'file'
+	) THEN
+		ALTER TABLE entries ADD COLUMN file VARCHAR(255) NOT NULL DEFAULT '';
+	END IF;
+END
+$$`
 
 // Open opens a new sql database and prepares relevant statements.
 func Open(ctx context.Context, driver, name string) (*Database, error) {
@@ -49,8 +103,12 @@ func Open(ctx context.Context, driver, name string) (*Database, error) {
 		out   **sql.Stmt
 	}{
 		{query: createQuery, out: &d.createStmt},
+		{query: updateQuery, out: &d.updateStmt},
+		{query: swapQuery, out: &d.swapStmt},
 		{query: removeQuery, out: &d.removeStmt},
+		{query: discardQuery, out: &d.discardStmt},
 		{query: lookupQuery, out: &d.lookupStmt},
+		{query: addQuery, out: &d.addStmt},
 	} {
 		var err error
 		if *v.out, err = db.PrepareContext(ctx, v.query); err != nil {
@@ -66,21 +124,111 @@ const createQuery = `INSERT INTO entries (
 	sum,
 	size,
 	lifetime,
-	timestamp
-) VALUES ($1, $2, $3, $4, $5, $6)`
+	timestamp,
+	uploader,
+	url,
+	file
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (slug) DO NOTHING`
 
-// Create inserts e into the underlying db.
+// Create inserts e into the underlying db, unless its slug is taken.
 func (db *Database) Create(ctx context.Context, e database.Entry) error {
-	if _, err := db.createStmt.ExecContext(ctx,
+	res, err := db.createStmt.ExecContext(ctx,
 		e.Slug,
 		e.Name,
 		e.Sum,
 		e.Size,
 		e.Lifetime,
 		e.Timestamp,
-	); err != nil {
+		e.Uploader,
+		e.URL,
+		e.File,
+	)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return database.ErrExists
+	}
+	return nil
+}
+
+const updateQuery = `UPDATE entries SET
+	name = $2,
+	sum = $3,
+	size = $4,
+	lifetime = $5,
+	timestamp = $6,
+	uploader = $7,
+	url = $8,
+	file = $9
+WHERE slug = $1`
+
+// Update updates the entry with the same slug as e.
+func (db *Database) Update(ctx context.Context, e database.Entry) error {
+	res, err := db.updateStmt.ExecContext(ctx,
+		e.Slug,
+		e.Name,
+		e.Sum,
+		e.Size,
+		e.Lifetime,
+		e.Timestamp,
+		e.Uploader,
+		e.URL,
+		e.File,
+	)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return database.ErrNoResults
+	}
+	return nil
+}
+
+const swapQuery = `UPDATE entries SET
+	name = $2,
+	sum = $3,
+	size = $4,
+	lifetime = $5,
+	timestamp = $6,
+	uploader = $7,
+	url = $8,
+	file = $9
+WHERE slug = $1 AND file = $10`
+
+// Swap updates the entry with the same slug as e, if its file is file.
+func (db *Database) Swap(ctx context.Context, e database.Entry, file string) error {
+	res, err := db.swapStmt.ExecContext(ctx,
+		e.Slug,
+		e.Name,
+		e.Sum,
+		e.Size,
+		e.Lifetime,
+		e.Timestamp,
+		e.Uploader,
+		e.URL,
+		e.File,
+		file,
+	)
+	if err != nil {
 		return fmt.Errorf("exec: %w", err)
 	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return database.ErrConflict
+	}
 	return nil
 }
 
@@ -94,7 +242,25 @@ func (db *Database) Remove(ctx context.Context, slug string) error {
 	return nil
 }
 
-const lookupQuery = "SELECT slug, name, sum, size, lifetime, timestamp FROM entries WHERE slug = $1"
+const discardQuery = "DELETE FROM entries WHERE slug = $1 AND file = $2"
+
+// Discard removes the entry with the given slug, if its file is file.
+func (db *Database) Discard(ctx context.Context, slug, file string) error {
+	res, err := db.discardStmt.ExecContext(ctx, slug, file)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return database.ErrConflict
+	}
+	return nil
+}
+
+const lookupQuery = "SELECT slug, name, sum, size, lifetime, timestamp, uploader, url, file FROM entries WHERE slug = $1"
 
 // Lookup looks up the entry for the given slug.
 func (db *Database) Lookup(ctx context.Context, slug string) (e database.Entry, err error) {
@@ -105,6 +271,9 @@ func (db *Database) Lookup(ctx context.Context, slug string) (e database.Entry,
 		&e.Size,
 		&e.Lifetime,
 		&e.Timestamp,
+		&e.Uploader,
+		&e.URL,
+		&e.File,
 	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return e, database.ErrNoResults
@@ -114,5 +283,52 @@ func (db *Database) Lookup(ctx context.Context, slug string) (e database.Entry,
 	return e, nil
 }
 
+const addQuery = `INSERT INTO counters (name, value) VALUES ($1, $2)
+ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value
+RETURNING value`
+
+// Add adds delta to the named counter, and returns its new value.
+func (db *Database) Add(ctx context.Context, name string, delta uint64) (uint64, error) {
+	var n int64
+	if err := db.addStmt.QueryRowContext(ctx, name, int64(delta)).Scan(&n); err != nil {
+		return 0, fmt.Errorf("query row: %w", err)
+	}
+	return uint64(n), nil
+}
+
+const walkQuery = "SELECT slug, name, sum, size, lifetime, timestamp, uploader, url, file FROM entries"
+
+// Walk queries every entry.
+func (db *Database) Walk(ctx context.Context, fn func(database.Entry) error) error {
+	rows, err := db.db.QueryContext(ctx, walkQuery)
+	if err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e database.Entry
+		if err := rows.Scan(
+			&e.Slug,
+			&e.Name,
+			&e.Sum,
+			&e.Size,
+			&e.Lifetime,
+			&e.Timestamp,
+			&e.Uploader,
+			&e.URL,
+			&e.File,
+		); err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows: %w", err)
+	}
+	return nil
+}
+
 // Close closes the underlying db.
 func (db *Database) Close(_ context.Context) error { return db.db.Close() }
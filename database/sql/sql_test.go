@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/databasetest"
+)
+
+// TestDatabase requires a disposable PostgreSQL database, specified by the
+// KIPP_TEST_POSTGRES environment variable. Its tables are emptied before each
+// test.
+func TestDatabase(t *testing.T) {
+	dsn := os.Getenv("KIPP_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("KIPP_TEST_POSTGRES is not set")
+	}
+	databasetest.TestDatabase(t, func(t *testing.T) database.Database {
+		ctx := context.Background()
+		db, err := Open(ctx, "postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.db.ExecContext(ctx, "DELETE FROM entries; DELETE FROM counters"); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,285 @@
+package kipp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"image"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/internal/thumbnail"
+)
+
+// embedWidth is the width of the thumbnails shown by unfurlers.
+const embedWidth = 640
+
+// unfurlers are substrings of the user agents of the bots which chat services
+// and social networks use to unfurl links.
+var unfurlers = []string{
+	"slackbot-linkexpanding",
+	"twitterbot",
+	"facebookexternalhit",
+	"discordbot",
+	"telegrambot",
+	"whatsapp",
+	"linkedinbot",
+	"skypeuripreview",
+	"synapse",
+	"mattermost-bot",
+	"redditbot",
+	"iframely",
+	"embedly",
+}
+
+// isUnfurler reports whether ua is the user agent of a bot which unfurls
+// links.
+func isUnfurler(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, u := range unfurlers {
+		if strings.Contains(ua, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseURL returns the URL kipp is served from, without a trailing slash. It's
+// the configured base URL, or failing that, the scheme and host r was made
+// to, such as https://kipp.example.com.
+func (s Server) baseURL(r *http.Request) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// embedType returns the content type of e, by the extension of its name, so
+// the file needn't be opened.
+func embedType(e database.Entry) string {
+	ctype, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(e.Name)))
+	return ctype
+}
+
+// imageSize returns the width and height of e, if it's an image which
+// thumbnails can be generated from.
+func (s Server) imageSize(ctx context.Context, e database.Entry) (int, int, bool) {
+	switch embedType(e) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return 0, 0, false
+	}
+	f, err := s.open(ctx, e)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 ||
+		cfg.Width > thumbnail.MaxDimension || cfg.Height > thumbnail.MaxDimension ||
+		cfg.Width*cfg.Height > thumbnail.MaxPixels {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// describe returns a short description of e, of its size and when it expires.
+func describe(e database.Entry) string {
+	size := units.Base2Bytes(e.Size).String()
+	if e.Lifetime == nil {
+		return size + ", never expires"
+	}
+	return size + ", expires " + e.Lifetime.UTC().Format("2 Jan 2006 15:04 MST")
+}
+
+// embedPage describes a file with OpenGraph and Twitter card metadata, and
+// links to its oEmbed response.
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta property="og:site_name" content="kipp">
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+{{- if .Image}}
+<meta property="og:image" content="{{.Image}}">
+<meta property="og:image:width" content="{{.Width}}">
+<meta property="og:image:height" content="{{.Height}}">
+<meta name="twitter:card" content="summary_large_image">
+{{- else}}
+<meta name="twitter:card" content="summary">
+{{- end}}
+{{- if .Video}}
+<meta property="og:video" content="{{.Video}}">
+<meta property="og:video:type" content="{{.Type}}">
+{{- end}}
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbed}}" title="{{.Title}}">
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+h1 { word-break: break-all; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+{{- if .Image}}
+<p><img src="{{.Image}}" width="{{.Width}}" height="{{.Height}}" alt=""></p>
+{{- end}}
+<p><a href="{{.URL}}">Download</a></p>
+</body>
+</html>
+`))
+
+// serveEmbed serves a page describing e, for the bots which unfurl links.
+// Images are shown by their thumbnails, and videos by their files.
+func (s Server) serveEmbed(w http.ResponseWriter, r *http.Request, e database.Entry) {
+	if e.URL != "" {
+		http.NotFound(w, r)
+		return
+	}
+	base := s.baseURL(r)
+	raw := base + "/" + e.Slug + filepath.Ext(e.Name)
+	data := struct {
+		Title, Description, URL, Type string
+		Image, Video, OEmbed          string
+		Width, Height                 int
+	}{
+		Title:       e.Name,
+		Description: describe(e),
+		URL:         raw,
+		Type:        embedType(e),
+		OEmbed:      base + "/oembed?" + url.Values{"url": {raw}}.Encode(),
+	}
+	if iw, ih, ok := s.imageSize(r.Context(), e); ok {
+		data.Image = base + "/" + e.Slug + "/thumb?w=" + strconv.Itoa(embedWidth)
+		data.Width, data.Height = thumbnail.Size(iw, ih, embedWidth)
+	}
+	if strings.HasPrefix(data.Type, "video/") {
+		// The raw parameter stops unfurlers being shown this page again.
+		data.Video = raw + "?raw"
+	}
+
+	setCacheHeaders(w.Header(), e)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src 'self'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	embedPage.Execute(w, data)
+}
+
+// oEmbed is an oEmbed response, as described by https://oembed.com.
+type oEmbed struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	CacheAge        int64  `json:"cache_age,omitempty"`
+	URL             string `json:"url,omitempty"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// OEmbedHandler serves the oEmbed responses of files, given their URLs, or the
+// URLs of their pages. Images are photos, shown by their thumbnails, and
+// everything else is a link. Only JSON responses are supported.
+func (s Server) OEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if f := q.Get("format"); f != "" && f != "json" {
+		http.Error(w, "unsupported format", http.StatusNotImplemented)
+		return
+	}
+	u, err := url.Parse(q.Get("url"))
+	if err != nil || q.Get("url") == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	var maxWidth, maxHeight int
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"maxwidth", &maxWidth}, {"maxheight", &maxHeight}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.v, err = strconv.Atoi(v); err != nil || *p.v <= 0 {
+				http.Error(w, "invalid "+p.name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	name := path.Clean("/" + u.Path)
+	if dir, page := path.Split(name); dir != "/" && entryPages[page] != nil {
+		name = path.Clean(dir)
+	}
+	e, err := s.entry(r.Context(), name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case e.URL != "":
+		http.NotFound(w, r)
+		return
+	}
+
+	base := s.baseURL(r)
+	res := oEmbed{
+		Version:      "1.0",
+		Type:         "link",
+		Title:        e.Name,
+		ProviderName: "kipp",
+		ProviderURL:  base + "/",
+	}
+	if e.Lifetime != nil {
+		res.CacheAge = int64(time.Until(*e.Lifetime).Seconds())
+	}
+	if iw, ih, ok := s.imageSize(r.Context(), e); ok {
+		// Use the widest thumbnail which fits, or the narrowest.
+		width, height := thumbnail.Size(iw, ih, thumbnail.Widths[0])
+		tw := thumbnail.Widths[0]
+		for _, v := range thumbnail.Widths {
+			ww, hh := thumbnail.Size(iw, ih, v)
+			if v > embedWidth || maxWidth > 0 && ww > maxWidth || maxHeight > 0 && hh > maxHeight {
+				break
+			}
+			width, height, tw = ww, hh, v
+		}
+		res.Type = "photo"
+		res.URL = base + "/" + e.Slug + "/thumb?w=" + strconv.Itoa(tw)
+		res.Width, res.Height = width, height
+		res.ThumbnailURL, res.ThumbnailWidth, res.ThumbnailHeight = res.URL, width, height
+	}
+
+	setCacheHeaders(w.Header(), e)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	json.NewEncoder(w).Encode(res)
+}
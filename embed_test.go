@@ -0,0 +1,211 @@
+package kipp
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const slackbot = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+
+func TestIsUnfurler(t *testing.T) {
+	for ua, want := range map[string]bool{
+		slackbot: true,
+		"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)":         true,
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)": true,
+		"Synapse (bot; +https://github.com/matrix-org/synapse)":                     true,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:91.0) Gecko/20100101 Firefox/91.0":      false,
+		"curl/7.79.1": false,
+		"":            false,
+	} {
+		if got := isUnfurler(ua); got != want {
+			t.Errorf("isUnfurler(%q) = %t, want %t", ua, got, want)
+		}
+	}
+}
+
+func TestServerUnfurl(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1000, 400))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	s.Unfurl = true
+	name := upload(t, s, "image.png", img.String())
+	slug := strings.TrimSuffix(strings.TrimPrefix(name, "/"), ".png")
+
+	for _, tt := range []struct {
+		path, ua string
+		embed    bool
+	}{
+		{path: name, ua: slackbot, embed: true},
+		{path: "/" + slug + "/embed", embed: true},
+		{path: name + "?raw", ua: slackbot},
+		{path: name, ua: "curl/7.79.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Header.Set("User-Agent", tt.ua)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status; got %d, want %d: %s", tt.path, w.Code, http.StatusOK, w.Body)
+		}
+		if got := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"); got != tt.embed {
+			t.Fatalf("%s (%q): embed page served = %t, want %t", tt.path, tt.ua, got, tt.embed)
+		}
+		if !tt.embed {
+			if w.Body.String() != img.String() {
+				t.Fatalf("%s: unexpected body", tt.path)
+			}
+			if got := w.Header().Get("Vary"); got != "User-Agent" {
+				t.Fatalf("%s: unexpected vary; got %q, want %q", tt.path, got, "User-Agent")
+			}
+			continue
+		}
+		for _, want := range []string{
+			`<meta property="og:title" content="image.png">`,
+			`<meta property="og:url" content="http://example.com` + name + `">`,
+			`<meta property="og:image" content="http://example.com/` + slug + `/thumb?w=640">`,
+			`<meta property="og:image:width" content="640">`,
+			`<meta property="og:image:height" content="256">`,
+			`<meta name="twitter:card" content="summary_large_image">`,
+			`application/json+oembed`,
+		} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Fatalf("%s: body does not contain %q:\n%s", tt.path, want, w.Body)
+			}
+		}
+	}
+
+	// Unfurlers still receive the files when unfurling is disabled.
+	s.Unfurl = false
+	r := httptest.NewRequest(http.MethodGet, name, nil)
+	r.Header.Set("User-Agent", slackbot)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Body.String() != img.String() {
+		t.Fatal("embed page served with unfurling disabled")
+	}
+}
+
+func TestServerEmbedBaseURL(t *testing.T) {
+	s := newTestServer()
+	s.BaseURL = "https://kipp.example.com/"
+	name := upload(t, s, "hello.txt", "hello")
+	slug := strings.TrimSuffix(strings.TrimPrefix(name, "/"), ".txt")
+
+	// The configured base URL is used, whatever the request claims.
+	r := httptest.NewRequest(http.MethodGet, "/"+slug+"/embed", nil)
+	r.Host = "evil.example.com"
+	r.Header.Set("X-Forwarded-Proto", "http")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if want := `<meta property="og:url" content="https://kipp.example.com` + name + `">`; !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("body does not contain %q:\n%s", want, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "evil.example.com") {
+		t.Fatalf("body contains the request's host:\n%s", w.Body)
+	}
+}
+
+func TestServerUnfurlVideo(t *testing.T) {
+	s := newTestServer()
+	s.Unfurl = true
+	name := upload(t, s, "clip.mp4", "not really a video")
+
+	r := httptest.NewRequest(http.MethodGet, name, nil)
+	r.Header.Set("User-Agent", slackbot)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	for _, want := range []string{
+		`<meta property="og:video" content="http://example.com` + name + `?raw">`,
+		`<meta property="og:video:type" content="video/mp4">`,
+		`<meta name="twitter:card" content="summary">`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("body does not contain %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestServerOEmbed(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1000, 400))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	name := upload(t, s, "image.png", img.String())
+	slug := strings.TrimSuffix(strings.TrimPrefix(name, "/"), ".png")
+	txt := upload(t, s, "hello.txt", "hello")
+
+	for _, tt := range []struct {
+		url, query string
+		want       oEmbed
+	}{{
+		url: "http://example.com" + name,
+		want: oEmbed{
+			Type:   "photo",
+			URL:    "http://example.com/" + slug + "/thumb?w=640",
+			Width:  640,
+			Height: 256,
+		},
+	}, {
+		url:   "http://example.com/" + slug + "/embed",
+		query: "&maxwidth=400",
+		want: oEmbed{
+			Type:   "photo",
+			URL:    "http://example.com/" + slug + "/thumb?w=320",
+			Width:  320,
+			Height: 128,
+		},
+	}, {
+		url:  "http://example.com" + txt,
+		want: oEmbed{Type: "link"},
+	}} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oembed?url="+url.QueryEscape(tt.url)+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status; got %d, want %d: %s", tt.url, w.Code, http.StatusOK, w.Body)
+		}
+		if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+			t.Fatalf("%s: unexpected content type; got %q, want %q", tt.url, got, want)
+		}
+		var got oEmbed
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != "1.0" || got.ProviderName != "kipp" || got.CacheAge <= 0 {
+			t.Fatalf("%s: unexpected response: %+v", tt.url, got)
+		}
+		if got.Type != tt.want.Type || got.URL != tt.want.URL || got.Width != tt.want.Width || got.Height != tt.want.Height {
+			t.Fatalf("%s: unexpected response; got %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{query: "", status: http.StatusBadRequest},
+		{query: "url=" + url.QueryEscape("http://example.com/missing"), status: http.StatusNotFound},
+		{query: "url=" + url.QueryEscape("http://example.com"+name) + "&format=xml", status: http.StatusNotImplemented},
+		{query: "url=" + url.QueryEscape("http://example.com"+name) + "&maxwidth=wide", status: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oembed?"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Fatalf("%s: unexpected status; got %d, want %d", tt.query, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package azblob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// An Authorizer authorises requests to the Blob service.
+type Authorizer interface {
+	Authorize(req *http.Request) error
+}
+
+// SharedKey authorises requests by signing them with a storage account key.
+type SharedKey struct {
+	account string
+	key     []byte
+}
+
+// NewSharedKey creates a SharedKey for the named account, from its base64
+// encoded key.
+func NewSharedKey(account, key string) (*SharedKey, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("decode key: %w", err)
+	}
+	return &SharedKey{account: account, key: b}, nil
+}
+
+// Authorize signs req, and sets its Authorization header.
+func (k *SharedKey) Authorize(req *http.Request) error {
+	h := hmac.New(sha256.New, k.key)
+	h.Write([]byte(stringToSign(k.account, req)))
+	req.Header.Set("Authorization", "SharedKey "+k.account+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+// stringToSign returns the string to sign for req, as described by
+// https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key.
+func stringToSign(account string, req *http.Request) string {
+	var length string
+	if req.ContentLength > 0 {
+		length = fmt.Sprint(req.ContentLength)
+	}
+
+	var b strings.Builder
+	for _, v := range []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	} {
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+
+	var keys []string
+	for k := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(strings.TrimSpace(req.Header.Get(k)))
+		b.WriteByte('\n')
+	}
+
+	b.WriteByte('/')
+	b.WriteString(account)
+	b.WriteString(req.URL.EscapedPath())
+
+	q := make(url.Values)
+	for k, v := range req.URL.Query() {
+		q[strings.ToLower(k)] = append(q[strings.ToLower(k)], v...)
+	}
+	keys = keys[:0]
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := q[k]
+		sort.Strings(v)
+		b.WriteByte('\n')
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(v, ","))
+	}
+	return b.String()
+}
+
+// SAS authorises requests by appending a shared access signature token to
+// their query.
+type SAS url.Values
+
+// ParseSAS parses a shared access signature token, with or without its
+// leading "?".
+func ParseSAS(token string) (SAS, error) {
+	q, err := url.ParseQuery(strings.TrimPrefix(token, "?"))
+	if err != nil {
+		return nil, err
+	}
+	if q.Get("sig") == "" {
+		return nil, fmt.Errorf("missing signature")
+	}
+	return SAS(q), nil
+}
+
+// Authorize appends the token to req's query.
+func (s SAS) Authorize(req *http.Request) error {
+	q := req.URL.Query()
+	for k, v := range s {
+		q[k] = v
+	}
+	req.URL.RawQuery = q.Encode()
+	return nil
+}
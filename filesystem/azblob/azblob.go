@@ -0,0 +1,172 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/httpfs"
+)
+
+// BlockSize is the size of each block staged when uploading a blob. Objects
+// smaller than BlockSize are uploaded with a single request.
+const BlockSize = 4 << 20
+
+// version is the version of the Blob service REST API used for requests.
+const version = "2019-12-12"
+
+// FileSystem is an abstraction over an Azure Blob Storage container which
+// allows for the creation, opening and removal of block blobs.
+type FileSystem struct {
+	client                      *http.Client
+	endpoint, container, prefix string
+	auth                        Authorizer
+}
+
+// New creates a new FileSystem for the named container, where blobs are
+// stored under prefix. Requests are sent to endpoint, typically
+// https://<account>.blob.core.windows.net, and authorised with auth.
+func New(client *http.Client, endpoint, container, prefix string, auth Authorizer) *FileSystem {
+	return &FileSystem{
+		client:    client,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		container: container,
+		prefix:    strings.Trim(prefix, "/"),
+		auth:      auth,
+	}
+}
+
+// Create streams r to the named blob. Blobs larger than BlockSize are staged
+// as blocks, and committed once r has been read up to io.EOF, so a partial
+// upload never becomes visible.
+func (fs *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	buf := make([]byte, BlockSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fs.put(ctx, name, nil, buf[:n], http.Header{"X-Ms-Blob-Type": {"BlockBlob"}})
+	}
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	var blocks blockList
+	for i := 0; n > 0; i++ {
+		// Block IDs must all be the same length within a blob.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+		if err := fs.put(ctx, name, url.Values{
+			"comp":    {"block"},
+			"blockid": {id},
+		}, buf[:n], nil); err != nil {
+			return fmt.Errorf("put block %d: %w", i, err)
+		}
+		blocks.Latest = append(blocks.Latest, id)
+
+		if n, err = io.ReadFull(r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+	}
+
+	b, err := xml.Marshal(blocks)
+	if err != nil {
+		return fmt.Errorf("xml marshal: %w", err)
+	}
+	if err := fs.put(ctx, name, url.Values{"comp": {"blocklist"}}, b, nil); err != nil {
+		return fmt.Errorf("put block list: %w", err)
+	}
+	return nil
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string
+}
+
+// put uploads b to the named blob, with the given query and headers.
+func (fs *FileSystem) put(ctx context.Context, name string, q url.Values, b []byte, h http.Header) error {
+	u := fs.url(name)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	res, err := fs.do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Open opens the named blob.
+func (fs *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	return httpfs.NewReader(func(offset int64) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fs.url(name), nil)
+		if err != nil {
+			return nil, fmt.Errorf("new request: %w", err)
+		}
+		if offset > 0 {
+			req.Header.Set("X-Ms-Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		res, err := fs.do(req, http.StatusOK, http.StatusPartialContent)
+		if err != nil {
+			return nil, fmt.Errorf("get blob: %w", err)
+		}
+		return res, nil
+	})
+}
+
+// Remove removes the named blob.
+func (fs *FileSystem) Remove(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fs.url(name), nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	res, err := fs.do(req, http.StatusAccepted)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("delete blob %s/%s: %w", fs.container, fs.blob(name), err)
+	}
+	return res.Body.Close()
+}
+
+// blob returns the full blob name for name.
+func (fs *FileSystem) blob(name string) string {
+	if fs.prefix == "" {
+		return name
+	}
+	return path.Join(fs.prefix, name)
+}
+
+// url returns the URL for the named blob.
+func (fs *FileSystem) url(name string) string {
+	return fs.endpoint + "/" + url.PathEscape(fs.container) + "/" + (&url.URL{Path: fs.blob(name)}).EscapedPath()
+}
+
+// do authorises and sends req, as with httpfs.Do.
+func (fs *FileSystem) do(req *http.Request, want ...int) (*http.Response, error) {
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", version)
+	if err := fs.auth.Authorize(req); err != nil {
+		return nil, fmt.Errorf("authorize: %w", err)
+	}
+	return httpfs.Do(fs.client, req, want...)
+}
@@ -0,0 +1,104 @@
+package azblob_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/azblob"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/internal/azuretest"
+)
+
+func TestFileSystem(t *testing.T) {
+	key, err := azblob.NewSharedKey(azuretest.Account, "c29tZSBrZXk=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := azblob.ParseSAS("?sv=2019-12-12&sp=rwd&sig=c29tZSBzaWduYXR1cmU%3D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, prefix string
+		auth         azblob.Authorizer
+	}{
+		{name: "SharedKey", auth: key},
+		{name: "SAS", prefix: "some/prefix", auth: sas},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+				srv := azuretest.NewServer()
+				t.Cleanup(srv.Close)
+				return azblob.New(http.DefaultClient, srv.Endpoint(), "kipp", tt.prefix, tt.auth)
+			})
+		})
+	}
+}
+
+// TestSharedKey checks signatures against those made by the Azure Storage SDK
+// for Go, github.com/Azure/azure-storage-blob-go, with Azurite's well-known
+// development account key.
+func TestSharedKey(t *testing.T) {
+	key, err := azblob.NewSharedKey("devstoreaccount1", "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		method, url string
+		length      int64
+		header      map[string]string
+		want        string
+	}{{
+		method: http.MethodPut,
+		url:    "http://127.0.0.1:10000/devstoreaccount1/kipp/some%20dir/blob?timeout=61",
+		length: 5,
+		header: map[string]string{
+			"X-Ms-Blob-Cache-Control":       "",
+			"X-Ms-Blob-Content-Disposition": "",
+			"X-Ms-Blob-Content-Encoding":    "",
+			"X-Ms-Blob-Content-Language":    "",
+			"X-Ms-Blob-Content-Type":        "application/octet-stream",
+			"X-Ms-Blob-Type":                "BlockBlob",
+			"X-Ms-Client-Request-Id":        "0b7ff6f1-04a1-41d4-6e00-654d3822e826",
+			"X-Ms-Date":                     "Mon, 19 Oct 2026 00:29:05 GMT",
+			"X-Ms-Version":                  "2020-10-02",
+		},
+		want: "SharedKey devstoreaccount1:CZV/f3c4wSRxCBUBjJq6q21rHuTRuUHYHsPqxqZpzsA=",
+	}, {
+		method: http.MethodGet,
+		url:    "http://127.0.0.1:10000/devstoreaccount1/kipp/some%20dir/blob?timeout=61",
+		header: map[string]string{
+			"X-Ms-Client-Request-Id": "2fd00cba-b475-4a9c-7c64-884d227fa243",
+			"X-Ms-Date":              "Mon, 19 Oct 2026 00:29:05 GMT",
+			"X-Ms-Range":             "bytes=5-",
+			"X-Ms-Version":           "2020-10-02",
+		},
+		want: "SharedKey devstoreaccount1:A3yq4nyYSUnQlkr7B9SBiV/5HqQIysgKK5hxyuwrtHA=",
+	}, {
+		method: http.MethodGet,
+		url:    "http://127.0.0.1:10000/devstoreaccount1/kipp?comp=list&prefix=some&restype=container&timeout=61",
+		header: map[string]string{
+			"X-Ms-Client-Request-Id": "0181cf34-be2b-4f75-4344-fd3699f8d5ff",
+			"X-Ms-Date":              "Mon, 19 Oct 2026 00:29:05 GMT",
+			"X-Ms-Version":           "2020-10-02",
+		},
+		want: "SharedKey devstoreaccount1:Wwu+KXvWGm89xICHIbJS/OmboI7v6uP9xoHpHeQ1VQI=",
+	}} {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = tt.length
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if err := key.Authorize(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != tt.want {
+			t.Errorf("%s %s: unexpected signature; got %q, want %q", tt.method, tt.url, got, tt.want)
+		}
+	}
+}
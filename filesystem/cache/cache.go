@@ -0,0 +1,379 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// A FileSystem keeps recently used objects from another, typically remote,
+// filesystem in a size-bounded local directory. Objects are cached when
+// created, and when first opened. It is safe for concurrent use.
+type FileSystem struct {
+	fs       filesystem.FileSystem
+	dir, tmp string
+	max      int64
+
+	mu      sync.Mutex
+	size    int64
+	ll      *list.List
+	entries map[string]*list.Element
+	fills   map[string]chan struct{}
+	// large are the names of objects which are too large to be cached, so
+	// they're opened from the underlying filesystem directly.
+	large map[string]bool
+	// gens are the generations of the names of objects being written to
+	// the cache.
+	gens map[string]*generation
+}
+
+// A generation counts how many times a name has been invalidated while its
+// object is written to the cache, so writes of since removed or replaced
+// objects can be dropped. It's forgotten once there are no more writers.
+type generation struct {
+	n       uint64
+	writers int
+}
+
+// A write is of an object to the cache, started at generation n.
+type write struct {
+	gen *generation
+	n   uint64
+}
+
+// maxLarge bounds how many names of large objects are remembered. Once
+// reached, they're forgotten, and found again as they're opened.
+const maxLarge = 1 << 14
+
+type entry struct {
+	name string
+	size int64
+}
+
+// New creates a new FileSystem which caches objects from fs in dir, up to a
+// total of max bytes. Files already in dir are indexed, so the cache survives
+// restarts.
+func New(fs filesystem.FileSystem, dir string, max int64) (*FileSystem, error) {
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+
+	c := &FileSystem{
+		fs:      fs,
+		dir:     dir,
+		tmp:     tmp,
+		max:     max,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+		fills:   make(map[string]chan struct{}),
+		large:   make(map[string]bool),
+		gens:    make(map[string]*generation),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			c.add(fi.Name(), fi.Size())
+		}
+	}
+	return c, nil
+}
+
+// Create writes r through to the underlying filesystem, caching a copy
+// locally. Failing to cache the copy does not fail the create.
+func (c *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	c.invalidate(name)
+
+	f, err := ioutil.TempFile(c.tmp, "kipp")
+	if err != nil {
+		return c.fs.Create(ctx, name, r)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := &limitWriter{w: f, n: c.max}
+	if err := c.fs.Create(ctx, name, io.TeeReader(r, w)); err != nil {
+		return err
+	}
+	// Fills which began before the object was replaced are dropped.
+	c.invalidate(name)
+	wr := c.begin(name)
+	defer c.end(name)
+	switch w.err {
+	case nil:
+		c.commit(f, name, c.max-w.n, wr)
+	case errTooLarge:
+		c.setLarge(name)
+	}
+	return nil
+}
+
+// Open opens the named object from the cache, filling it from the underlying
+// filesystem first if needed. Objects too large to be cached are opened from
+// the underlying filesystem directly.
+func (c *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	for {
+		c.mu.Lock()
+		if el, ok := c.entries[name]; ok {
+			c.ll.MoveToFront(el)
+			c.mu.Unlock()
+			if f, err := c.open(name); err == nil {
+				return f, nil
+			}
+			// The file went missing, so refill it.
+			c.invalidate(name)
+			continue
+		}
+		if c.large[name] {
+			c.mu.Unlock()
+			return c.fs.Open(ctx, name)
+		}
+		if done, ok := c.fills[name]; ok {
+			c.mu.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		c.fills[name] = done
+		c.mu.Unlock()
+
+		f, err := c.fill(ctx, name)
+
+		c.mu.Lock()
+		delete(c.fills, name)
+		c.mu.Unlock()
+		close(done)
+		return f, err
+	}
+}
+
+// fill copies the named object from the underlying filesystem to the cache,
+// and opens it. Objects which are too large to be cached are remembered, and
+// opened from the underlying filesystem directly, as are those which couldn't
+// be cached.
+func (c *FileSystem) fill(ctx context.Context, name string) (filesystem.Reader, error) {
+	wr := c.begin(name)
+	defer c.end(name)
+
+	r, err := c.fs.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	if size > c.max {
+		c.setLarge(name)
+		return r, nil
+	}
+
+	f, err := ioutil.TempFile(c.tmp, "kipp")
+	if err != nil {
+		return r, nil
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := &limitWriter{w: f, n: c.max}
+	if _, err := io.Copy(w, io.LimitReader(r, size)); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("copy: %w", err)
+	}
+	if w.err != nil {
+		// The cache is unwritable.
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("seek: %w", err)
+		}
+		return r, nil
+	}
+
+	if c.commit(f, name, c.max-w.n, wr) {
+		if f, err := c.open(name); err == nil {
+			r.Close()
+			return f, nil
+		}
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	return r, nil
+}
+
+// begin starts a write of the named object to the cache.
+func (c *FileSystem) begin(name string) write {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.gens[name]
+	if !ok {
+		g = &generation{}
+		c.gens[name] = g
+	}
+	g.writers++
+	return write{gen: g, n: g.n}
+}
+
+// end finishes a write of the named object to the cache.
+func (c *FileSystem) end(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.gens[name]
+	if g.writers--; g.writers == 0 {
+		delete(c.gens, name)
+	}
+}
+
+// setLarge remembers that the named object is too large to be cached.
+func (c *FileSystem) setLarge(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.large) >= maxLarge {
+		c.large = make(map[string]bool)
+	}
+	c.large[name] = true
+}
+
+// commit links the temporary file f into the cache as name, and evicts the
+// least recently used objects until the cache fits. It reports whether the
+// object was cached, which it isn't if name was invalidated since wr began.
+func (c *FileSystem) commit(f *os.File, name string, size int64, wr write) bool {
+	if err := f.Close(); err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wr.gen.n != wr.n {
+		return false
+	}
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+	p := filepath.Join(c.dir, name)
+	os.Remove(p)
+	if err := os.Link(f.Name(), p); err != nil {
+		return false
+	}
+	c.add(name, size)
+	for c.size > c.max {
+		c.remove(c.ll.Back())
+	}
+	_, ok := c.entries[name]
+	return ok
+}
+
+// Walk lists the objects of the underlying filesystem, regardless of whether
+// they're cached.
+func (c *FileSystem) Walk(ctx context.Context, fn func(filesystem.Object) error) error {
+	return filesystem.Walk(ctx, c.fs, fn)
+}
+
+// Remove removes the named object from the cache, and the underlying
+// filesystem.
+func (c *FileSystem) Remove(ctx context.Context, name string) error {
+	c.invalidate(name)
+	err := c.fs.Remove(ctx, name)
+	// Fills which began before the object was removed are dropped.
+	c.invalidate(name)
+	return err
+}
+
+func (c *FileSystem) open(name string) (*os.File, error) {
+	p := filepath.Join(c.dir, name)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	// Best effort, so the order of the cache survives restarts.
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return f, nil
+}
+
+// invalidate removes the named object from the cache, and drops any writes of
+// it in progress.
+func (c *FileSystem) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if g, ok := c.gens[name]; ok {
+		g.n++
+	}
+	delete(c.large, name)
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+}
+
+// add adds the named object to the front of the cache. c.mu must be held.
+func (c *FileSystem) add(name string, size int64) {
+	c.entries[name] = c.ll.PushFront(&entry{name: name, size: size})
+	c.size += size
+}
+
+// remove removes el from the cache. c.mu must be held.
+func (c *FileSystem) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*entry)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	os.Remove(filepath.Join(c.dir, e.name))
+}
+
+// limitWriter writes to w until n bytes have been written, or a write fails.
+// Further writes are discarded, and err is set. It never fails, so it can be
+// used with io.TeeReader without affecting the reader.
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+var errTooLarge = errors.New("too large")
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if int64(len(p)) > w.n {
+		w.err = errTooLarge
+		return len(p), nil
+	}
+	n, err := w.w.Write(p)
+	w.n -= int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return len(p), nil
+}
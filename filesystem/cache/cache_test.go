@@ -0,0 +1,239 @@
+package cache_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/cache"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/memory"
+)
+
+func TestFileSystem(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		fs, err := cache.New(memory.New(0), t.TempDir(), 4<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+// countingFileSystem counts the number of times each object is opened, and
+// the number of bytes read from them.
+type countingFileSystem struct {
+	filesystem.FileSystem
+	opens map[string]int
+	reads map[string]int
+}
+
+func (fs *countingFileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	fs.opens[name]++
+	f, err := fs.FileSystem.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return countingReader{Reader: f, n: fs.reads, name: name}, nil
+}
+
+type countingReader struct {
+	filesystem.Reader
+	n    map[string]int
+	name string
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n[r.name] += n
+	return n, err
+}
+
+func read(t *testing.T, fs filesystem.FileSystem, name string) string {
+	t.Helper()
+	f, err := fs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func newCountingFileSystem() *countingFileSystem {
+	return &countingFileSystem{
+		FileSystem: memory.New(0),
+		opens:      make(map[string]int),
+		reads:      make(map[string]int),
+	}
+}
+
+func TestFileSystemCaching(t *testing.T) {
+	ctx := context.Background()
+	backing := newCountingFileSystem()
+	for name, content := range map[string]string{
+		"a":     "aaaa",
+		"b":     "bbbb",
+		"large": "too large to cache",
+	} {
+		if err := backing.Create(ctx, name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	fs, err := cache.New(backing, dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if got, want := read(t, fs, "a"), "aaaa"; got != want {
+			t.Fatalf("unexpected content; got %q, want %q", got, want)
+		}
+		if got, want := read(t, fs, "large"), "too large to cache"; got != want {
+			t.Fatalf("unexpected content; got %q, want %q", got, want)
+		}
+	}
+	if got, want := backing.opens["a"], 1; got != want {
+		t.Fatalf("a was opened %d times from the backing filesystem, want %d", got, want)
+	}
+	if got, want := backing.opens["large"], 2; got != want {
+		t.Fatalf("large was opened %d times from the backing filesystem, want %d", got, want)
+	}
+	// Objects which are too large are only read as they're served.
+	if got, want := backing.reads["large"], 2*len("too large to cache"); got != want {
+		t.Fatalf("%d bytes of large were read from the backing filesystem, want %d", got, want)
+	}
+
+	// Creating c writes through, and evicts a, the least recently used.
+	read(t, fs, "b")
+	if err := fs.Create(ctx, "c", strings.NewReader("cccc")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(t, backing, "c"), "cccc"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(dir + "/a"); !os.IsNotExist(err) {
+		t.Fatalf("a was not evicted; got %v", err)
+	}
+	read(t, fs, "c")
+	if got, want := backing.opens["c"], 1; got != want {
+		t.Fatalf("c was opened %d times from the backing filesystem, want %d", got, want)
+	}
+
+	// The cache survives restarts.
+	if fs, err = cache.New(backing, dir, 8); err != nil {
+		t.Fatal(err)
+	}
+	read(t, fs, "b")
+	if got, want := backing.opens["b"], 1; got != want {
+		t.Fatalf("b was opened %d times from the backing filesystem, want %d", got, want)
+	}
+
+	if err := fs.Remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(ctx, "b"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+// blockingFileSystem blocks the first read of each object opened, until
+// unblock is closed, signalling started once it's blocked.
+type blockingFileSystem struct {
+	filesystem.FileSystem
+	started, unblock chan struct{}
+}
+
+func (fs blockingFileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	f, err := fs.FileSystem.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingReader{Reader: f, fs: fs}, nil
+}
+
+type blockingReader struct {
+	filesystem.Reader
+	fs    blockingFileSystem
+	reads int
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if r.reads++; r.reads == 1 {
+		r.fs.started <- struct{}{}
+		<-r.fs.unblock
+	}
+	return r.Reader.Read(p)
+}
+
+func TestFileSystemRemoveDuringFill(t *testing.T) {
+	ctx := context.Background()
+	backing := blockingFileSystem{
+		FileSystem: memory.New(0),
+		started:    make(chan struct{}, 1),
+		unblock:    make(chan struct{}),
+	}
+	if err := backing.FileSystem.Create(ctx, "a", strings.NewReader("aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := cache.New(backing, t.TempDir(), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan string)
+	go func() {
+		var b []byte
+		f, err := fs.Open(ctx, "a")
+		if err == nil {
+			b, err = ioutil.ReadAll(f)
+			f.Close()
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		done <- string(b)
+	}()
+	<-backing.started
+	if err := fs.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	close(backing.unblock)
+	if got, want := <-done, "aaaa"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+
+	// The fill was overtaken by the remove, so isn't cached.
+	if _, err := fs.Open(ctx, "a"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestFileSystemCommitFailure(t *testing.T) {
+	ctx := context.Background()
+	backing := memory.New(0)
+	if err := backing.Create(ctx, "a", strings.NewReader("aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in the way of a stops it from being cached.
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := cache.New(backing, dir, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(t, fs, "a"), "aaaa"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A codec compresses and decompresses single frames.
+type codec interface {
+	id() byte
+	encoding() string
+	encode(dst, src []byte) ([]byte, error)
+	decode(dst, src []byte) ([]byte, error)
+}
+
+var codecs = map[string]codec{}
+
+func init() {
+	for _, c := range []codec{newZstdCodec(), gzipCodec{}} {
+		codecs[c.encoding()] = c
+	}
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCodec() zstdCodec {
+	// Neither can fail without options which may be invalid. Both encode
+	// and decode up to GOMAXPROCS frames at once, so they're shared by
+	// every upload and download.
+	enc, _ := zstd.NewWriter(nil)
+	dec, _ := zstd.NewReader(nil)
+	return zstdCodec{enc: enc, dec: dec}
+}
+
+func (zstdCodec) id() byte { return 1 }
+
+func (zstdCodec) encoding() string { return "zstd" }
+
+func (c zstdCodec) encode(dst, src []byte) ([]byte, error) { return c.enc.EncodeAll(src, dst), nil }
+
+func (c zstdCodec) decode(dst, src []byte) ([]byte, error) { return c.dec.DecodeAll(src, dst) }
+
+type gzipCodec struct{}
+
+func (gzipCodec) id() byte { return 2 }
+
+func (gzipCodec) encoding() string { return "gzip" }
+
+func (gzipCodec) encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) decode(dst, src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, b...), nil
+}
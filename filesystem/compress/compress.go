@@ -0,0 +1,170 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// FrameSize is the size of plaintext compressed into each frame. Seeking
+// requires decompressing at most one frame.
+const FrameSize = 256 << 10
+
+// sampleSize is the size of the sample used to decide whether an object is
+// worth compressing.
+const sampleSize = 64 << 10
+
+const (
+	magic      = "kippcmp\x01"
+	headerSize = len(magic) + 1
+	footerSize = 4 + len(magic)
+	entrySize  = 8
+)
+
+// A FileSystem compresses objects which are worth compressing before they're
+// written to another filesystem, and decompresses them as they're read.
+//
+// Compressed objects are stored as a sequence of independently compressed
+// frames, followed by an index of their sizes, so readers can seek. The
+// frames alone are a valid stream in their encoding, so can be served to
+// clients as is. Objects which aren't worth compressing are stored as is.
+type FileSystem struct {
+	fs    filesystem.FileSystem
+	codec codec
+	ratio float64
+}
+
+// New creates a new FileSystem which compresses objects written to fs with the
+// named encoding, either "zstd" or "gzip". Objects are only compressed if a
+// sample compresses to at most ratio of its original size.
+func New(fs filesystem.FileSystem, encoding string, ratio float64) (*FileSystem, error) {
+	c, ok := codecs[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+	return &FileSystem{fs: fs, codec: c, ratio: ratio}, nil
+}
+
+// Create writes r to the underlying filesystem, compressing it if worthwhile.
+func (fs *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	br := bufio.NewReaderSize(r, sampleSize)
+	sample, err := br.Peek(sampleSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("peek: %w", err)
+	}
+	// Objects which look compressed must always be compressed, so they're
+	// never confused with one.
+	if !bytes.HasPrefix(sample, []byte(magic)) && !fs.compressible(sample) {
+		return fs.fs.Create(ctx, name, br)
+	}
+	return fs.fs.Create(ctx, name, filesystem.PipeReader(func(w io.Writer) error {
+		if _, err := w.Write(append([]byte(magic), fs.codec.id())); err != nil {
+			return err
+		}
+		var (
+			index []byte
+			buf   = make([]byte, FrameSize)
+			dst   []byte
+			n     uint32
+		)
+		for {
+			m, err := io.ReadFull(br, buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if dst, err = fs.codec.encode(dst[:0], buf[:m]); err != nil {
+				return fmt.Errorf("encode: %w", err)
+			}
+			if _, err := w.Write(dst); err != nil {
+				return err
+			}
+			index = appendEntry(index, uint32(len(dst)), uint32(m))
+			n++
+		}
+		var footer [footerSize]byte
+		binary.LittleEndian.PutUint32(footer[:], n)
+		copy(footer[4:], magic)
+		_, err := w.Write(append(index, footer[:]...))
+		return err
+	}))
+}
+
+func appendEntry(b []byte, csize, dsize uint32) []byte {
+	var e [entrySize]byte
+	binary.LittleEndian.PutUint32(e[:], csize)
+	binary.LittleEndian.PutUint32(e[4:], dsize)
+	return append(b, e[:]...)
+}
+
+// compressible reports whether the sample is worth compressing. Media and
+// archives are typically compressed already, so are skipped, and anything
+// else is skipped if a trial compression of the sample doesn't save enough.
+func (fs *FileSystem) compressible(sample []byte) bool {
+	if len(sample) < 1<<10 {
+		return false
+	}
+	ctype := http.DetectContentType(sample)
+	for _, prefix := range []string{
+		"image/",
+		"audio/",
+		"video/",
+		"font/woff",
+		"application/ogg",
+		"application/pdf",
+		"application/zip",
+		"application/x-gzip",
+		"application/x-rar-compressed",
+	} {
+		if strings.HasPrefix(ctype, prefix) && ctype != "image/bmp" && ctype != "audio/wave" {
+			return false
+		}
+	}
+	b, err := fs.codec.encode(nil, sample)
+	if err != nil {
+		return false
+	}
+	return float64(len(b)) <= fs.ratio*float64(len(sample))
+}
+
+// Open opens the named object, decompressing it if needed.
+func (fs *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	f, err := fs.fs.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReader(f)
+	if errors.Is(err, errNotCompressed) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("seek: %w", err)
+		}
+		return f, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return r, nil
+}
+
+// Walk lists the objects of the underlying filesystem. Sizes are of the
+// stored, possibly compressed, objects.
+func (fs *FileSystem) Walk(ctx context.Context, fn func(filesystem.Object) error) error {
+	return filesystem.Walk(ctx, fs.fs, fn)
+}
+
+// Remove removes the named object.
+func (fs *FileSystem) Remove(ctx context.Context, name string) error {
+	return fs.fs.Remove(ctx, name)
+}
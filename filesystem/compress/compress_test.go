@@ -0,0 +1,173 @@
+package compress_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/compress"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/memory"
+)
+
+// logs returns n bytes of compressible, log-like content.
+func logs(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "2020-08-22T12:00:00Z level=info msg=\"request served\" id=%d\n", i)
+	}
+	return buf.Bytes()[:n]
+}
+
+func size(t *testing.T, fs filesystem.FileSystem, name string) int64 {
+	t.Helper()
+	f, err := fs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFileSystem(t *testing.T) {
+	for _, encoding := range []string{"zstd", "gzip"} {
+		t.Run(encoding, func(t *testing.T) {
+			filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+				fs, err := compress.New(memory.New(0), encoding, 0.9)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return fs
+			})
+		})
+	}
+}
+
+func TestFileSystemCompresses(t *testing.T) {
+	for _, encoding := range []string{"zstd", "gzip"} {
+		t.Run(encoding, func(t *testing.T) {
+			ctx := context.Background()
+			mem := memory.New(0)
+			fs, err := compress.New(mem, encoding, 0.9)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := logs(3*compress.FrameSize + 123)
+			if err := fs.Create(ctx, "logs", bytes.NewReader(want)); err != nil {
+				t.Fatal(err)
+			}
+			if n := size(t, mem, "logs"); n*4 > int64(len(want)) {
+				t.Fatalf("stored %d bytes for %d bytes of logs", n, len(want))
+			}
+
+			f, err := fs.Open(ctx, "logs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			// Seek across frame boundaries in both directions.
+			for _, off := range []int64{2*compress.FrameSize - 10, 17, int64(len(want)) - 5, compress.FrameSize} {
+				if _, err := f.Seek(off, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				b := make([]byte, 20)
+				n, err := io.ReadFull(f, b)
+				if err != nil && err != io.ErrUnexpectedEOF {
+					t.Fatal(err)
+				}
+				if got := b[:n]; !bytes.Equal(got, want[off:off+int64(n)]) {
+					t.Fatalf("read at %d = %q, want %q", off, got, want[off:off+int64(n)])
+				}
+			}
+		})
+	}
+}
+
+func TestFileSystemSkipsIncompressible(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New(0)
+	fs, err := compress.New(mem, "zstd", 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 128<<10)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, "random", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := size(t, mem, "random"), int64(len(b)); got != want {
+		t.Fatalf("stored %d bytes, want %d", got, want)
+	}
+}
+
+func TestFileSystemEncoded(t *testing.T) {
+	ctx := context.Background()
+	fs, err := compress.New(memory.New(0), "gzip", 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := logs(2*compress.FrameSize + 1)
+	if err := fs.Create(ctx, "logs", bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open(ctx, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	er, ok := f.(filesystem.EncodedReader)
+	if !ok {
+		f.Close()
+		t.Fatal("reader does not implement filesystem.EncodedReader")
+	}
+	if got, want := er.Encoding(), "gzip"; got != want {
+		t.Fatalf("encoding = %q, want %q", got, want)
+	}
+	r, n, err := er.Encoded()
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(b)) != n {
+		t.Fatalf("read %d encoded bytes, want %d", len(b), n)
+	}
+	// The frames are gzip members, which decode as a single stream.
+	got, err := ioutil.ReadAll(mustGzip(t, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("decoded contents differ")
+	}
+}
+
+func TestNewUnsupportedEncoding(t *testing.T) {
+	if _, err := compress.New(memory.New(0), "lz4", 0.9); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func mustGzip(t *testing.T, b []byte) io.Reader {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
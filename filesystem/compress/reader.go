@@ -0,0 +1,216 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+var errNotCompressed = errors.New("not compressed")
+
+// frame describes a single compressed frame.
+type frame struct {
+	// coff and doff are the offsets of the frame in the compressed and
+	// decompressed streams respectively.
+	coff, doff   int64
+	csize, dsize int64
+}
+
+type reader struct {
+	filesystem.Reader
+	codec  codec
+	frames []frame
+	// start and end are the bounds of the frames in the underlying reader.
+	start, end int64
+	size       int64
+	offset     int64
+	// buf holds the decompressed contents of frame i, or is nil.
+	i   int
+	buf []byte
+	src []byte
+}
+
+var _ filesystem.EncodedReader = (*reader)(nil)
+
+// newReader parses the header and index of f. If f is not compressed, it
+// returns errNotCompressed.
+func newReader(f filesystem.Reader) (*reader, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	if size < int64(headerSize+footerSize) {
+		return nil, errNotCompressed
+	}
+	var header [headerSize]byte
+	if err := readAt(f, header[:], 0); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	var footer [footerSize]byte
+	if err := readAt(f, footer[:], size-int64(footerSize)); err != nil {
+		return nil, fmt.Errorf("read footer: %w", err)
+	}
+	if string(header[:len(magic)]) != magic || string(footer[4:]) != magic {
+		return nil, errNotCompressed
+	}
+	var c codec
+	for _, v := range codecs {
+		if v.id() == header[len(magic)] {
+			c = v
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("unsupported codec: %d", header[len(magic)])
+	}
+	n := int64(binary.LittleEndian.Uint32(footer[:]))
+	end := size - int64(footerSize) - n*entrySize
+	if end < int64(headerSize) {
+		return nil, errors.New("malformed index")
+	}
+	index := make([]byte, n*entrySize)
+	if err := readAt(f, index, end); err != nil {
+		return nil, fmt.Errorf("read index: %w", err)
+	}
+	r := &reader{
+		Reader: f,
+		codec:  c,
+		frames: make([]frame, n),
+		start:  int64(headerSize),
+		end:    end,
+		i:      -1,
+	}
+	coff := r.start
+	for i := range r.frames {
+		b := index[i*entrySize:]
+		fr := frame{
+			coff:  coff,
+			doff:  r.size,
+			csize: int64(binary.LittleEndian.Uint32(b)),
+			dsize: int64(binary.LittleEndian.Uint32(b[4:])),
+		}
+		r.frames[i] = fr
+		coff += fr.csize
+		r.size += fr.dsize
+	}
+	if coff != end {
+		return nil, errors.New("malformed index")
+	}
+	return r, nil
+}
+
+func readAt(r io.ReadSeeker, b []byte, off int64) error {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, b)
+	return err
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.frames), func(i int) bool {
+		return r.frames[i].doff+r.frames[i].dsize > r.offset
+	})
+	if i != r.i {
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf[r.offset-r.frames[i].doff:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decodes frame i into buf.
+func (r *reader) load(i int) error {
+	fr := r.frames[i]
+	if int64(cap(r.src)) < fr.csize {
+		r.src = make([]byte, fr.csize)
+	}
+	r.src = r.src[:fr.csize]
+	if err := readAt(r.Reader, r.src, fr.coff); err != nil {
+		return fmt.Errorf("read frame: %w", err)
+	}
+	buf, err := r.codec.decode(r.buf[:0], r.src)
+	if err != nil {
+		r.i = -1
+		return fmt.Errorf("decode frame: %w", err)
+	}
+	if int64(len(buf)) != fr.dsize {
+		r.i = -1
+		return errors.New("decode frame: size mismatch")
+	}
+	r.i, r.buf = i, buf
+	return nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *reader) Encoding() string { return r.codec.encoding() }
+
+func (r *reader) Encoded() (filesystem.Reader, int64, error) {
+	if _, err := r.Reader.Seek(r.start, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("seek: %w", err)
+	}
+	return &section{Reader: r.Reader, start: r.start, size: r.end - r.start}, r.end - r.start, nil
+}
+
+// section is a seekable view of the frames in the underlying reader, which
+// together are a valid stream in their encoding.
+type section struct {
+	filesystem.Reader
+	start, size, offset int64
+}
+
+func (s *section) Read(b []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if max := s.size - s.offset; int64(len(b)) > max {
+		b = b[:max]
+	}
+	n, err := s.Reader.Read(b)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *section) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if _, err := s.Reader.Seek(s.start+offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	s.offset = offset
+	return offset, nil
+}
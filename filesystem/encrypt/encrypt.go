@@ -0,0 +1,294 @@
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// ChunkSize is the default size of each encrypted chunk of plaintext.
+const ChunkSize = 64 << 10
+
+// KeySize is the size of key-encryption and data keys.
+const KeySize = 32
+
+const (
+	// magic begins the header of objects. Data keys are wrapped with the
+	// name of the object, so objects can't be swapped; objects whose magic
+	// is legacyMagic were encrypted before they were.
+	magic       = "kippenc\x02"
+	legacyMagic = "kippenc\x01"
+	headerSize  = len(magic) + 4 + idSize + nonceSize + KeySize + tagSize
+	idSize      = 8
+	nonceSize   = 12
+	tagSize     = 16
+)
+
+// ErrNotEncrypted is returned by Rekey for objects which weren't encrypted,
+// such as those written to the underlying filesystem directly.
+var ErrNotEncrypted = errors.New("not encrypted")
+
+// A Key is a key-encryption key, used to wrap the data key of each object.
+type Key struct {
+	id   [idSize]byte
+	aead cipher.AEAD
+}
+
+// NewKey creates a Key from a KeySize byte secret.
+func NewKey(b []byte) (*Key, error) {
+	if len(b) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d, want %d", len(b), KeySize)
+	}
+	aead, err := newAEAD(b)
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{aead: aead}
+	sum := sha256.Sum256(b)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// ReadKeyFile reads a base64 encoded key from the named file.
+func ReadKeyFile(name string) (*Key, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	k, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", name, err)
+	}
+	return NewKey(k)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+	return cipher.NewGCM(b)
+}
+
+// A FileSystem encrypts objects before they're written to another
+// filesystem, and decrypts them as they're read.
+//
+// Each object is encrypted with its own random data key, which is wrapped by
+// a key-encryption key and stored in the object's header. The plaintext is
+// split into chunks which are sealed separately with AES-256-GCM, so readers
+// can seek without decrypting from the start.
+type FileSystem struct {
+	fs    filesystem.FileSystem
+	keys  []*Key
+	chunk int
+}
+
+// New creates a new FileSystem which encrypts objects written to fs with the
+// first key. The remaining keys are only used to decrypt existing objects, so
+// keys can be rotated.
+func New(fs filesystem.FileSystem, keys ...*Key) (*FileSystem, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key is required")
+	}
+	return &FileSystem{fs: fs, keys: keys, chunk: ChunkSize}, nil
+}
+
+// Create encrypts r, and writes it to the underlying filesystem.
+func (fs *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	var dk [KeySize]byte
+	if _, err := io.ReadFull(rand.Reader, dk[:]); err != nil {
+		return err
+	}
+	aead, err := newAEAD(dk[:])
+	if err != nil {
+		return err
+	}
+	h, err := fs.header(dk[:], name)
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	return fs.fs.Create(ctx, name, filesystem.PipeReader(func(w io.Writer) error {
+		if _, err := w.Write(h); err != nil {
+			return err
+		}
+		br := bufio.NewReader(r)
+		buf := make([]byte, fs.chunk, fs.chunk+tagSize)
+		for i := uint64(0); ; i++ {
+			n, err := io.ReadFull(br, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			// The final chunk is sealed differently, so truncation is
+			// detected.
+			last := err != nil
+			if !last {
+				if _, err := br.Peek(1); err == io.EOF {
+					last = true
+				} else if err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(aead.Seal(buf[:0], nonce(i, last), buf[:n], h[:len(magic)+4])); err != nil {
+				return err
+			}
+			if last {
+				return nil
+			}
+		}
+	}))
+}
+
+// header returns a new header for the named object, with the data key dk
+// wrapped by the primary key.
+func (fs *FileSystem) header(dk []byte, name string) ([]byte, error) {
+	h := make([]byte, len(magic)+4, headerSize)
+	copy(h, magic)
+	binary.BigEndian.PutUint32(h[len(magic):], uint32(fs.chunk))
+	return wrap(fs.keys[0], h, dk, name)
+}
+
+// wrap appends the id of k, and the data key dk sealed by k, to h, which is
+// the header of the named object.
+func wrap(k *Key, h, dk []byte, name string) ([]byte, error) {
+	h = append(h[:len(magic)+4], k.id[:]...)
+	var n [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, n[:]); err != nil {
+		return nil, err
+	}
+	h = append(h, n[:]...)
+	return k.aead.Seal(h, n[:], dk, wrapAD(h, name)), nil
+}
+
+// wrapAD returns the additional data data keys are sealed with, which is the
+// header h so far, and the name of the object, unless it's a legacy header.
+func wrapAD(h []byte, name string) []byte {
+	if string(h[:len(magic)]) == legacyMagic {
+		return h
+	}
+	return append(h[:len(h):len(h)], name...)
+}
+
+// unwrap parses the header h of the named object, and returns the key it was
+// wrapped with, its data key and chunk size.
+func (fs *FileSystem) unwrap(h []byte, name string) (*Key, []byte, int, error) {
+	if len(h) != headerSize || (string(h[:len(magic)]) != magic && string(h[:len(magic)]) != legacyMagic) {
+		return nil, nil, 0, errors.New("invalid header")
+	}
+	chunk := int(binary.BigEndian.Uint32(h[len(magic):]))
+	id := h[len(magic)+4 : len(magic)+4+idSize]
+	for _, k := range fs.keys {
+		if !bytes.Equal(k.id[:], id) {
+			continue
+		}
+		i := len(magic) + 4 + idSize
+		dk, err := k.aead.Open(nil, h[i:i+nonceSize], h[i+nonceSize:], wrapAD(h[:i+nonceSize], name))
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("unwrap data key: %w", err)
+		}
+		return k, dk, chunk, nil
+	}
+	return nil, nil, 0, fmt.Errorf("unknown key %x", id)
+}
+
+// encrypted reports whether h begins with the magic of an encrypted object.
+func encrypted(h []byte) bool {
+	return bytes.HasPrefix(h, []byte(magic)) || bytes.HasPrefix(h, []byte(legacyMagic))
+}
+
+// nonce returns the nonce for the i'th chunk.
+func nonce(i uint64, last bool) []byte {
+	var n [nonceSize]byte
+	binary.BigEndian.PutUint64(n[3:], i)
+	if last {
+		n[nonceSize-1] = 1
+	}
+	return n[:]
+}
+
+// Open opens and decrypts the named object.
+func (fs *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	f, err := fs.fs.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReader(fs, name, f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return r, nil
+}
+
+// Walk lists the objects of the underlying filesystem. Sizes are of the
+// encrypted objects.
+func (fs *FileSystem) Walk(ctx context.Context, fn func(filesystem.Object) error) error {
+	return filesystem.Walk(ctx, fs.fs, fn)
+}
+
+// Remove removes the named object.
+func (fs *FileSystem) Remove(ctx context.Context, name string) error {
+	return fs.fs.Remove(ctx, name)
+}
+
+// Rekey rewraps the data key of the named object with the primary key, if it
+// was wrapped with another key. The encrypted contents are copied as is,
+// unless the object was encrypted before objects were bound to their names,
+// in which case it's encrypted again. It reports whether the object was
+// rewritten, and returns ErrNotEncrypted if the object wasn't encrypted.
+func (fs *FileSystem) Rekey(ctx context.Context, name string) (bool, error) {
+	f, err := fs.fs.Open(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := make([]byte, headerSize)
+	if n, err := io.ReadFull(f, h); err != nil {
+		if (err == io.EOF || err == io.ErrUnexpectedEOF) && !encrypted(h[:n]) {
+			return false, ErrNotEncrypted
+		}
+		return false, fmt.Errorf("read header: %w", err)
+	}
+	if !encrypted(h) {
+		return false, ErrNotEncrypted
+	}
+	k, dk, _, err := fs.unwrap(h, name)
+	if err != nil {
+		return false, err
+	}
+	if string(h[:len(magic)]) == legacyMagic {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("seek: %w", err)
+		}
+		r, err := newReader(fs, name, f)
+		if err != nil {
+			return false, err
+		}
+		if err := fs.Create(ctx, name, r); err != nil {
+			return false, fmt.Errorf("create: %w", err)
+		}
+		return true, nil
+	}
+	if k == fs.keys[0] {
+		return false, nil
+	}
+	if h, err = wrap(fs.keys[0], h, dk, name); err != nil {
+		return false, fmt.Errorf("wrap: %w", err)
+	}
+	if err := fs.fs.Create(ctx, name, io.MultiReader(bytes.NewReader(h), f)); err != nil {
+		return false, fmt.Errorf("create: %w", err)
+	}
+	return true, nil
+}
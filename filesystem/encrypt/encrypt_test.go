@@ -0,0 +1,262 @@
+package encrypt_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/encrypt"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/memory"
+)
+
+func newKey(t *testing.T) *encrypt.Key {
+	t.Helper()
+	b := make([]byte, encrypt.KeySize)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	k, err := encrypt.NewKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func read(t *testing.T, fs filesystem.FileSystem, name string) []byte {
+	t.Helper()
+	f, err := fs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFileSystem(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		fs, err := encrypt.New(memory.New(0), newKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+func TestFileSystemEncrypts(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New(0)
+	fs, err := encrypt.New(mem, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("some secret content ", encrypt.ChunkSize/10)
+	if err := fs.Create(ctx, "secret", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	b := read(t, mem, "secret")
+	if bytes.Contains(b, []byte("some secret content")) {
+		t.Fatal("the underlying object contains the plaintext")
+	}
+
+	// Tamper with the final chunk.
+	b[len(b)-1] ^= 1
+	if err := mem.Create(ctx, "secret", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open(ctx, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(ioutil.Discard, f); err == nil {
+		t.Fatal("read succeeded, despite the object being tampered with")
+	}
+
+	// Truncate the final chunk.
+	if err := mem.Create(ctx, "secret", bytes.NewReader(b[:len(b)-encrypt.ChunkSize/2])); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = fs.Open(ctx, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(ioutil.Discard, f); err == nil {
+		t.Fatal("read succeeded, despite the object being truncated")
+	}
+}
+
+func TestFileSystemRekey(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New(0)
+	oldKey, newKey := newKey(t), newKey(t)
+
+	fs, err := encrypt.New(mem, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, "some-name", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = encrypt.New(mem, newKey, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []bool{true, false} {
+		ok, err := fs.Rekey(ctx, "some-name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("unexpected rekey result; got %t, want %t", ok, want)
+		}
+	}
+
+	// The old key is no longer needed.
+	if fs, err = encrypt.New(mem, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(read(t, fs, "some-name")), "some content"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+}
+
+func TestFileSystemRekeyNotEncrypted(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New(0)
+	fs, err := encrypt.New(mem, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"", "short", strings.Repeat("not encrypted", 16)} {
+		if err := mem.Create(ctx, "some-name", strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Rekey(ctx, "some-name"); !errors.Is(err, encrypt.ErrNotEncrypted) {
+			t.Fatalf("unexpected error for %q; got %v, want %v", content, err, encrypt.ErrNotEncrypted)
+		}
+	}
+}
+
+// seekCountingFileSystem counts the seeks of the objects it opens.
+type seekCountingFileSystem struct {
+	filesystem.FileSystem
+	seeks int
+}
+
+func (fs *seekCountingFileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	f, err := fs.FileSystem.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return seekCountingReader{Reader: f, fs: fs}, nil
+}
+
+type seekCountingReader struct {
+	filesystem.Reader
+	fs *seekCountingFileSystem
+}
+
+func (r seekCountingReader) Seek(offset int64, whence int) (int64, error) {
+	r.fs.seeks++
+	return r.Reader.Seek(offset, whence)
+}
+
+func TestFileSystemSequentialReads(t *testing.T) {
+	ctx := context.Background()
+	mem := &seekCountingFileSystem{FileSystem: memory.New(0)}
+	fs, err := encrypt.New(mem, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("x", 4*encrypt.ChunkSize+1)
+	if err := fs.Create(ctx, "name", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, fs, "name"); string(got) != content {
+		t.Fatalf("unexpected content; got %d bytes, want %d", len(got), len(content))
+	}
+	// Finding the size, and returning to the first chunk, are the only
+	// seeks.
+	if mem.seeks != 2 {
+		t.Fatalf("unexpected number of seeks; got %d, want 2", mem.seeks)
+	}
+}
+
+func TestFileSystemSwapped(t *testing.T) {
+	ctx := context.Background()
+	mem := memory.New(0)
+	fs, err := encrypt.New(mem, newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := fs.Create(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copying a over b is detected, as objects are bound to their names.
+	if err := mem.Create(ctx, "b", bytes.NewReader(read(t, mem, "a"))); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := fs.Open(ctx, "b"); err == nil {
+		f.Close()
+		t.Fatal("open succeeded, despite the object being swapped")
+	}
+}
+
+// legacyObject is "legacy content", encrypted with a key of 32 ones before
+// objects were bound to their names.
+const legacyObject = "a2lwcGVuYwEAAQAAcs1uhCLEB/t3YNlnh4lqE6TgC0/vaWSUuwvHntivcXZbSe3IDUEUjb5zuEmnl5Y2+rnrX/1xwVsp3/IIhrnrP7ykkA7QW+PCWoOJHgmtTDB6xrfyqx1NqhvT3ilWdlVCu2o="
+
+func TestFileSystemLegacy(t *testing.T) {
+	ctx := context.Background()
+	b, err := base64.StdEncoding.DecodeString(legacyObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := memory.New(0)
+	if err := mem.Create(ctx, "some-name", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	k, err := encrypt.NewKey(bytes.Repeat([]byte{1}, encrypt.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := encrypt.New(mem, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(read(t, fs, "some-name")), "legacy content"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+
+	// Rekeying encrypts legacy objects again, bound to their names.
+	ok, err := fs.Rekey(ctx, "some-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("legacy object was not rewritten")
+	}
+	if got, want := string(read(t, fs, "some-name")), "legacy content"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+	if bytes.Equal(read(t, mem, "some-name")[:8], b[:8]) {
+		t.Fatal("rekeyed object is still a legacy object")
+	}
+	if ok, err := fs.Rekey(ctx, "some-name"); err != nil || ok {
+		t.Fatalf("unexpected rekey; got (%t, %v), want (false, nil)", ok, err)
+	}
+}
@@ -0,0 +1,130 @@
+package encrypt
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+type reader struct {
+	r      filesystem.Reader
+	aead   cipher.AEAD
+	ad     []byte
+	chunk  int
+	size   int64
+	last   int64
+	offset int64
+	// pos is the offset of r, so it's only seeked when reads aren't
+	// sequential, as seeking may cost a request.
+	pos int64
+
+	// buf holds the plaintext of chunk i, if valid.
+	buf   []byte
+	i     int64
+	valid bool
+}
+
+func newReader(fs *FileSystem, name string, r filesystem.Reader) (*reader, error) {
+	h := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	_, dk, chunk, err := fs.unwrap(h, name)
+	if err != nil {
+		return nil, err
+	}
+	if chunk <= 0 {
+		return nil, errors.New("invalid chunk size")
+	}
+	aead, err := newAEAD(dk)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	// Every object has at least one chunk, and every chunk has a tag.
+	body := end - int64(headerSize)
+	sealed := int64(chunk + tagSize)
+	chunks := (body + sealed - 1) / sealed
+	if chunks == 0 {
+		chunks = 1
+	}
+	size := body - chunks*tagSize
+	if size < 0 {
+		return nil, errors.New("truncated")
+	}
+
+	return &reader{
+		r:     r,
+		aead:  aead,
+		ad:    h[:len(magic)+4],
+		chunk: chunk,
+		size:  size,
+		last:  chunks - 1,
+		pos:   end,
+		buf:   make([]byte, 0, chunk+tagSize),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	i := r.offset / int64(r.chunk)
+	if !r.valid || r.i != i {
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.offset-i*int64(r.chunk):])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts the i'th chunk into buf.
+func (r *reader) load(i int64) error {
+	r.valid = false
+	if off := int64(headerSize) + i*int64(r.chunk+tagSize); r.pos != off {
+		if _, err := r.r.Seek(off, io.SeekStart); err != nil {
+			r.pos = -1
+			return fmt.Errorf("seek: %w", err)
+		}
+		r.pos = off
+	}
+	n, err := io.ReadFull(r.r, r.buf[:cap(r.buf)])
+	r.pos += int64(n)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("read chunk %d: %w", i, err)
+	}
+	b, err := r.aead.Open(r.buf[:0], nonce(uint64(i), i == r.last), r.buf[:n], r.ad)
+	if err != nil {
+		return fmt.Errorf("open chunk %d: %w", i, err)
+	}
+	r.buf, r.i, r.valid = b, i, true
+	return nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error { return r.r.Close() }
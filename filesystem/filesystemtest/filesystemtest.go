@@ -0,0 +1,305 @@
+package filesystemtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// TestFileSystem runs a suite of conformance tests against the filesystems
+// returned by open. Each subtest opens a new, empty filesystem. Filesystems
+// which implement filesystem.Walker are also tested for walking.
+func TestFileSystem(t *testing.T, open func(t *testing.T) filesystem.FileSystem) {
+	for _, tt := range []struct {
+		name string
+		f    func(t *testing.T, fs filesystem.FileSystem)
+	}{
+		{name: "CreateOpen", f: testCreateOpen},
+		{name: "CreateReplace", f: testCreateReplace},
+		{name: "CreateReadError", f: testCreateReadError},
+		{name: "OpenNotFound", f: testOpenNotFound},
+		{name: "Remove", f: testRemove},
+		{name: "RemoveNotFound", f: testRemoveNotFound},
+		{name: "Seek", f: testSeek},
+		{name: "Large", f: testLarge},
+		{name: "Concurrent", f: testConcurrent},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) { tt.f(t, open(t)) })
+	}
+	t.Run("Walk", func(t *testing.T) {
+		fs, ok := open(t).(filesystem.Walker)
+		if !ok {
+			t.Skip("filesystem does not implement filesystem.Walker")
+		}
+		testWalk(t, fs)
+	})
+}
+
+// content returns n bytes of deterministic, pseudo-random content.
+func content(seed, n int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func create(t *testing.T, fs filesystem.FileSystem, name string, b []byte) {
+	t.Helper()
+	if err := fs.Create(context.Background(), name, bytes.NewReader(b)); err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+}
+
+func readFile(fs filesystem.FileSystem, name string) ([]byte, error) {
+	f, err := fs.Open(context.Background(), name)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return b, nil
+}
+
+func checkFile(t *testing.T, fs filesystem.FileSystem, name string, want []byte) {
+	t.Helper()
+	got, err := readFile(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected content for %s; got %d bytes, want %d bytes", name, len(got), len(want))
+	}
+}
+
+func checkNotExist(t *testing.T, fs filesystem.FileSystem, name string) {
+	t.Helper()
+	f, err := fs.Open(context.Background(), name)
+	if err == nil {
+		f.Close()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error opening %s; got %v, want %v", name, err, os.ErrNotExist)
+	}
+}
+
+func testCreateOpen(t *testing.T, fs filesystem.FileSystem) {
+	for name, b := range map[string][]byte{
+		"empty":  {},
+		"small":  []byte("some content"),
+		"random": content(1, 64<<10),
+	} {
+		create(t, fs, name, b)
+		checkFile(t, fs, name, b)
+	}
+
+	want := []byte("piped content")
+	if err := fs.Create(context.Background(), "piped", filesystem.PipeReader(func(w io.Writer) error {
+		_, err := w.Write(want)
+		return err
+	})); err != nil {
+		t.Fatalf("create piped: %v", err)
+	}
+	checkFile(t, fs, "piped", want)
+}
+
+func testCreateReplace(t *testing.T, fs filesystem.FileSystem) {
+	create(t, fs, "replace", []byte("old content"))
+	create(t, fs, "replace", []byte("new content"))
+	checkFile(t, fs, "replace", []byte("new content"))
+}
+
+func testCreateReadError(t *testing.T, fs filesystem.FileSystem) {
+	errRead := errors.New("some read error")
+	if err := fs.Create(context.Background(), "broken", filesystem.PipeReader(func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return errRead
+	})); err == nil {
+		t.Fatal("create succeeded, despite the reader failing")
+	}
+	checkNotExist(t, fs, "broken")
+}
+
+func testOpenNotFound(t *testing.T, fs filesystem.FileSystem) { checkNotExist(t, fs, "missing") }
+
+func testRemove(t *testing.T, fs filesystem.FileSystem) {
+	create(t, fs, "keep", []byte("keep"))
+	create(t, fs, "remove", []byte("remove"))
+	if err := fs.Remove(context.Background(), "remove"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	checkNotExist(t, fs, "remove")
+	checkFile(t, fs, "keep", []byte("keep"))
+}
+
+// testRemoveNotFound allows either no error, or an error satisfying
+// os.ErrNotExist, as some backends can't distinguish the two cheaply.
+func testRemoveNotFound(t *testing.T, fs filesystem.FileSystem) {
+	if err := fs.Remove(context.Background(), "missing"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error; got %v, want nil or %v", err, os.ErrNotExist)
+	}
+}
+
+func testSeek(t *testing.T, fs filesystem.FileSystem) {
+	b := content(2, 4096)
+	create(t, fs, "seek", b)
+
+	f, err := fs.Open(context.Background(), "seek")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	// Read a little first, to ensure seeking discards buffered state.
+	if _, err := io.ReadFull(f, make([]byte, 100)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	for _, tt := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{offset: 1000, whence: io.SeekStart, want: 1000},
+		{offset: 24, whence: io.SeekCurrent, want: 1040},
+		{offset: -96, whence: io.SeekEnd, want: 4000},
+		{offset: 0, whence: io.SeekStart, want: 0},
+	} {
+		n, err := f.Seek(tt.offset, tt.whence)
+		if err != nil {
+			t.Fatalf("seek(%d, %d): %v", tt.offset, tt.whence, err)
+		}
+		if n != tt.want {
+			t.Fatalf("seek(%d, %d); got offset %d, want %d", tt.offset, tt.whence, n, tt.want)
+		}
+		got := make([]byte, 16)
+		if _, err := io.ReadFull(f, got); err != nil {
+			t.Fatalf("read after seek(%d, %d): %v", tt.offset, tt.whence, err)
+		}
+		if want := b[tt.want : tt.want+16]; !bytes.Equal(got, want) {
+			t.Fatalf("read after seek(%d, %d); got %x, want %x", tt.offset, tt.whence, got, want)
+		}
+	}
+
+	n, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("seek to end: %v", err)
+	}
+	if want := int64(len(b)); n != want {
+		t.Fatalf("seek to end; got offset %d, want %d", n, want)
+	}
+	if n, err := f.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Fatalf("read at end; got (%d, %v), want (0, %v)", n, err, io.EOF)
+	}
+}
+
+// testLarge creates an object large enough to need multipart uploads, or
+// similar, for most backends.
+func testLarge(t *testing.T, fs filesystem.FileSystem) {
+	if testing.Short() {
+		t.Skip("skipping large object test in short mode")
+	}
+	b := content(3, 12<<20+123)
+	create(t, fs, "large", b)
+	checkFile(t, fs, "large", b)
+
+	f, err := fs.Open(context.Background(), "large")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	off := int64(len(b) - 1<<20)
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, b[off:]) {
+		t.Fatalf("unexpected tail; got %d bytes, want %d bytes", len(got), len(b[off:]))
+	}
+}
+
+func testConcurrent(t *testing.T, fs filesystem.FileSystem) {
+	const n = 16
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name, want := fmt.Sprintf("concurrent%d", i), content(int64(i), 32<<10)
+			if err := fs.Create(context.Background(), name, bytes.NewReader(want)); err != nil {
+				errs <- fmt.Errorf("create %s: %w", name, err)
+				return
+			}
+			got, err := readFile(fs, name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, want) {
+				errs <- fmt.Errorf("unexpected content for %s", name)
+				return
+			}
+			if err := fs.Remove(context.Background(), name); err != nil {
+				errs <- fmt.Errorf("remove %s: %w", name, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testWalk(t *testing.T, fs filesystem.Walker) {
+	want := map[string]bool{}
+	for i := int64(0); i < 8; i++ {
+		name := fmt.Sprintf("walk%d", i)
+		create(t, fs, name, content(i, 1<<10))
+		want[name] = true
+	}
+	if err := fs.Remove(context.Background(), "walk0"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	delete(want, "walk0")
+
+	if err := fs.Walk(context.Background(), func(o filesystem.Object) error {
+		if !want[o.Name] {
+			return fmt.Errorf("unexpected object %s", o.Name)
+		}
+		if o.ModTime.IsZero() {
+			return fmt.Errorf("object %s has no modification time", o.Name)
+		}
+		delete(want, o.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	for name := range want {
+		t.Errorf("object %s was not walked", name)
+	}
+
+	stop := errors.New("stop")
+	if err := fs.Walk(context.Background(), func(filesystem.Object) error {
+		return stop
+	}); err != stop {
+		t.Fatalf("unexpected error; got %v, want %v", err, stop)
+	}
+}
@@ -2,7 +2,9 @@ package filesystem
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 )
 
 // A FileSystem is a persistent store of objects uniquely identified by name.
@@ -21,6 +23,96 @@ type Reader interface {
 	io.Closer
 }
 
+// An EncodedReader is a Reader whose contents are stored in a content
+// encoding, such as zstd, which can be served to clients as is.
+type EncodedReader interface {
+	Reader
+	// Encoding returns the content encoding of the stored contents.
+	Encoding() string
+	// Encoded returns a reader for the stored contents, and their size.
+	// The returned reader replaces the EncodedReader, which must not be
+	// used afterwards. Closing either closes both.
+	Encoded() (Reader, int64, error)
+}
+
+// A Redirector is a FileSystem from which clients can download objects
+// directly.
+type Redirector interface {
+	FileSystem
+	// RedirectURL returns a URL from which the named object can be
+	// downloaded with a GET request until it expires. Responses have the
+	// given Content-Type and Content-Disposition headers.
+	RedirectURL(ctx context.Context, name string, expires time.Duration, contentType, contentDisposition string) (string, error)
+}
+
+// A SizedOpener is a FileSystem which can open objects more cheaply when
+// their size is already known.
+type SizedOpener interface {
+	FileSystem
+	// OpenSize opens the named object, which is size bytes.
+	// Implementations may defer checking the object exists until it's
+	// read.
+	OpenSize(ctx context.Context, name string, size int64) (Reader, error)
+}
+
+// An Uploader is a FileSystem to which clients can upload objects directly.
+type Uploader interface {
+	FileSystem
+	// UploadURL returns a URL to which the named object, of exactly size
+	// bytes, can be uploaded with a PUT request until it expires.
+	UploadURL(ctx context.Context, name string, size int64, expires time.Duration) (string, error)
+	// Copy copies the object named src to dst, replacing any existing
+	// object.
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// An Object describes a stored object.
+type Object struct {
+	Name string
+	// Size is the size of the object as stored, which may differ from
+	// the size of its contents.
+	Size    int64
+	ModTime time.Time
+}
+
+// A Walker is a FileSystem which can list its objects.
+type Walker interface {
+	FileSystem
+	// Walk calls fn for each object, in no particular order, stopping at
+	// and returning the first error returned by fn. Objects created or
+	// removed during the walk may or may not be visited.
+	Walk(ctx context.Context, fn func(Object) error) error
+}
+
+// ErrNotWalker is returned by Walk for filesystems which can't list their
+// objects.
+var ErrNotWalker = errors.New("filesystem can't list objects")
+
+// Walk calls the Walk method of fs if it's a Walker, and otherwise returns
+// ErrNotWalker. Filesystems which wrap others implement Walker with it.
+func Walk(ctx context.Context, fs FileSystem, fn func(Object) error) error {
+	w, ok := fs.(Walker)
+	if !ok {
+		return ErrNotWalker
+	}
+	return w.Walk(ctx, fn)
+}
+
+type expiresKey struct{}
+
+// WithExpires returns a copy of ctx which tells Create, or Copy, that the
+// object being created expires at t. Filesystems may use it to describe the
+// object, or to have it removed without kipp.
+func WithExpires(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, expiresKey{}, t)
+}
+
+// Expires returns the expiry set by WithExpires, if any.
+func Expires(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(expiresKey{}).(time.Time)
+	return t, ok
+}
+
 // PipeReader pipes r to f(w).
 func PipeReader(f func(w io.Writer) error) io.Reader {
 	pr, pw := io.Pipe()
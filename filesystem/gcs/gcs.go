@@ -0,0 +1,113 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/httpfs"
+	"golang.org/x/oauth2/google"
+)
+
+// DefaultEndpoint is the endpoint for Google Cloud Storage's JSON API.
+const DefaultEndpoint = "https://storage.googleapis.com"
+
+// Scope is the OAuth2 scope required by FileSystem.
+const Scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// FileSystem is an abstraction over a Google Cloud Storage bucket which
+// allows for the creation, opening and removal of objects.
+type FileSystem struct {
+	client                   *http.Client
+	endpoint, bucket, prefix string
+}
+
+// New creates a new FileSystem for the named bucket, where objects are stored
+// under prefix. Requests are sent to endpoint using client, which is
+// responsible for authorisation.
+func New(client *http.Client, endpoint, bucket, prefix string) *FileSystem {
+	return &FileSystem{
+		client:   client,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+	}
+}
+
+// DefaultClient returns an HTTP client which is authorised using application
+// default credentials.
+func DefaultClient(ctx context.Context) (*http.Client, error) {
+	return google.DefaultClient(ctx, Scope)
+}
+
+// Create streams r to the named object.
+func (fs *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	u := fs.endpoint + "/upload/storage/v1/b/" + url.PathEscape(fs.bucket) + "/o?" + url.Values{
+		"uploadType": {"media"},
+		"name":       {fs.object(name)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, ioutil.NopCloser(r))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := httpfs.Do(fs.client, req, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	return res.Body.Close()
+}
+
+// Open opens the named object.
+func (fs *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	return httpfs.NewReader(func(offset int64) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fs.url(name)+"?alt=media", nil)
+		if err != nil {
+			return nil, fmt.Errorf("new request: %w", err)
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		res, err := httpfs.Do(fs.client, req, http.StatusOK, http.StatusPartialContent)
+		if err != nil {
+			return nil, fmt.Errorf("get object: %w", err)
+		}
+		return res, nil
+	})
+}
+
+// Remove removes the named object.
+func (fs *FileSystem) Remove(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fs.url(name), nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	res, err := httpfs.Do(fs.client, req, http.StatusNoContent)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("delete object %s/%s: %w", fs.bucket, fs.object(name), err)
+	}
+	return res.Body.Close()
+}
+
+// object returns the full object name for name.
+func (fs *FileSystem) object(name string) string {
+	if fs.prefix == "" {
+		return name
+	}
+	return path.Join(fs.prefix, name)
+}
+
+// url returns the JSON API URL for the named object.
+func (fs *FileSystem) url(name string) string {
+	return fs.endpoint + "/storage/v1/b/" + url.PathEscape(fs.bucket) + "/o/" + url.PathEscape(fs.object(name))
+}
@@ -0,0 +1,24 @@
+package gcs_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/gcs"
+	"github.com/uhthomas/kipp/internal/gcstest"
+)
+
+func TestFileSystem(t *testing.T) {
+	for _, prefix := range []string{"", "some/prefix"} {
+		prefix := prefix
+		t.Run("prefix="+prefix, func(t *testing.T) {
+			filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+				srv := gcstest.NewServer()
+				t.Cleanup(srv.Close)
+				return gcs.New(http.DefaultClient, srv.URL, "kipp", prefix)
+			})
+		})
+	}
+}
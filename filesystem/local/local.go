@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/uhthomas/kipp/filesystem"
 )
@@ -14,18 +15,44 @@ import (
 // A FileSystem contains information about the local filesystem.
 type FileSystem struct{ dir, tmp string }
 
+// staleTemp is how long a temporary file must be unmodified before it's
+// considered abandoned.
+const staleTemp = time.Hour
+
 // New creates a new FileSystem, and makes the relevant directories for
-// dir and tmp.
+// dir and tmp. Temporary files abandoned by previous runs, which haven't been
+// modified for an hour, are removed.
 func New(dir string) (*FileSystem, error) {
 	tmp := filepath.Join(dir, "tmp")
 	if err := os.MkdirAll(tmp, 0755); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
-	return &FileSystem{dir: dir, tmp: tmp}, nil
+	fs := &FileSystem{dir: dir, tmp: tmp}
+	if err := fs.removeTemp(time.Now().Add(-staleTemp)); err != nil {
+		return nil, fmt.Errorf("remove temp: %w", err)
+	}
+	return fs, nil
+}
+
+// removeTemp removes temporary files last modified before t. Other processes
+// may share dir, so newer files may still be in use.
+func (fs FileSystem) removeTemp(t time.Time) error {
+	fis, err := ioutil.ReadDir(fs.tmp)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.ModTime().Before(t) {
+			if err := os.Remove(filepath.Join(fs.tmp, fi.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// Create writer r to a temporary file, and links it to a permanent location
-// upon success.
+// Create writes r to a temporary file, and renames it to a permanent location
+// upon success, replacing any existing file.
 func (fs FileSystem) Create(_ context.Context, name string, r io.Reader) error {
 	f, err := ioutil.TempFile(fs.tmp, "kipp")
 	if err != nil {
@@ -36,8 +63,11 @@ func (fs FileSystem) Create(_ context.Context, name string, r io.Reader) error {
 	if _, err := io.Copy(f, r); err != nil {
 		return fmt.Errorf("copy: %w", err)
 	}
-	if err := os.Link(f.Name(), filepath.Join(fs.dir, name)); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("link: %w", err)
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(fs.dir, name)); err != nil {
+		return fmt.Errorf("rename: %w", err)
 	}
 	return nil
 }
@@ -47,7 +77,40 @@ func (fs FileSystem) Open(_ context.Context, name string) (filesystem.Reader, er
 	return os.Open(filepath.Join(fs.dir, name))
 }
 
+// Walk calls fn for each regular file in dir. Temporary files are skipped.
+func (fs FileSystem) Walk(ctx context.Context, fn func(filesystem.Object) error) error {
+	d, err := os.Open(fs.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	for {
+		fis, err := d.Readdir(1024)
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			if err := fn(filesystem.Object{
+				Name:    fi.Name(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("readdir: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
 // Remove removes the named file.
 func (fs FileSystem) Remove(_ context.Context, name string) error {
-	return os.Remove(name)
+	return os.Remove(filepath.Join(fs.dir, name))
 }
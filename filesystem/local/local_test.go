@@ -1,9 +1,14 @@
 package local_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
 	"github.com/uhthomas/kipp/filesystem/local"
 )
 
@@ -13,3 +18,40 @@ func TestFileSystem(t *testing.T) {
 		t.Fatal("local.FileSystem does not implement fs.FileSystem")
 	}
 }
+
+func TestFileSystemConformance(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		fs, err := local.New(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+func TestNewRemovesStaleTemp(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := local.New(dir); err != nil {
+		t.Fatal(err)
+	}
+	stale, fresh := filepath.Join(dir, "tmp", "stale"), filepath.Join(dir, "tmp", "fresh")
+	for _, name := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(name, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := local.New(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temp file was not removed: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("fresh temp file was removed: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// A FileSystem is an in-memory filesystem, useful for tests and ephemeral
+// instances. It is safe for concurrent use.
+type FileSystem struct {
+	mu        sync.Mutex
+	max, size int64
+	ll        *list.List
+	objects   map[string]*list.Element
+}
+
+type object struct {
+	name    string
+	b       []byte
+	modTime time.Time
+}
+
+// New creates a new FileSystem which holds at most max bytes. Once full, the
+// least recently used objects are evicted to make room. A max of zero or less
+// means there is no limit.
+func New(max int64) *FileSystem {
+	return &FileSystem{
+		max:     max,
+		ll:      list.New(),
+		objects: make(map[string]*list.Element),
+	}
+}
+
+// Create reads r up to io.EOF and stores the result as the named object,
+// replacing any existing object with the same name.
+func (fs *FileSystem) Create(_ context.Context, name string, r io.Reader) error {
+	if fs.max > 0 {
+		r = io.LimitReader(r, fs.max+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read all: %w", err)
+	}
+	if fs.max > 0 && int64(len(b)) > fs.max {
+		return fmt.Errorf("object %s exceeds limit of %d bytes", name, fs.max)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if el, ok := fs.objects[name]; ok {
+		fs.remove(el)
+	}
+	fs.objects[name] = fs.ll.PushFront(&object{name: name, b: b, modTime: time.Now()})
+	fs.size += int64(len(b))
+	for fs.max > 0 && fs.size > fs.max {
+		fs.remove(fs.ll.Back())
+	}
+	return nil
+}
+
+// Open opens the named object, and marks it as recently used.
+func (fs *FileSystem) Open(_ context.Context, name string) (filesystem.Reader, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	el, ok := fs.objects[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	fs.ll.MoveToFront(el)
+	return reader{bytes.NewReader(el.Value.(*object).b)}, nil
+}
+
+// Remove removes the named object.
+func (fs *FileSystem) Remove(_ context.Context, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	el, ok := fs.objects[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	fs.remove(el)
+	return nil
+}
+
+// Walk calls fn for a snapshot of the objects, so fn may modify the
+// filesystem. Objects are not marked as recently used.
+func (fs *FileSystem) Walk(_ context.Context, fn func(filesystem.Object) error) error {
+	fs.mu.Lock()
+	objects := make([]filesystem.Object, 0, fs.ll.Len())
+	for el := fs.ll.Front(); el != nil; el = el.Next() {
+		o := el.Value.(*object)
+		objects = append(objects, filesystem.Object{
+			Name:    o.name,
+			Size:    int64(len(o.b)),
+			ModTime: o.modTime,
+		})
+	}
+	fs.mu.Unlock()
+
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes el from fs. fs.mu must be held.
+func (fs *FileSystem) remove(el *list.Element) {
+	o := fs.ll.Remove(el).(*object)
+	delete(fs.objects, o.name)
+	fs.size -= int64(len(o.b))
+}
+
+type reader struct{ *bytes.Reader }
+
+func (reader) Close() error { return nil }
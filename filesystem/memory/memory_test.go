@@ -0,0 +1,67 @@
+package memory_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/memory"
+)
+
+func TestFileSystem(t *testing.T) {
+	var i interface{} = (*memory.FileSystem)(nil)
+	if _, ok := i.(filesystem.FileSystem); !ok {
+		t.Fatal("memory.FileSystem does not implement fs.FileSystem")
+	}
+}
+
+func TestFileSystemConformance(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		return memory.New(0)
+	})
+}
+
+func TestFileSystemEviction(t *testing.T) {
+	ctx := context.Background()
+	fs := memory.New(8)
+	for _, name := range []string{"a", "b"} {
+		if err := fs.Create(ctx, name, strings.NewReader("abcd")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Mark a as recently used, so b is evicted instead.
+	f, err := fs.Open(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := fs.Create(ctx, "c", strings.NewReader("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(ctx, "b"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+	for _, name := range []string{"a", "c"} {
+		f, err := fs.Open(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "abcd"; got != want {
+			t.Fatalf("unexpected content; got %q, want %q", got, want)
+		}
+	}
+
+	if err := fs.Create(ctx, "d", strings.NewReader("too large")); err == nil {
+		t.Fatal("expected error for object exceeding limit")
+	}
+}
@@ -0,0 +1,457 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// A FileSystem mirrors objects across several replicas for redundancy.
+// Objects are written to every replica, and read from the first healthy
+// replica which has them. It is safe for concurrent use.
+type FileSystem struct {
+	replicas []*replica
+	quorum   int
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+	// removed are the tombstones of removed objects, so they aren't copied
+	// back to the replicas by repairs.
+	removed map[string]tombstone
+}
+
+// A tombstone records when an object was removed, and whether any replica
+// failed to remove it. Those which failed are kept until the object is
+// created again, or removed from every replica. The others are kept for
+// tombstoneAge, to outlast the repairs which may have been copying them.
+type tombstone struct {
+	at     time.Time
+	failed bool
+}
+
+const (
+	tombstoneAge = time.Hour
+	// maxTombstones is how many tombstones are kept before those which are
+	// no longer needed are pruned outside of the repair and resync loops.
+	maxTombstones = 1 << 16
+)
+
+type replica struct {
+	filesystem.FileSystem
+	unhealthy int32
+}
+
+func (r *replica) setHealthy(healthy bool) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&r.unhealthy, v)
+}
+
+func (r *replica) healthy() bool { return atomic.LoadInt32(&r.unhealthy) == 0 }
+
+// New creates a new FileSystem which mirrors objects across replicas. Creating
+// an object succeeds once at least quorum replicas have it.
+func New(quorum int, replicas ...filesystem.FileSystem) (*FileSystem, error) {
+	if quorum < 1 || quorum > len(replicas) {
+		return nil, fmt.Errorf("invalid quorum %d for %d replicas", quorum, len(replicas))
+	}
+	m := &FileSystem{
+		quorum:  quorum,
+		pending: make(map[string]struct{}),
+		removed: make(map[string]tombstone),
+	}
+	for _, fs := range replicas {
+		m.replicas = append(m.replicas, &replica{FileSystem: fs})
+	}
+	return m, nil
+}
+
+// Create writes r to every replica concurrently. Replicas which fail are
+// dropped, and the object is queued for repair, as long as the quorum is
+// met. Otherwise, the object is removed from the replicas which succeeded.
+// It returns once every replica has succeeded or failed, so creates are as
+// slow as the slowest healthy replica, even once the quorum is met.
+func (m *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	errs := make([]error, len(m.replicas))
+	pws := make([]*io.PipeWriter, len(m.replicas))
+
+	var wg sync.WaitGroup
+	for i, rep := range m.replicas {
+		pr, pw := io.Pipe()
+		pws[i] = pw
+		wg.Add(1)
+		go func(i int, rep *replica) {
+			defer wg.Done()
+			errs[i] = rep.Create(ctx, name, pr)
+			// Unblock the fanout, in case the replica gave up early.
+			pr.CloseWithError(errReplicaDone)
+		}(i, rep)
+	}
+
+	_, err := io.Copy(&fanout{pws: append([]*io.PipeWriter(nil), pws...), quorum: m.quorum}, r)
+	for _, pw := range pws {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+
+	var failed []error
+	for i, rep := range m.replicas {
+		rep.setHealthy(errs[i] == nil)
+		if errs[i] != nil {
+			failed = append(failed, errs[i])
+		}
+	}
+	if len(m.replicas)-len(failed) >= m.quorum {
+		m.mu.Lock()
+		delete(m.removed, name)
+		m.mu.Unlock()
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(m.replicas)-len(failed) < m.quorum {
+		for i, rep := range m.replicas {
+			if errs[i] == nil {
+				rep.Remove(ctx, name)
+			}
+		}
+		return fmt.Errorf("%d of %d replicas failed, quorum is %d: %w", len(failed), len(m.replicas), m.quorum, failed[0])
+	}
+	m.queue(name)
+	return nil
+}
+
+var errReplicaDone = errors.New("replica done")
+
+// fanout writes to every pipe, dropping those which fail. It fails once fewer
+// than quorum pipes remain.
+type fanout struct {
+	pws    []*io.PipeWriter
+	quorum int
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	var live int
+	for i, pw := range f.pws {
+		if pw == nil {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			f.pws[i] = nil
+			continue
+		}
+		live++
+	}
+	if live < f.quorum {
+		return 0, errors.New("too many replicas failed")
+	}
+	return len(p), nil
+}
+
+// Open opens the named object from the first healthy replica which has it.
+// Should a replica fail while reading, the reader fails over to the next.
+func (m *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	r := &reader{ctx: ctx, m: m, name: name, replicas: m.ordered()}
+	if err := r.failover(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ordered returns the replicas with the healthy replicas first, but otherwise
+// in their original order.
+func (m *FileSystem) ordered() []*replica {
+	replicas := append([]*replica(nil), m.replicas...)
+	sort.SliceStable(replicas, func(i, j int) bool {
+		return replicas[i].healthy() && !replicas[j].healthy()
+	})
+	return replicas
+}
+
+// Remove removes the named object from every replica. It reports
+// os.ErrNotExist only if no replica had the object. Should any replica fail,
+// the object isn't copied back to the others by repairs, until it's created
+// again.
+func (m *FileSystem) Remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	delete(m.pending, name)
+	if len(m.removed) >= maxTombstones {
+		m.prune()
+	}
+	m.removed[name] = tombstone{at: time.Now(), failed: true}
+	m.mu.Unlock()
+
+	var missing int
+	var errs []error
+	for _, rep := range m.replicas {
+		if err := rep.Remove(ctx, name); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				missing++
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d replicas failed: %w", len(errs), len(m.replicas), errs[0])
+	}
+	m.mu.Lock()
+	if t, ok := m.removed[name]; ok {
+		t.failed = false
+		m.removed[name] = t
+	}
+	m.mu.Unlock()
+	if missing == len(m.replicas) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// Walk lists the objects of every replica which can list its objects, so
+// objects missing from some replicas are still visited. Each object is visited
+// once, with its most recent modification time.
+func (m *FileSystem) Walk(ctx context.Context, fn func(filesystem.Object) error) error {
+	objects := make(map[string]filesystem.Object)
+	var walked bool
+	for _, rep := range m.replicas {
+		err := filesystem.Walk(ctx, rep.FileSystem, func(o filesystem.Object) error {
+			if v, ok := objects[o.Name]; !ok || o.ModTime.After(v.ModTime) {
+				objects[o.Name] = o
+			}
+			return nil
+		})
+		if errors.Is(err, filesystem.ErrNotWalker) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		walked = true
+	}
+	if !walked {
+		return filesystem.ErrNotWalker
+	}
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair copies the named object to any replicas which are missing it.
+// Objects which were removed aren't copied, and should one be removed while
+// it's copied, the copies are removed too.
+func (m *FileSystem) Repair(ctx context.Context, name string) error {
+	start := time.Now()
+	if m.removedSince(name, time.Time{}) {
+		return &os.PathError{Op: "repair", Path: name, Err: os.ErrNotExist}
+	}
+
+	var (
+		src     filesystem.Reader
+		missing []*replica
+	)
+	for _, rep := range m.replicas {
+		f, err := rep.Open(ctx, name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, rep)
+			}
+			continue
+		}
+		if src == nil {
+			src = f
+		} else {
+			f.Close()
+		}
+	}
+	if src == nil {
+		if len(missing) == len(m.replicas) {
+			return &os.PathError{Op: "repair", Path: name, Err: os.ErrNotExist}
+		}
+		return fmt.Errorf("repair %s: no replica is available", name)
+	}
+	defer src.Close()
+
+	var created []*replica
+	for _, rep := range missing {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek: %w", err)
+		}
+		if err := rep.Create(ctx, name, src); err != nil {
+			return fmt.Errorf("create: %w", err)
+		}
+		created = append(created, rep)
+		if m.removedSince(name, start) {
+			break
+		}
+	}
+	if m.removedSince(name, start) {
+		for _, rep := range created {
+			rep.Remove(ctx, name)
+		}
+		return &os.PathError{Op: "repair", Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// removedSince reports whether the named object was removed after t, and
+// hasn't been created since.
+func (m *FileSystem) removedSince(name string, t time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.removed[name]
+	return ok && !v.at.Before(t)
+}
+
+// prune forgets the tombstones which are no longer needed. m.mu must be held.
+func (m *FileSystem) prune() {
+	for name, t := range m.removed {
+		if !t.failed && time.Since(t.at) > tombstoneAge {
+			delete(m.removed, name)
+		}
+	}
+}
+
+// RepairPending repairs the objects which are known to be missing from a
+// replica, because a replica failed while they were created, or read.
+func (m *FileSystem) RepairPending(ctx context.Context) error {
+	m.mu.Lock()
+	m.prune()
+	names := make([]string, 0, len(m.pending))
+	for name := range m.pending {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, name := range names {
+		if err := m.Repair(ctx, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		m.mu.Lock()
+		delete(m.pending, name)
+		m.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d repairs failed: %w", len(errs), len(names), errs[0])
+	}
+	return nil
+}
+
+// RepairLoop calls RepairPending every interval, until ctx is done.
+func (m *FileSystem) RepairLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := m.RepairPending(ctx); err != nil {
+				log.Printf("mirror: repair pending: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Resync repairs every object which is missing from some replica, such as a
+// replica which was replaced, or emptied. Objects are found by listing the
+// replicas which can list their objects. Should any replica be unable to,
+// every object found is repaired, as it may be missing any of them. It
+// returns the number of objects which were repaired. Objects which were
+// removed, including those removed while listing, aren't repaired.
+func (m *FileSystem) Resync(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	m.prune()
+	m.mu.Unlock()
+
+	counts := make(map[string]int)
+	var walked int
+	for _, rep := range m.replicas {
+		err := filesystem.Walk(ctx, rep.FileSystem, func(o filesystem.Object) error {
+			counts[o.Name]++
+			return nil
+		})
+		if errors.Is(err, filesystem.ErrNotWalker) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("walk: %w", err)
+		}
+		walked++
+	}
+	if walked == 0 {
+		return 0, filesystem.ErrNotWalker
+	}
+
+	var (
+		repaired int
+		errs     []error
+	)
+	for name, n := range counts {
+		if n == len(m.replicas) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return repaired, err
+		}
+		if err := m.Repair(ctx, name); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		repaired++
+	}
+	if len(errs) > 0 {
+		return repaired, fmt.Errorf("%d repairs failed: %w", len(errs), errs[0])
+	}
+	return repaired, nil
+}
+
+// ResyncLoop calls Resync now, and then every interval, until ctx is done.
+func (m *FileSystem) ResyncLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := m.Resync(ctx)
+		switch {
+		case errors.Is(err, filesystem.ErrNotWalker):
+			log.Printf("mirror: resync: no replica can list its objects")
+			return
+		case err != nil:
+			log.Printf("mirror: resync: %v", err)
+		}
+		if n > 0 {
+			log.Printf("mirror: resync: repaired %d objects", n)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *FileSystem) queue(name string) {
+	m.mu.Lock()
+	m.pending[name] = struct{}{}
+	m.mu.Unlock()
+}
@@ -0,0 +1,185 @@
+package mirror_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/filesystem/mirror"
+)
+
+func TestFileSystem(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		fs, err := mirror.New(2, memory.New(0), memory.New(0), memory.New(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+// brokenFileSystem fails every operation while broken is set.
+type brokenFileSystem struct {
+	filesystem.FileSystem
+	broken bool
+}
+
+var errBroken = errors.New("broken")
+
+func (fs *brokenFileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	if fs.broken {
+		return errBroken
+	}
+	return fs.FileSystem.Create(ctx, name, r)
+}
+
+func (fs *brokenFileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	if fs.broken {
+		return nil, errBroken
+	}
+	return fs.FileSystem.Open(ctx, name)
+}
+
+func (fs *brokenFileSystem) Remove(ctx context.Context, name string) error {
+	if fs.broken {
+		return errBroken
+	}
+	return fs.FileSystem.Remove(ctx, name)
+}
+
+func read(t *testing.T, fs filesystem.FileSystem, name string) string {
+	t.Helper()
+	f, err := fs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFileSystemRepair(t *testing.T) {
+	ctx := context.Background()
+	a, b := &brokenFileSystem{FileSystem: memory.New(0)}, memory.New(0)
+	fs, err := mirror.New(1, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.broken = true
+	if err := fs.Create(ctx, "some-name", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(t, fs, "some-name"), "some content"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+
+	a.broken = false
+	if _, err := a.Open(ctx, "some-name"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+	if err := fs.RepairPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(t, a, "some-name"), "some content"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+}
+
+func TestFileSystemQuorum(t *testing.T) {
+	ctx := context.Background()
+	a, b := memory.New(0), &brokenFileSystem{FileSystem: memory.New(0), broken: true}
+	fs, err := mirror.New(2, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, "some-name", strings.NewReader("some content")); err == nil {
+		t.Fatal("create succeeded, despite the quorum not being met")
+	}
+	if _, err := a.Open(ctx, "some-name"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestFileSystemResync(t *testing.T) {
+	ctx := context.Background()
+	a, b := memory.New(0), memory.New(0)
+	fs, err := mirror.New(1, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is empty, as if it was replaced, so nothing is known to be missing
+	// from it.
+	for _, name := range []string{"a", "b"} {
+		if err := b.Create(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := fs.Resync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected number of repairs; got %d, want 2", n)
+	}
+	for _, name := range []string{"a", "b"} {
+		if got := read(t, a, name); got != name {
+			t.Fatalf("unexpected content; got %q, want %q", got, name)
+		}
+	}
+	if n, err := fs.Resync(ctx); err != nil || n != 0 {
+		t.Fatalf("unexpected resync; got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestFileSystemResyncRemoved(t *testing.T) {
+	ctx := context.Background()
+	a, b := memory.New(0), &brokenFileSystem{FileSystem: memory.New(0)}
+	fs, err := mirror.New(1, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, "some-name", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// b fails to remove the object, but it isn't copied back to a.
+	b.broken = true
+	if err := fs.Remove(ctx, "some-name"); !errors.Is(err, errBroken) {
+		t.Fatalf("unexpected error; got %v, want %v", err, errBroken)
+	}
+	b.broken = false
+	if n, err := fs.Resync(ctx); err != nil || n != 0 {
+		t.Fatalf("unexpected resync; got (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err := a.Open(ctx, "some-name"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+
+	// Once it's created again, it's repaired as usual.
+	b.broken = true
+	if err := fs.Create(ctx, "some-name", strings.NewReader("new content")); err != nil {
+		t.Fatal(err)
+	}
+	b.broken = false
+	if err := b.Remove(ctx, "some-name"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := fs.Resync(ctx); err != nil || n != 1 {
+		t.Fatalf("unexpected resync; got (%d, %v), want (1, nil)", n, err)
+	}
+	if got, want := read(t, b, "some-name"), "new content"; got != want {
+		t.Fatalf("unexpected content; got %q, want %q", got, want)
+	}
+}
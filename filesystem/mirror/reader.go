@@ -0,0 +1,104 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// reader reads from a replica, failing over to the remaining replicas.
+type reader struct {
+	ctx      context.Context
+	m        *FileSystem
+	name     string
+	replicas []*replica
+	r        filesystem.Reader
+	offset   int64
+	missing  bool
+}
+
+var errUnavailable = errors.New("no replica is available")
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	if r.r == nil {
+		return 0, errUnavailable
+	}
+	n, err = r.r.Read(p)
+	r.offset += int64(n)
+	if err != nil && err != io.EOF && r.failover() == nil {
+		if n > 0 {
+			return n, nil
+		}
+		return r.Read(p)
+	}
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	if r.r == nil {
+		return 0, errUnavailable
+	}
+	n, err := r.r.Seek(offset, whence)
+	if err != nil {
+		if r.failover() != nil {
+			return 0, err
+		}
+		return r.Seek(offset, whence)
+	}
+	r.offset = n
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	if r.r == nil {
+		return nil
+	}
+	return r.r.Close()
+}
+
+// failover opens the next replica which has the object, at the current
+// offset.
+func (r *reader) failover() error {
+	if r.r != nil {
+		r.r.Close()
+		r.r = nil
+	}
+
+	var errs []error
+	for len(r.replicas) > 0 {
+		rep := r.replicas[0]
+		r.replicas = r.replicas[1:]
+
+		f, err := rep.Open(r.ctx, r.name)
+		if err == nil && r.offset > 0 {
+			if _, err = f.Seek(r.offset, io.SeekStart); err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				r.missing = true
+			} else {
+				rep.setHealthy(false)
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		rep.setHealthy(true)
+		r.r = f
+		// Another replica is missing the object, so queue it for repair.
+		if r.missing {
+			r.m.queue(r.name)
+		}
+		return nil
+	}
+	if len(errs) == 0 {
+		return &os.PathError{Op: "open", Path: r.name, Err: os.ErrNotExist}
+	}
+	return fmt.Errorf("%d replicas failed: %w", len(errs), errs[0])
+}
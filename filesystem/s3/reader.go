@@ -5,33 +5,157 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+const (
+	// prefetchSize is the size of the first range read, which is kept in
+	// memory. Content sniffing and seeking back to the start are served
+	// from it, and small objects are read with a single request.
+	prefetchSize = 64 << 10
+	// minWindow and maxWindow bound the size of subsequent ranges. Each
+	// range which continues where the last ended is twice the size of the
+	// last, so sequential reads need few requests, while reads after a
+	// seek fetch little more than is needed.
+	minWindow = 1 << 20
+	maxWindow = 64 << 20
+)
+
+// A reader reads an object with bounded range requests. Nothing is fetched
+// until the first Read, so opening and seeking are free.
 type reader struct {
 	ctx          context.Context
-	client       *s3.S3
-	bucket, name string
-	obj          *s3.GetObjectOutput
+	fs           *FileSystem
+	name         string
 	offset, size int64
+
+	// buf holds the prefetched bytes from bufStart.
+	buf      []byte
+	bufStart int64
+
+	// body streams the range [bodyPos, bodyEnd).
+	body             io.ReadCloser
+	bodyPos, bodyEnd int64
+	window           int64
+	// end is the end of the last range requested.
+	end int64
+}
+
+// newReader returns a reader for the named object, whose size must be known.
+func (fs *FileSystem) newReader(ctx context.Context, name string, size int64) *reader {
+	return &reader{
+		ctx:  ctx,
+		fs:   fs,
+		name: name,
+		size: size,
+		end:  -1,
+	}
 }
 
-func newReader(ctx context.Context, client *s3.S3, bucket, name string) (*reader, error) {
-	r := &reader{
-		ctx:    ctx,
-		client: client,
-		bucket: bucket,
-		name:   name,
+func (r *reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.buf == nil {
+		if err := r.prefetch(); err != nil {
+			return 0, err
+		}
+	}
+	if i := r.offset - r.bufStart; i >= 0 && i < int64(len(r.buf)) {
+		n := copy(p, r.buf[i:])
+		r.offset += int64(n)
+		return n, nil
 	}
-	if err := r.reset(); err != nil {
-		return nil, fmt.Errorf("reset: %w", err)
+	if r.body == nil || r.offset != r.bodyPos || r.bodyPos >= r.bodyEnd {
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
 	}
-	return r, nil
+	if max := r.bodyEnd - r.bodyPos; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.bodyPos += int64(n)
+	if err == io.EOF {
+		if r.bodyPos < r.bodyEnd {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
 }
 
-func (r *reader) Read(p []byte) (n int, err error) { return r.obj.Body.Read(p) }
+// prefetch reads the first range into buf.
+func (r *reader) prefetch() error {
+	end := r.offset + prefetchSize
+	if end > r.size {
+		end = r.size
+	}
+	body, err := r.get(r.offset, end)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	buf := make([]byte, end-r.offset)
+	if _, err := io.ReadFull(body, buf); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	r.buf, r.bufStart, r.end = buf, r.offset, end
+	return nil
+}
+
+// fetch requests a range starting at the current offset.
+func (r *reader) fetch() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	if r.offset == r.end {
+		r.window *= 2
+	} else {
+		r.window = 0
+	}
+	if r.window < minWindow {
+		r.window = minWindow
+	}
+	if r.window > maxWindow {
+		r.window = maxWindow
+	}
+	end := r.offset + r.window
+	if end > r.size {
+		end = r.size
+	}
+	body, err := r.get(r.offset, end)
+	if err != nil {
+		return err
+	}
+	r.body, r.bodyPos, r.bodyEnd, r.end = body, r.offset, end, end
+	return nil
+}
+
+// get requests the range [start, end) of the object.
+func (r *reader) get(start, end int64) (io.ReadCloser, error) {
+	in := &s3.GetObjectInput{
+		Bucket: &r.fs.bucket,
+		Key:    r.fs.key(r.name),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	}
+	in.SSECustomerAlgorithm, in.SSECustomerKey = r.fs.customerKey()
+	obj, err := r.fs.client.GetObjectWithContext(r.ctx, in)
+	if err != nil {
+		return nil, notExist("open", r.name, fmt.Errorf("get object: %w", err))
+	}
+	return obj.Body, nil
+}
 
 func (r *reader) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
@@ -39,7 +163,7 @@ func (r *reader) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		offset += r.offset
 	case io.SeekEnd:
-		offset = r.size - offset
+		offset += r.size
 	default:
 		return 0, fmt.Errorf("invalid whence: %d", whence)
 	}
@@ -47,30 +171,27 @@ func (r *reader) Seek(offset int64, whence int) (int64, error) {
 		return 0, errors.New("invalid offset")
 	}
 	r.offset = offset
-	if err := r.reset(); err != nil {
-		return 0, err
-	}
 	return offset, nil
 }
 
-func (r *reader) Close() error { return r.obj.Body.Close() }
-
-func (r *reader) reset() error {
-	if r.obj != nil {
-		r.Close()
+func (r *reader) Close() error {
+	if r.body == nil {
+		return nil
 	}
+	return r.body.Close()
+}
 
-	in := &s3.GetObjectInput{Bucket: &r.bucket, Key: &r.name}
-	if r.offset > 0 {
-		in.Range = aws.String(fmt.Sprintf("bytes=%d-", r.offset))
-	}
-	obj, err := r.client.GetObjectWithContext(r.ctx, in)
-	if err != nil {
-		return fmt.Errorf("get object: %w", err)
+// notExist returns a *os.PathError wrapping os.ErrNotExist if err is because
+// the object doesn't exist, and err otherwise.
+func notExist(op, name string, err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
 	}
-	r.obj = obj
-	if r.size == 0 {
-		r.size = *obj.ContentLength
+	// Responses to HEAD requests have no body, so no error code.
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) && rerr.StatusCode() == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
 	}
-	return nil
+	return err
 }
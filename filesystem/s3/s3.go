@@ -2,8 +2,14 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -12,50 +18,295 @@ import (
 	"github.com/uhthomas/kipp/filesystem"
 )
 
+// Server-side encryption modes.
+const (
+	SSES3  = "AES256"
+	SSEKMS = "aws:kms"
+)
+
+// sseCustomerAlgorithm is the algorithm S3 encrypts objects with for SSE-C,
+// the only one it supports.
+const sseCustomerAlgorithm = "AES256"
+
+// Tags set on objects when Options.Tags or Options.Lifecycle is set.
+const (
+	SlugTag    = "kipp-slug"
+	ExpiresTag = "kipp-expires"
+	// ExpiryDaysTag is the number of whole days, rounded up, from the
+	// creation of an object until it expires.
+	ExpiryDaysTag = "kipp-expiry-days"
+)
+
+// Options configures how objects are stored.
+type Options struct {
+	// StorageClass is the storage class of objects, such as STANDARD_IA.
+	// The bucket's default is used if empty.
+	StorageClass string
+	// ServerSideEncryption is either SSES3 or SSEKMS, in which case
+	// KMSKeyID may name the key. The bucket's default is used if empty.
+	ServerSideEncryption string
+	KMSKeyID             string
+	// CustomerKey is a 256-bit key with which S3 encrypts objects (SSE-C).
+	// It must accompany every request, so objects can't be downloaded or
+	// uploaded directly.
+	CustomerKey []byte
+	// Tags tags objects with their slug and, if they expire, their
+	// expiry.
+	Tags bool
+	// Lifecycle tags expiring objects with ExpiryDaysTag too, so a bucket
+	// lifecycle rule for each number of days can remove them, even if
+	// kipp isn't running.
+	Lifecycle bool
+	// Prefix, if set, is prepended to the keys of objects, followed by a
+	// "/". Only objects under it are listed, so a bucket can be shared
+	// without other objects being collected as orphans.
+	Prefix string
+}
+
 // FileSystem is an abstraction over an s3 bucket which allows for the creation,
 // opening and removal of objects.
 type FileSystem struct {
 	client   *s3.S3
 	uploader *s3manager.Uploader
 	bucket   string
+	opts     Options
 }
 
 // New creates a new aws session and s3 client.
 func New(bucket string, config *aws.Config) (*FileSystem, error) {
+	return NewWithOptions(bucket, config, Options{})
+}
+
+// NewWithOptions creates a new aws session and s3 client, which stores
+// objects as described by opts.
+func NewWithOptions(bucket string, config *aws.Config, opts Options) (*FileSystem, error) {
+	switch opts.ServerSideEncryption {
+	case "", SSES3, SSEKMS:
+	default:
+		return nil, fmt.Errorf("invalid server-side encryption: %s", opts.ServerSideEncryption)
+	}
+	if opts.KMSKeyID != "" && opts.ServerSideEncryption != SSEKMS {
+		return nil, errors.New("kms key id requires kms server-side encryption")
+	}
+	if opts.CustomerKey != nil {
+		if len(opts.CustomerKey) != 32 {
+			return nil, fmt.Errorf("invalid customer key length: %d", len(opts.CustomerKey))
+		}
+		if opts.ServerSideEncryption != "" {
+			// S3 refuses requests with both.
+			return nil, fmt.Errorf("customer key can't be used with %s server-side encryption", opts.ServerSideEncryption)
+		}
+	}
 	sess, err := session.NewSession(config)
 	if err != nil {
 		return nil, fmt.Errorf("new session: %w", err)
 	}
 	c := s3.New(sess)
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
 	return &FileSystem{
 		client:   c,
 		uploader: s3manager.NewUploaderWithClient(c),
 		bucket:   bucket,
+		opts:     opts,
 	}, nil
 }
 
+// key returns the key of the named object.
+func (fs *FileSystem) key(name string) *string {
+	if fs.opts.Prefix == "" {
+		return &name
+	}
+	return aws.String(fs.opts.Prefix + "/" + name)
+}
+
 // Create writes r to the named s3 bucket/object.
 func (fs *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
-	if _, err := fs.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Body:   r,
-		Bucket: aws.String(fs.bucket),
-		Key:    &name,
-	}); err != nil {
+	in := &s3manager.UploadInput{
+		Body:                 r,
+		Bucket:               aws.String(fs.bucket),
+		Key:                  fs.key(name),
+		StorageClass:         optional(fs.opts.StorageClass),
+		ServerSideEncryption: optional(fs.opts.ServerSideEncryption),
+		SSEKMSKeyId:          optional(fs.opts.KMSKeyID),
+		Tagging:              optional(fs.tagging(ctx, name)),
+	}
+	if t, ok := filesystem.Expires(ctx); ok {
+		in.Expires = &t
+	}
+	in.SSECustomerAlgorithm, in.SSECustomerKey = fs.customerKey()
+	if _, err := fs.uploader.UploadWithContext(ctx, in); err != nil {
 		return fmt.Errorf("upload: %w", err)
 	}
 	return nil
 }
 
-// Open gets the object with the specified key, name.
+// tagging returns the tags for the named object, as a query string.
+func (fs *FileSystem) tagging(ctx context.Context, name string) string {
+	if !fs.opts.Tags && !fs.opts.Lifecycle {
+		return ""
+	}
+	slug := name
+	if i := strings.Index(slug, "."); i > -1 {
+		slug = slug[:i]
+	}
+	tags := url.Values{SlugTag: {slug}}
+	if t, ok := filesystem.Expires(ctx); ok {
+		tags.Set(ExpiresTag, t.UTC().Format(time.RFC3339))
+		if fs.opts.Lifecycle {
+			days := int64(math.Ceil(time.Until(t).Hours() / 24))
+			if days < 1 {
+				days = 1
+			}
+			tags.Set(ExpiryDaysTag, strconv.FormatInt(days, 10))
+		}
+	}
+	return tags.Encode()
+}
+
+// customerKey returns the algorithm and key for SSE-C, if configured.
+func (fs *FileSystem) customerKey() (algorithm, key *string) {
+	if fs.opts.CustomerKey == nil {
+		return nil, nil
+	}
+	return aws.String(sseCustomerAlgorithm), aws.String(string(fs.opts.CustomerKey))
+}
+
+// optional returns a pointer to s, or nil if s is empty.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// errCustomerKey is returned for requests which other clients would need the
+// customer key to make.
+var errCustomerKey = errors.New("presigned requests can't be used with a customer key")
+
+// Open looks up the size of the object with the specified key, name. Its
+// contents are read with range requests as needed.
 func (fs *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
-	return newReader(ctx, fs.client, fs.bucket, name)
+	in := &s3.HeadObjectInput{
+		Bucket: &fs.bucket,
+		Key:    fs.key(name),
+	}
+	in.SSECustomerAlgorithm, in.SSECustomerKey = fs.customerKey()
+	out, err := fs.client.HeadObjectWithContext(ctx, in)
+	if err != nil {
+		return nil, notExist("open", name, fmt.Errorf("head object: %w", err))
+	}
+	return fs.newReader(ctx, name, aws.Int64Value(out.ContentLength)), nil
+}
+
+// OpenSize opens the object with the specified key, name, without making any
+// requests. Should it not exist, the first read fails.
+func (fs *FileSystem) OpenSize(ctx context.Context, name string, size int64) (filesystem.Reader, error) {
+	return fs.newReader(ctx, name, size), nil
+}
+
+// Walk lists every object in the bucket, or under the prefix if set. Keys
+// which are nested further can't be the names of objects, so are skipped.
+func (fs *FileSystem) Walk(ctx context.Context, fn func(filesystem.Object) error) error {
+	in := &s3.ListObjectsV2Input{Bucket: &fs.bucket}
+	var prefix string
+	if fs.opts.Prefix != "" {
+		prefix = fs.opts.Prefix + "/"
+		in.Prefix = &prefix
+	}
+	var err error
+	if lerr := fs.client.ListObjectsV2PagesWithContext(ctx, in, func(out *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range out.Contents {
+			name := strings.TrimPrefix(aws.StringValue(o.Key), prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+			if err = fn(filesystem.Object{
+				Name:    name,
+				Size:    aws.Int64Value(o.Size),
+				ModTime: aws.TimeValue(o.LastModified),
+			}); err != nil {
+				return false
+			}
+		}
+		return true
+	}); lerr != nil {
+		return fmt.Errorf("list objects %s: %w", fs.bucket, lerr)
+	}
+	return err
+}
+
+// RedirectURL presigns a GetObject request for the named object, which
+// overrides the Content-Type and Content-Disposition of the response.
+func (fs *FileSystem) RedirectURL(ctx context.Context, name string, expires time.Duration, contentType, contentDisposition string) (string, error) {
+	if fs.opts.CustomerKey != nil {
+		return "", errCustomerKey
+	}
+	req, _ := fs.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     &fs.bucket,
+		Key:                        fs.key(name),
+		ResponseContentType:        &contentType,
+		ResponseContentDisposition: &contentDisposition,
+	})
+	req.SetContext(ctx)
+	u, err := req.Presign(expires)
+	if err != nil {
+		return "", fmt.Errorf("presign %s/%s: %w", fs.bucket, name, err)
+	}
+	return u, nil
+}
+
+// UploadURL presigns a PutObject request for the named object. The size is
+// signed, so S3 rejects uploads of any other size. The object is stored as
+// configured when it's copied.
+func (fs *FileSystem) UploadURL(ctx context.Context, name string, size int64, expires time.Duration) (string, error) {
+	if fs.opts.CustomerKey != nil {
+		return "", errCustomerKey
+	}
+	req, _ := fs.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        &fs.bucket,
+		Key:           fs.key(name),
+		ContentLength: &size,
+	})
+	req.SetContext(ctx)
+	u, err := req.Presign(expires)
+	if err != nil {
+		return "", fmt.Errorf("presign %s/%s: %w", fs.bucket, name, err)
+	}
+	return u, nil
+}
+
+// Copy copies the object src to dst within the bucket. The copy is stored as
+// if it were created, rather than as src was.
+func (fs *FileSystem) Copy(ctx context.Context, src, dst string) error {
+	in := &s3.CopyObjectInput{
+		Bucket:               &fs.bucket,
+		CopySource:           aws.String(url.PathEscape(fs.bucket + "/" + *fs.key(src))),
+		Key:                  fs.key(dst),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		StorageClass:         optional(fs.opts.StorageClass),
+		ServerSideEncryption: optional(fs.opts.ServerSideEncryption),
+		SSEKMSKeyId:          optional(fs.opts.KMSKeyID),
+	}
+	if tagging := fs.tagging(ctx, dst); tagging != "" {
+		in.Tagging = &tagging
+		in.TaggingDirective = aws.String(s3.TaggingDirectiveReplace)
+	}
+	if t, ok := filesystem.Expires(ctx); ok {
+		in.Expires = &t
+	}
+	in.SSECustomerAlgorithm, in.SSECustomerKey = fs.customerKey()
+	in.CopySourceSSECustomerAlgorithm, in.CopySourceSSECustomerKey = fs.customerKey()
+	if _, err := fs.client.CopyObjectWithContext(ctx, in); err != nil {
+		return notExist("copy", src, fmt.Errorf("copy object %s/%s: %w", fs.bucket, src, err))
+	}
+	return nil
 }
 
 // Remove removes the s3 object specified with key, name, from the bucket.
 func (fs *FileSystem) Remove(ctx context.Context, name string) error {
 	if _, err := fs.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: &fs.bucket,
-		Key:    &name,
+		Key:    fs.key(name),
 	}); err != nil {
 		return fmt.Errorf("delete object %s/%s: %w", fs.bucket, name, err)
 	}
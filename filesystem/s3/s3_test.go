@@ -0,0 +1,316 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	"github.com/uhthomas/kipp/filesystem/s3"
+	"github.com/uhthomas/kipp/internal/s3test"
+)
+
+func TestFileSystem(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		srv := s3test.NewServer()
+		t.Cleanup(srv.Close)
+		fs, err := s3.New("kipp", srv.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+func TestFileSystemPrefix(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		srv := s3test.NewServer()
+		t.Cleanup(srv.Close)
+		fs, err := s3.NewWithOptions("kipp", srv.Config(), s3.Options{Prefix: "some/prefix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+
+	srv := s3test.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+	// Objects outside of the prefix, or nested within it, belong to
+	// something else sharing the bucket.
+	other, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"other", "some/other", "some/prefix/nested/other"} {
+		if err := other.Create(ctx, name, strings.NewReader("other content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, err := s3.NewWithOptions("kipp", srv.Config(), s3.Options{Prefix: "/some/prefix/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, "slug", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(ctx, "some/prefix/slug"); err != nil {
+		t.Fatalf("object isn't under the prefix: %v", err)
+	}
+	var names []string
+	if err := fs.Walk(ctx, func(o filesystem.Object) error {
+		names = append(names, o.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"slug"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected names; got %q, want %q", names, want)
+	}
+}
+
+func TestFileSystemCustomerKey(t *testing.T) {
+	// A custom CA bundle would replace the test server's certificate.
+	if v, ok := os.LookupEnv("AWS_CA_BUNDLE"); ok {
+		os.Unsetenv("AWS_CA_BUNDLE")
+		defer os.Setenv("AWS_CA_BUNDLE", v)
+	}
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		srv := s3test.NewTLSServer()
+		t.Cleanup(srv.Close)
+		fs, err := s3.NewWithOptions("kipp", srv.Config(), s3.Options{
+			CustomerKey: bytes.Repeat([]byte{1}, 32),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+
+	srv := s3test.NewTLSServer()
+	defer srv.Close()
+	fs, err := s3.NewWithOptions("kipp", srv.Config(), s3.Options{
+		CustomerKey: bytes.Repeat([]byte{1}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := fs.Create(ctx, "slug", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.RedirectURL(ctx, "slug", time.Minute, "text/plain", ""); err == nil {
+		t.Fatal("presigned a download, despite needing the customer key")
+	}
+	nokey, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nokey.Open(ctx, "slug"); err == nil {
+		t.Fatal("opened the object without the customer key")
+	}
+}
+
+func TestFileSystemOptions(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.NewWithOptions("kipp", srv.Config(), s3.Options{
+		StorageClass:         "STANDARD_IA",
+		ServerSideEncryption: s3.SSEKMS,
+		KMSKeyID:             "some-key",
+		Lifecycle:            true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(36 * time.Hour).Truncate(time.Second)
+	ctx := filesystem.WithExpires(context.Background(), expires)
+	if err := fs.Create(ctx, "staged.upload", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Copy(ctx, "staged.upload", "slug"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, slug := range map[string]string{"staged.upload": "staged", "slug": "slug"} {
+		h := srv.Header("kipp/" + name)
+		for k, want := range map[string]string{
+			"X-Amz-Storage-Class":                         "STANDARD_IA",
+			"X-Amz-Server-Side-Encryption":                s3.SSEKMS,
+			"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "some-key",
+			"Expires": expires.UTC().Format(http.TimeFormat),
+		} {
+			if got := h.Get(k); got != want {
+				t.Errorf("unexpected %s for %s; got %q, want %q", k, name, got, want)
+			}
+		}
+		tags, err := url.ParseQuery(h.Get("X-Amz-Tagging"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range map[string]string{
+			s3.SlugTag:       slug,
+			s3.ExpiresTag:    expires.UTC().Format(time.RFC3339),
+			s3.ExpiryDaysTag: "2",
+		} {
+			if got := tags.Get(k); got != want {
+				t.Errorf("unexpected tag %s for %s; got %q, want %q", k, name, got, want)
+			}
+		}
+	}
+
+	// Objects which don't expire are only tagged with their slug.
+	if err := fs.Create(context.Background(), "forever", strings.NewReader("some content")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Header("kipp/forever").Get("X-Amz-Tagging"), s3.SlugTag+"=forever"; got != want {
+		t.Fatalf("unexpected tagging; got %q, want %q", got, want)
+	}
+}
+
+func TestNewWithOptionsInvalid(t *testing.T) {
+	for _, opts := range []s3.Options{
+		{ServerSideEncryption: "rot13"},
+		{KMSKeyID: "some-key"},
+		{CustomerKey: []byte("short")},
+		{CustomerKey: bytes.Repeat([]byte{1}, 32), ServerSideEncryption: s3.SSES3},
+	} {
+		if _, err := s3.NewWithOptions("kipp", nil, opts); err == nil {
+			t.Errorf("%+v: expected an error", opts)
+		}
+	}
+}
+
+func TestFileSystemRedirectURL(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := fs.Create(ctx, "slug", strings.NewReader("<h1>hello</h1>")); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := fs.RedirectURL(ctx, "slug", time.Minute, "text/plain; charset=utf-8", `filename="hello.html"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := mustParseQuery(t, u); q.Get("X-Amz-Expires") != "60" || q.Get("X-Amz-Signature") == "" {
+		t.Fatalf("url is not presigned: %s", u)
+	}
+
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "<h1>hello</h1>"; got != want {
+		t.Fatalf("unexpected body; got %q, want %q", got, want)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":        "text/plain; charset=utf-8",
+		"Content-Disposition": `filename="hello.html"`,
+	} {
+		if got := res.Header.Get(k); got != want {
+			t.Fatalf("unexpected %s; got %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestFileSystemRanges(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	b := bytes.Repeat([]byte("0123456789abcdef"), 3<<20/16)
+	if err := fs.Create(ctx, "slug", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	n := len(srv.Requests())
+
+	f, err := fs.OpenSize(ctx, "slug", int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := srv.Requests()[n:]; len(got) > 0 {
+		t.Fatalf("open made requests: %q", got)
+	}
+
+	// Sniff, then read everything, as the server does.
+	if _, err := io.ReadFull(f, make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("unexpected content; got %d bytes, want %d bytes", len(got), len(b))
+	}
+
+	if _, err := f.Seek(-1<<20, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(f, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"GET /kipp/slug bytes=0-65535",
+		"GET /kipp/slug bytes=65536-1114111",
+		"GET /kipp/slug bytes=1114112-3145727",
+		"GET /kipp/slug bytes=2097152-3145727",
+	}
+	if got := srv.Requests()[n:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected requests; got %q, want %q", got, want)
+	}
+}
+
+func TestFileSystemOpenSizeNotFound(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenSize(context.Background(), "missing", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 10)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func mustParseQuery(t *testing.T, s string) url.Values {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
@@ -0,0 +1,226 @@
+package sftp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/uhthomas/kipp/filesystem"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A FileSystem stores objects in a directory on a remote host, over SFTP.
+type FileSystem struct {
+	dial     DialFunc
+	dir, tmp string
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+// New creates a new FileSystem, which starts SFTP sessions with dial, and makes
+// the relevant remote directories for dir and tmp. Should a session be lost,
+// a new one is started when it's next needed.
+func New(dial DialFunc, dir string) (*FileSystem, error) {
+	fs := &FileSystem{dial: dial, dir: dir, tmp: path.Join(dir, "tmp")}
+	if err := fs.do(func(c *sftp.Client) error { return c.MkdirAll(fs.tmp) }); err != nil {
+		return nil, fmt.Errorf("mkdir all: %w", err)
+	}
+	return fs, nil
+}
+
+// A DialFunc starts a new SFTP session.
+type DialFunc func() (*sftp.Client, error)
+
+// Dialer returns a DialFunc which dials addr with config, as with Dial.
+func Dialer(addr string, config *ssh.ClientConfig) DialFunc {
+	return func() (*sftp.Client, error) { return Dial(addr, config) }
+}
+
+// Dial connects to the SSH server at addr, and starts a new SFTP session. The
+// SSH connection is closed along with the session.
+func Dial(addr string, config *ssh.ClientConfig) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("ssh dial: %w", err)
+	}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("new client: %w", err)
+	}
+	go func() {
+		c.Wait()
+		conn.Close()
+	}()
+	return c, nil
+}
+
+// NewClientConfig creates an SSH client config for user, which authenticates
+// with the private keys in keyFiles, and verifies host keys against the
+// knownHostsFile.
+func NewClientConfig(user string, keyFiles []string, knownHostsFile string) (*ssh.ClientConfig, error) {
+	signers := make([]ssh.Signer, 0, len(keyFiles))
+	for _, name := range keyFiles {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("read key: %w", err)
+		}
+		s, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse private key %s: %w", name, err)
+		}
+		signers = append(signers, s)
+	}
+	cb, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: cb,
+	}, nil
+}
+
+// session returns the current session, or starts one if there's none.
+func (fs *FileSystem) session() (*sftp.Client, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.client != nil {
+		return fs.client, nil
+	}
+	c, err := fs.dial()
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	fs.client = c
+	go func() {
+		c.Wait()
+		fs.drop(c)
+	}()
+	return c, nil
+}
+
+// drop closes the session c, and forgets it if it's the current session.
+func (fs *FileSystem) drop(c *sftp.Client) {
+	fs.mu.Lock()
+	if fs.client == c {
+		fs.client = nil
+	}
+	fs.mu.Unlock()
+	c.Close()
+}
+
+// do calls f with the current session. Should the connection be lost, the
+// session is dropped, and f is called once more with a new one, so f must be
+// safe to repeat.
+func (fs *FileSystem) do(f func(c *sftp.Client) error) error {
+	for retried := false; ; retried = true {
+		c, err := fs.session()
+		if err != nil {
+			return err
+		}
+		if err = f(c); err == nil || !lost(err) {
+			return err
+		}
+		fs.drop(c)
+		if retried {
+			return err
+		}
+	}
+}
+
+// lost reports whether err may be due to the connection being lost. The
+// errors of failed sends aren't wrapped, so any which didn't come from the
+// server is assumed to be.
+func lost(err error) bool {
+	var status *sftp.StatusError
+	return !errors.As(err, &status) && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission)
+}
+
+// Create writes r to a temporary file, and renames it to a permanent location
+// upon success. As r can only be read once, it's not retried should the
+// connection be lost.
+func (fs *FileSystem) Create(_ context.Context, name string, r io.Reader) (err error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return err
+	}
+	tmp := path.Join(fs.tmp, "kipp"+hex.EncodeToString(b[:]))
+
+	c, err := fs.session()
+	if err != nil {
+		return err
+	}
+	// Errors reading r aren't the connection's, so don't drop the session,
+	// which may be in use by others.
+	src := &source{r: r}
+	defer func() {
+		if err != nil && src.err == nil && lost(err) {
+			fs.drop(c)
+		}
+	}()
+	f, err := c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("temp file: %w", err)
+	}
+	defer c.Remove(tmp)
+	defer f.Close()
+	if _, err := io.Copy(f, src); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := c.PosixRename(tmp, path.Join(fs.dir, name)); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// A source is the reader an object is created from, which records its
+// errors, so they can be told apart from those of the connection.
+type source struct {
+	r   io.Reader
+	err error
+}
+
+func (s *source) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// Open opens the named file.
+func (fs *FileSystem) Open(_ context.Context, name string) (filesystem.Reader, error) {
+	p := path.Join(fs.dir, name)
+	var f *sftp.File
+	if err := fs.do(func(c *sftp.Client) (err error) {
+		f, err = c.Open(p)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Remove removes the named file.
+func (fs *FileSystem) Remove(_ context.Context, name string) error {
+	p := path.Join(fs.dir, name)
+	if err := fs.do(func(c *sftp.Client) error { return c.Remove(p) }); err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package sftp_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	kippsftp "github.com/uhthomas/kipp/filesystem/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	s, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, b
+}
+
+// serve starts an in-process SSH server which serves the sftp subsystem for
+// the local filesystem, and only accepts the given client key.
+func serve(t *testing.T, host ssh.Signer, client ssh.PublicKey) net.Addr {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(k.Marshal()) != string(client.Marshal()) {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(host)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, reqs, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						for req := range reqs {
+							ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if !ok {
+								continue
+							}
+							s, err := sftp.NewServer(ch)
+							if err != nil {
+								return
+							}
+							s.Serve()
+							s.Close()
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr()
+}
+
+func TestFileSystem(t *testing.T) {
+	host, _ := newSigner(t)
+	key, pemKey := newSigner(t)
+	addr := serve(t, host, key.PublicKey())
+
+	dir := t.TempDir()
+	keyFile, knownHostsFile := filepath.Join(dir, "id_rsa"), filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(keyFile, pemKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(knownHostsFile, []byte(knownhosts.Line(
+		[]string{knownhosts.Normalize(addr.String())},
+		host.PublicKey(),
+	)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := kippsftp.NewClientConfig("kipp", []string{keyFile}, knownHostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem {
+		fs, err := kippsftp.New(dialer(t, addr.String(), config, nil), filepath.ToSlash(t.TempDir()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+// dialer returns a DialFunc which closes its sessions when t finishes, and
+// sends them to sessions, if it's not nil.
+func dialer(t *testing.T, addr string, config *ssh.ClientConfig, sessions chan<- *sftp.Client) kippsftp.DialFunc {
+	return func() (*sftp.Client, error) {
+		c, err := kippsftp.Dial(addr, config)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { c.Close() })
+		if sessions != nil {
+			sessions <- c
+		}
+		return c, nil
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	host, _ := newSigner(t)
+	key, _ := newSigner(t)
+	addr := serve(t, host, key.PublicKey())
+	config := &ssh.ClientConfig{
+		User:            "kipp",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.FixedHostKey(host.PublicKey()),
+	}
+
+	sessions := make(chan *sftp.Client, 2)
+	fs, err := kippsftp.New(dialer(t, addr.String(), config, sessions), filepath.ToSlash(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := fs.Create(ctx, "file", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the connection starts a new session, rather than failing.
+	(<-sessions).Close()
+	f, err := fs.Open(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "content" {
+		t.Fatalf("unexpected content; got %q, want %q", b, "content")
+	}
+	select {
+	case <-sessions:
+	default:
+		t.Fatal("no new session was started")
+	}
+}
+
+// An errReader fails to read with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestCreateReaderError(t *testing.T) {
+	host, _ := newSigner(t)
+	key, _ := newSigner(t)
+	addr := serve(t, host, key.PublicKey())
+	config := &ssh.ClientConfig{
+		User:            "kipp",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.FixedHostKey(host.PublicKey()),
+	}
+
+	sessions := make(chan *sftp.Client, 2)
+	fs, err := kippsftp.New(dialer(t, addr.String(), config, sessions), filepath.ToSlash(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := fs.Create(ctx, "file", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A failing reader isn't a lost connection, so the session, and the
+	// files open with it, are kept.
+	errRead := errors.New("read failed")
+	if err := fs.Create(ctx, "other", errReader{errRead}); !errors.Is(err, errRead) {
+		t.Fatalf("unexpected error; got %v, want %v", err, errRead)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "content" {
+		t.Fatalf("unexpected content; got %q, want %q", b, "content")
+	}
+	<-sessions
+	select {
+	case <-sessions:
+		t.Fatal("a new session was started")
+	default:
+	}
+}
+
+func TestDialUnknownHost(t *testing.T) {
+	host, _ := newSigner(t)
+	key, _ := newSigner(t)
+	addr := serve(t, host, key.PublicKey())
+
+	other, _ := newSigner(t)
+	if _, err := kippsftp.Dial(addr.String(), &ssh.ClientConfig{
+		User:            "kipp",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.FixedHostKey(other.PublicKey()),
+	}); err == nil {
+		t.Fatal("dial succeeded, despite an unexpected host key")
+	}
+}
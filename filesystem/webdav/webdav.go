@@ -0,0 +1,152 @@
+package webdav
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/httpfs"
+)
+
+// A FileSystem stores objects in a collection on a WebDAV server.
+type FileSystem struct {
+	client   *http.Client
+	root     url.URL
+	user     *url.Userinfo
+	dir, tmp string
+}
+
+// New creates a new FileSystem for the collection at root, and makes the
+// relevant collections for root and its tmp collection. If root contains user
+// info, it is used for basic authentication.
+func New(ctx context.Context, client *http.Client, root *url.URL) (*FileSystem, error) {
+	fs := &FileSystem{client: client, root: *root, user: root.User}
+	fs.root.User = nil
+	fs.dir = strings.TrimSuffix(root.Path, "/")
+	fs.tmp = fs.dir + "/tmp"
+	if err := fs.mkcol(ctx, fs.tmp); err != nil {
+		return nil, fmt.Errorf("mkcol: %w", err)
+	}
+	return fs, nil
+}
+
+// mkcol makes the collection p, and any missing parents.
+func (fs *FileSystem) mkcol(ctx context.Context, p string) error {
+	req, err := fs.newRequest(ctx, "MKCOL", p+"/", nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpfs.Do(fs.client, req, http.StatusCreated, http.StatusMethodNotAllowed, http.StatusConflict)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	// A conflict means a parent is missing.
+	if res.StatusCode == http.StatusConflict {
+		if parent := path.Dir(p); parent != p && parent != "/" {
+			if err := fs.mkcol(ctx, parent); err != nil {
+				return err
+			}
+			return fs.mkcol(ctx, p)
+		}
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// Create streams r to a temporary resource, and moves it to a permanent
+// location upon success.
+func (fs *FileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return err
+	}
+	tmp := path.Join(fs.tmp, "kipp"+hex.EncodeToString(b[:]))
+
+	req, err := fs.newRequest(ctx, http.MethodPut, tmp, ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	res, err := httpfs.Do(fs.client, req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		fs.remove(context.Background(), tmp)
+		return fmt.Errorf("put: %w", err)
+	}
+	res.Body.Close()
+	defer fs.remove(context.Background(), tmp)
+
+	if req, err = fs.newRequest(ctx, "MOVE", tmp, nil); err != nil {
+		return err
+	}
+	dst := fs.root
+	dst.Path = path.Join(fs.dir, name)
+	req.Header.Set("Destination", dst.String())
+	req.Header.Set("Overwrite", "T")
+	if res, err = httpfs.Do(fs.client, req, http.StatusCreated, http.StatusNoContent); err != nil {
+		return fmt.Errorf("move: %w", err)
+	}
+	return res.Body.Close()
+}
+
+// Open opens the named resource.
+func (fs *FileSystem) Open(ctx context.Context, name string) (filesystem.Reader, error) {
+	return httpfs.NewReader(func(offset int64) (*http.Response, error) {
+		req, err := fs.newRequest(ctx, http.MethodGet, path.Join(fs.dir, name), nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		res, err := httpfs.Do(fs.client, req, http.StatusOK, http.StatusPartialContent)
+		if err != nil {
+			return nil, fmt.Errorf("get: %w", err)
+		}
+		return res, nil
+	})
+}
+
+// Remove removes the named resource.
+func (fs *FileSystem) Remove(ctx context.Context, name string) error {
+	return fs.remove(ctx, path.Join(fs.dir, name))
+}
+
+func (fs *FileSystem) remove(ctx context.Context, p string) error {
+	req, err := fs.newRequest(ctx, http.MethodDelete, p, nil)
+	if err != nil {
+		return err
+	}
+	res, err := httpfs.Do(fs.client, req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("delete %s: %w", p, err)
+	}
+	return res.Body.Close()
+}
+
+// newRequest creates a new request for the resource at path p.
+func (fs *FileSystem) newRequest(ctx context.Context, method, p string, body io.Reader) (*http.Request, error) {
+	u := fs.root
+	u.Path = p
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if fs.user != nil {
+		password, _ := fs.user.Password()
+		req.SetBasicAuth(fs.user.Username(), password)
+	}
+	return req, nil
+}
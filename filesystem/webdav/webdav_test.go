@@ -0,0 +1,55 @@
+package webdav_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/filesystemtest"
+	kippwebdav "github.com/uhthomas/kipp/filesystem/webdav"
+	"golang.org/x/net/webdav"
+)
+
+func TestFileSystem(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem { return newFileSystem(t, false) })
+}
+
+// TestFileSystemIgnoreRange tests against a server which ignores ranges, as
+// many do.
+func TestFileSystemIgnoreRange(t *testing.T) {
+	filesystemtest.TestFileSystem(t, func(t *testing.T) filesystem.FileSystem { return newFileSystem(t, true) })
+}
+
+func newFileSystem(t *testing.T, ignoreRange bool) filesystem.FileSystem {
+	t.Helper()
+
+	h := &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL + "/some/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("user", "password")
+	fs, err := kippwebdav.New(context.Background(), http.DefaultClient, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
@@ -3,11 +3,20 @@ module github.com/uhthomas/kipp
 go 1.15
 
 require (
+	github.com/alecthomas/chroma v0.10.0
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d
 	github.com/aws/aws-sdk-go v1.30.16
 	github.com/dgraph-io/badger/v2 v2.0.3
 	github.com/dgraph-io/ristretto v0.0.2 // indirect
+	github.com/klauspost/compress v1.11.7
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/lib/pq v1.5.2
+	github.com/pkg/sftp v1.12.0
+	github.com/yuin/goldmark v1.4.0
 	github.com/zeebo/blake3 v0.0.1
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,299 @@
+// Package archive exports entries and their files to, and imports them from,
+// a tar archive.
+//
+// An archive starts with a manifest, "manifest.ndjson", which has one JSON
+// record per entry. It's followed by the file of each entry, "files/<slug>",
+// in the same order. Links have no file, so they're only in the manifest. Only the manifest is held in memory, so files are
+// streamed without being staged on disk.
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/migrate"
+)
+
+const (
+	manifestName = "manifest.ndjson"
+	filesDir     = "files/"
+)
+
+// A record is the JSON representation of an entry in the manifest.
+type record struct {
+	Slug      string     `json:"slug"`
+	Name      string     `json:"name"`
+	Sum       string     `json:"sum"`
+	Size      int64      `json:"size"`
+	Lifetime  *time.Time `json:"lifetime,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+	Uploader  string     `json:"uploader,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	// File isn't exported, as files are archived by slug, and imported
+	// under it.
+	File string `json:"-"`
+}
+
+// An ExportResult is the result of an export.
+type ExportResult struct {
+	// Exported is the number of entries exported, and Bytes is the total
+	// size of their files.
+	Exported int
+	Bytes    int64
+	// Missing are entries whose file doesn't exist. They're in the
+	// manifest, but not the archive.
+	Missing []database.Entry
+}
+
+// Log writes a summary of r, followed by each missing file, to logf.
+func (r ExportResult) Log(logf func(format string, v ...interface{})) {
+	logf("export: %d exported (%d bytes), %d missing", r.Exported, r.Bytes, len(r.Missing))
+	for _, e := range r.Missing {
+		logf("export: missing %s", e.Slug)
+	}
+}
+
+// Export writes every entry in db, and its file in fs, to w. A corrupt file
+// fails the export, as the archive can't be amended once written.
+func Export(ctx context.Context, w io.Writer, db database.Database, fs filesystem.FileSystem) (ExportResult, error) {
+	var res ExportResult
+	var (
+		entries  []database.Entry
+		manifest bytes.Buffer
+	)
+	enc := json.NewEncoder(&manifest)
+	if err := db.Walk(ctx, func(e database.Entry) error {
+		entries = append(entries, e)
+		return enc.Encode(record(e))
+	}); err != nil {
+		return res, fmt.Errorf("walk database: %w", err)
+	}
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(manifest.Len()),
+		ModTime: now,
+	}); err != nil {
+		return res, fmt.Errorf("write manifest header: %w", err)
+	}
+	if _, err := manifest.WriteTo(tw); err != nil {
+		return res, fmt.Errorf("write manifest: %w", err)
+	}
+
+	for _, e := range entries {
+		if e.URL != "" {
+			res.Exported++
+			continue
+		}
+		err := exportFile(ctx, tw, fs, e)
+		if errors.Is(err, os.ErrNotExist) {
+			res.Missing = append(res.Missing, e)
+			continue
+		}
+		if err != nil {
+			return res, fmt.Errorf("export %s: %w", e.Slug, err)
+		}
+		res.Exported++
+		res.Bytes += e.Size
+	}
+	if err := tw.Close(); err != nil {
+		return res, fmt.Errorf("close: %w", err)
+	}
+	return res, nil
+}
+
+func exportFile(ctx context.Context, tw *tar.Writer, fs filesystem.FileSystem, e database.Entry) error {
+	f, err := fs.Open(ctx, e.FileName())
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    filesDir + e.Slug,
+		Mode:    0644,
+		Size:    e.Size,
+		ModTime: e.Timestamp,
+	}); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	if _, err := io.Copy(tw, migrate.Verify(f, e)); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	return nil
+}
+
+// A Failure is an entry which couldn't be imported.
+type Failure struct {
+	Entry database.Entry
+	Err   error
+}
+
+// An ImportResult is the result of an import.
+type ImportResult struct {
+	// Imported is the number of entries imported.
+	Imported int
+	// Skipped is the number of entries which had already been imported.
+	Skipped int
+	// Expired is the number of expired entries which were skipped.
+	Expired int
+	// Conflicts are entries whose slug is used by a different file. They're
+	// never overwritten.
+	Conflicts []database.Entry
+	Failed    []Failure
+	// Missing are entries whose file wasn't in the archive.
+	Missing []database.Entry
+}
+
+// ImportOptions configure Import.
+type ImportOptions struct {
+	// SkipExpired, if true, skips entries which have expired.
+	SkipExpired bool
+}
+
+// Import reads an archive from r, and creates each entry and its file in db
+// and fs. Entries keep their original timestamps and lifetimes. Files are
+// verified against the sum and size of their entry, and are created before
+// their entry. Entries which already exist with the same sum are skipped, so
+// an interrupted import can be resumed by running it again.
+func Import(ctx context.Context, r io.Reader, db database.Database, fs filesystem.FileSystem, opts ImportOptions) (ImportResult, error) {
+	var res ImportResult
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return res, fmt.Errorf("read manifest header: %w", err)
+	}
+	if hdr.Name != manifestName {
+		return res, fmt.Errorf("unexpected %s, want %s", hdr.Name, manifestName)
+	}
+	pending := make(map[string]database.Entry)
+	var order []string
+	dec := json.NewDecoder(tr)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return res, fmt.Errorf("decode manifest: %w", err)
+		}
+		pending[rec.Slug] = database.Entry(rec)
+		order = append(order, rec.Slug)
+	}
+
+	now := time.Now()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("read header: %w", err)
+		}
+		slug := strings.TrimPrefix(hdr.Name, filesDir)
+		e, ok := pending[slug]
+		if !ok || slug == hdr.Name || path.Base(slug) != slug {
+			return res, fmt.Errorf("unexpected %s", hdr.Name)
+		}
+		delete(pending, slug)
+		if err := res.importEntry(ctx, tr, db, fs, e, opts, now); err != nil {
+			return res, err
+		}
+	}
+	for _, slug := range order {
+		e, ok := pending[slug]
+		switch {
+		case !ok:
+		case e.URL != "":
+			if err := res.importEntry(ctx, nil, db, fs, e, opts, now); err != nil {
+				return res, err
+			}
+		default:
+			res.Missing = append(res.Missing, e)
+		}
+	}
+	return res, nil
+}
+
+// importEntry imports e, whose file is read from r, and records the outcome in
+// res. It only returns an error if ctx is done.
+func (res *ImportResult) importEntry(ctx context.Context, r io.Reader, db database.Database, fs filesystem.FileSystem, e database.Entry, opts ImportOptions, now time.Time) error {
+	if opts.SkipExpired && e.Lifetime != nil && e.Lifetime.Before(now) {
+		res.Expired++
+		return nil
+	}
+	switch imported, err := importFile(ctx, r, db, fs, e); {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.Is(err, errConflict):
+		res.Conflicts = append(res.Conflicts, e)
+	case err != nil:
+		res.Failed = append(res.Failed, Failure{Entry: e, Err: err})
+	case imported:
+		res.Imported++
+	default:
+		res.Skipped++
+	}
+	return nil
+}
+
+var errConflict = errors.New("slug is used by a different file")
+
+// importFile imports e, whose file is read from r, and reports whether it was
+// imported. Links have no file, so r is ignored for them.
+func importFile(ctx context.Context, r io.Reader, db database.Database, fs filesystem.FileSystem, e database.Entry) (bool, error) {
+	switch existing, err := db.Lookup(ctx, e.Slug); {
+	case err == nil && existing.Sum == e.Sum && existing.URL == e.URL:
+		return false, nil
+	case err == nil:
+		return false, errConflict
+	case !errors.Is(err, database.ErrNoResults):
+		return false, fmt.Errorf("lookup: %w", err)
+	}
+	if e.URL != "" {
+		if err := db.Create(ctx, e); err != nil {
+			return false, fmt.Errorf("create entry: %w", err)
+		}
+		return true, nil
+	}
+	fctx := ctx
+	if e.Lifetime != nil {
+		fctx = filesystem.WithExpires(ctx, *e.Lifetime)
+	}
+	if err := fs.Create(fctx, e.Slug, migrate.Verify(r, e)); err != nil {
+		return false, fmt.Errorf("create: %w", err)
+	}
+	if err := db.Create(ctx, e); err != nil {
+		return false, fmt.Errorf("create entry: %w", err)
+	}
+	return true, nil
+}
+
+// Log writes a summary of r, followed by each problem, to logf.
+func (r ImportResult) Log(logf func(format string, v ...interface{})) {
+	logf(
+		"import: %d imported, %d already imported, %d expired, %d conflicting, %d failed, %d missing",
+		r.Imported, r.Skipped, r.Expired, len(r.Conflicts), len(r.Failed), len(r.Missing),
+	)
+	for _, e := range r.Conflicts {
+		logf("import: conflicting %s: slug is used by a different file", e.Slug)
+	}
+	for _, f := range r.Failed {
+		logf("import: failed %s: %v", f.Entry.Slug, f.Err)
+	}
+	for _, e := range r.Missing {
+		logf("import: missing %s", e.Slug)
+	}
+}
@@ -0,0 +1,151 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/memory"
+	"github.com/uhthomas/kipp/filesystem"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/internal/archive"
+	"github.com/zeebo/blake3"
+)
+
+func entry(slug, content string, lifetime *time.Time) database.Entry {
+	h := blake3.New()
+	h.Write([]byte(content))
+	return database.Entry{
+		Slug:      slug,
+		Name:      slug + ".txt",
+		Sum:       base64.RawURLEncoding.EncodeToString(h.Sum(nil)),
+		Size:      int64(len(content)),
+		Lifetime:  lifetime,
+		Timestamp: time.Date(2020, 8, 22, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func read(t *testing.T, fs filesystem.FileSystem, name string) string {
+	t.Helper()
+	f, err := fs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	db, fs := memory.New(0), memoryfs.New(0)
+
+	future, past := time.Now().Add(time.Hour).UTC(), time.Now().Add(-time.Hour).UTC()
+	for _, v := range []struct {
+		e       database.Entry
+		content string
+	}{
+		{entry("permanent", "hello", nil), "hello"},
+		{entry("temporary", "world", &future), "world"},
+		{entry("expired", "gone", &past), "gone"},
+		{entry("missing", "lost", nil), ""},
+		{database.Entry{Slug: "link", Timestamp: time.Now().UTC(), URL: "https://example.com"}, ""},
+	} {
+		if err := db.Create(ctx, v.e); err != nil {
+			t.Fatal(err)
+		}
+		if v.content != "" {
+			if err := fs.Create(ctx, v.e.Slug, strings.NewReader(v.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	eres, err := archive.Export(ctx, &buf, db, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eres.Exported != 4 || eres.Bytes != 14 || len(eres.Missing) != 1 {
+		t.Fatalf("unexpected export result: %+v", eres)
+	}
+	b := buf.Bytes()
+
+	db2, fs2 := memory.New(0), memoryfs.New(0)
+	res, err := archive.Import(ctx, bytes.NewReader(b), db2, fs2, archive.ImportOptions{SkipExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 3 || res.Expired != 1 || len(res.Missing) != 1 || res.Missing[0].Slug != "missing" {
+		t.Fatalf("unexpected import result: %+v", res)
+	}
+	got, err := db2.Lookup(ctx, "temporary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := entry("temporary", "world", &future)
+	if !got.Timestamp.Equal(want.Timestamp) || got.Lifetime == nil || !got.Lifetime.Equal(future) {
+		t.Fatalf("timestamps were not preserved; got %+v, want %+v", got, want)
+	}
+	if got := read(t, fs2, "temporary"); got != "world" {
+		t.Fatalf("unexpected content; got %q, want %q", got, "world")
+	}
+	if _, err := db2.Lookup(ctx, "expired"); err != database.ErrNoResults {
+		t.Fatalf("expired entry was imported: %v", err)
+	}
+	if got, err := db2.Lookup(ctx, "link"); err != nil || got.URL != "https://example.com" {
+		t.Fatalf("unexpected link; got (%+v, %v)", got, err)
+	}
+
+	// Importing again skips what has been imported.
+	if res, err = archive.Import(ctx, bytes.NewReader(b), db2, fs2, archive.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 1 || res.Skipped != 3 {
+		t.Fatalf("unexpected import result: %+v", res)
+	}
+}
+
+func TestImportCorrupt(t *testing.T) {
+	ctx := context.Background()
+	e := entry("corrupt", "hello", nil)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{"manifest.ndjson", `{"slug":"corrupt","name":"corrupt.txt","sum":"` + e.Sum + `","size":5,"timestamp":"2020-08-22T12:00:00Z"}` + "\n"},
+		{"files/corrupt", "hellp"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, fs := memory.New(0), memoryfs.New(0)
+	res, err := archive.Import(ctx, &buf, db, fs, archive.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 1 || res.Imported != 0 {
+		t.Fatalf("unexpected import result: %+v", res)
+	}
+	if _, err := db.Lookup(ctx, "corrupt"); err != database.ErrNoResults {
+		t.Fatalf("corrupt entry was imported: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package azuretest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Account is the storage account name served by Server.
+const Account = "devstoreaccount1"
+
+// A Server is a minimal, in-process stand-in for the Azure Blob service, using
+// path style URLs like Azurite. It implements just enough of the API for
+// kipp's tests, and containers are created implicitly on first use.
+//
+// Requests must be authorised, but signatures are not verified. SharedKey
+// signatures are checked against the Azure SDK's by the azblob tests instead.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	blobs  map[string]blob
+	blocks map[string]map[string][]byte
+}
+
+type blob struct {
+	b       []byte
+	modTime time.Time
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		blobs:  make(map[string]blob),
+		blocks: make(map[string]map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Endpoint returns the endpoint for Account.
+func (s *Server) Endpoint() string { return s.URL + "/" + Account }
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+Account+":") && r.URL.Query().Get("sig") == "" {
+		writeError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+Account+"/")
+	if i := strings.Index(key, "/"); key == r.URL.Path || i < 0 || i == len(key)-1 {
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		s.mu.Lock()
+		if s.blocks[key] == nil {
+			s.blocks[key] = make(map[string][]byte)
+		}
+		s.blocks[key][q.Get("blockid")] = b
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		var buf bytes.Buffer
+		for _, id := range list.Latest {
+			b, ok := s.blocks[key][id]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			buf.Write(b)
+		}
+		delete(s.blocks, key)
+		s.blobs[key] = blob{b: buf.Bytes(), modTime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "":
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+			writeError(w, http.StatusBadRequest, "InvalidBlobType")
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		s.mu.Lock()
+		s.blobs[key] = blob{b: b, modTime: time.Now()}
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.mu.Lock()
+		b, ok := s.blobs[key]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if v := r.Header.Get("X-Ms-Range"); v != "" {
+			r.Header.Set("Range", v)
+		}
+		http.ServeContent(w, r, "", b.modTime, bytes.NewReader(b.b))
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		_, ok := s.blobs[key]
+		delete(s.blobs, key)
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Ms-Error-Code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
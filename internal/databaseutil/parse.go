@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"strconv"
 
 	"github.com/uhthomas/kipp/database"
 	"github.com/uhthomas/kipp/database/badger"
+	"github.com/uhthomas/kipp/database/memory"
 	"github.com/uhthomas/kipp/database/sql"
 )
 
@@ -19,6 +21,14 @@ func Parse(ctx context.Context, s string) (database.Database, error) {
 	switch u.Scheme {
 	case "":
 		return badger.Open(u.Path)
+	case "mem":
+		var max int
+		if v := u.Query().Get("max"); v != "" {
+			if max, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("parse max: %w", err)
+			}
+		}
+		return memory.New(max), nil
 	case "psql", "postgres", "postgresql":
 		return sql.Open(ctx, "postgres", u.String())
 	}
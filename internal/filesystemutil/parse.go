@@ -1,18 +1,39 @@
 package filesystemutil
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/filesystem/azblob"
+	"github.com/uhthomas/kipp/filesystem/cache"
+	"github.com/uhthomas/kipp/filesystem/compress"
+	"github.com/uhthomas/kipp/filesystem/encrypt"
+	"github.com/uhthomas/kipp/filesystem/gcs"
 	"github.com/uhthomas/kipp/filesystem/local"
+	"github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/filesystem/mirror"
 	"github.com/uhthomas/kipp/filesystem/s3"
+	"github.com/uhthomas/kipp/filesystem/sftp"
+	"github.com/uhthomas/kipp/filesystem/webdav"
 )
 
 // Parse parses s, and will create the appropriate filesystem for the scheme.
-func Parse(s string) (filesystem.FileSystem, error) {
+func Parse(ctx context.Context, s string) (filesystem.FileSystem, error) {
 	u, err := url.Parse(s)
 	if err != nil {
 		return nil, err
@@ -20,16 +41,271 @@ func Parse(s string) (filesystem.FileSystem, error) {
 	switch u.Scheme {
 	case "":
 		return local.New(u.Path)
-	case "s3":
-		c := &aws.Config{Region: &u.Host}
-		if u.User != nil {
-			p, _ := u.User.Password()
-			c.Credentials = credentials.NewStaticCredentials(u.User.Username(), p, "")
+	case "azblob":
+		q := u.Query()
+		var auth azblob.Authorizer
+		if sas := q.Get("sas"); sas != "" {
+			if auth, err = azblob.ParseSAS(sas); err != nil {
+				return nil, fmt.Errorf("parse sas: %w", err)
+			}
+		} else {
+			key := q.Get("key")
+			if key == "" {
+				key = os.Getenv("AZURE_STORAGE_KEY")
+			}
+			if auth, err = azblob.NewSharedKey(u.Host, key); err != nil {
+				return nil, fmt.Errorf("new shared key: %w", err)
+			}
+		}
+		endpoint := "https://" + u.Host + ".blob.core.windows.net"
+		if e := q.Get("endpoint"); e != "" {
+			endpoint = e
+		}
+		container, prefix := strings.TrimPrefix(u.Path, "/"), ""
+		if i := strings.Index(container, "/"); i > -1 {
+			container, prefix = container[:i], container[i+1:]
+		}
+		return azblob.New(http.DefaultClient, endpoint, container, prefix, auth), nil
+	case "cache":
+		q := u.Query()
+		if q.Get("filesystem") == "" {
+			return nil, fmt.Errorf("missing filesystem")
+		}
+		fs, err := Parse(ctx, q.Get("filesystem"))
+		if err != nil {
+			return nil, fmt.Errorf("parse filesystem: %w", err)
+		}
+		max := units.GiB
+		if v := q.Get("max"); v != "" {
+			if max, err = units.ParseBase2Bytes(v); err != nil {
+				return nil, fmt.Errorf("parse max: %w", err)
+			}
+		}
+		return cache.New(fs, u.Path, int64(max))
+	case "compress":
+		q := u.Query()
+		if q.Get("filesystem") == "" {
+			return nil, fmt.Errorf("missing filesystem")
+		}
+		fs, err := Parse(ctx, q.Get("filesystem"))
+		if err != nil {
+			return nil, fmt.Errorf("parse filesystem: %w", err)
+		}
+		encoding := "zstd"
+		if v := q.Get("encoding"); v != "" {
+			encoding = v
 		}
-		if e := u.Query().Get("endpoint"); e != "" {
-			c.Endpoint = &e
+		ratio := 0.9
+		if v := q.Get("ratio"); v != "" {
+			if ratio, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("parse ratio: %w", err)
+			}
 		}
-		return s3.New(u.Path, c)
+		return compress.New(fs, encoding, ratio)
+	case "encrypt":
+		q := u.Query()
+		if q.Get("filesystem") == "" {
+			return nil, fmt.Errorf("missing filesystem")
+		}
+		fs, err := Parse(ctx, q.Get("filesystem"))
+		if err != nil {
+			return nil, fmt.Errorf("parse filesystem: %w", err)
+		}
+		var keys []*encrypt.Key
+		for _, name := range q["key"] {
+			k, err := encrypt.ReadKeyFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("read key file: %w", err)
+			}
+			keys = append(keys, k)
+		}
+		return encrypt.New(fs, keys...)
+	case "gs":
+		q := u.Query()
+		var anonymous bool
+		if v := q.Get("anonymous"); v != "" {
+			if anonymous, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("parse anonymous: %w", err)
+			}
+		}
+		client := http.DefaultClient
+		if !anonymous {
+			if client, err = gcs.DefaultClient(ctx); err != nil {
+				return nil, fmt.Errorf("default client: %w", err)
+			}
+		}
+		endpoint := gcs.DefaultEndpoint
+		if e := q.Get("endpoint"); e != "" {
+			endpoint = e
+		}
+		return gcs.New(client, endpoint, u.Host, u.Path), nil
+	case "mem":
+		var max units.Base2Bytes
+		if v := u.Query().Get("max"); v != "" {
+			if max, err = units.ParseBase2Bytes(v); err != nil {
+				return nil, fmt.Errorf("parse max: %w", err)
+			}
+		}
+		return memory.New(int64(max)), nil
+	case "mirror":
+		return parseMirror(ctx, u)
+	case "s3":
+		return parseS3(u)
+	case "sftp":
+		return parseSFTP(u)
+	case "webdav", "webdavs":
+		root := *u
+		root.Scheme = "http"
+		if u.Scheme == "webdavs" {
+			root.Scheme = "https"
+		}
+		return webdav.New(ctx, http.DefaultClient, &root)
 	}
 	return nil, fmt.Errorf("invalid scheme: %s", u.Scheme)
 }
+
+// parseS3 parses the s3 filesystem, and how its objects are stored.
+func parseS3(u *url.URL) (filesystem.FileSystem, error) {
+	q := u.Query()
+	c := &aws.Config{Region: &u.Host}
+	if u.User != nil {
+		p, _ := u.User.Password()
+		c.Credentials = credentials.NewStaticCredentials(u.User.Username(), p, "")
+	}
+	if e := q.Get("endpoint"); e != "" {
+		c.Endpoint = &e
+	}
+
+	opts := s3.Options{
+		StorageClass: q.Get("storage-class"),
+		KMSKeyID:     q.Get("kms-key"),
+		Prefix:       q.Get("prefix"),
+	}
+	switch v := q.Get("sse"); v {
+	case "":
+	case "s3":
+		opts.ServerSideEncryption = s3.SSES3
+	case "kms":
+		opts.ServerSideEncryption = s3.SSEKMS
+	default:
+		return nil, fmt.Errorf("invalid sse: %s", v)
+	}
+	if name := q.Get("sse-c-key"); name != "" {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("read sse-c key: %w", err)
+		}
+		// Keys may be raw, or base64 encoded.
+		if len(b) != 32 {
+			if b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err != nil {
+				return nil, fmt.Errorf("decode sse-c key: %w", err)
+			}
+		}
+		opts.CustomerKey = b
+	}
+	for k, v := range map[string]*bool{
+		"tags":      &opts.Tags,
+		"lifecycle": &opts.Lifecycle,
+	} {
+		if s := q.Get(k); s != "" {
+			var err error
+			if *v, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", k, err)
+			}
+		}
+	}
+	return s3.NewWithOptions(u.Path, c, opts)
+}
+
+// parseMirror parses each of the mirror's filesystems, and starts repairing
+// them in the background until ctx is done.
+func parseMirror(ctx context.Context, u *url.URL) (filesystem.FileSystem, error) {
+	q := u.Query()
+	var replicas []filesystem.FileSystem
+	for _, v := range q["filesystem"] {
+		fs, err := Parse(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("parse filesystem: %w", err)
+		}
+		replicas = append(replicas, fs)
+	}
+
+	quorum := len(replicas)/2 + 1
+	if v := q.Get("quorum"); v != "" {
+		var err error
+		if quorum, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("parse quorum: %w", err)
+		}
+	}
+	repair := time.Minute
+	if v := q.Get("repair"); v != "" {
+		var err error
+		if repair, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("parse repair: %w", err)
+		}
+	}
+	resync := 24 * time.Hour
+	if v := q.Get("resync"); v != "" {
+		var err error
+		if resync, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("parse resync: %w", err)
+		}
+	}
+
+	fs, err := mirror.New(quorum, replicas...)
+	if err != nil {
+		return nil, err
+	}
+	if repair > 0 {
+		go fs.RepairLoop(ctx, repair)
+	}
+	if resync > 0 {
+		go fs.ResyncLoop(ctx, resync)
+	}
+	return fs, nil
+}
+
+// parseSFTP connects to the SFTP server described by u. By default, it
+// authenticates with the user's usual SSH keys, and verifies the host against
+// their known_hosts file.
+func parseSFTP(u *url.URL) (filesystem.FileSystem, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("user home dir: %w", err)
+	}
+
+	name := u.User.Username()
+	if name == "" {
+		cu, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("current user: %w", err)
+		}
+		name = cu.Username
+	}
+
+	q := u.Query()
+	keys := q["key"]
+	if len(keys) == 0 {
+		for _, k := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			k = filepath.Join(home, ".ssh", k)
+			if _, err := os.Stat(k); err == nil {
+				keys = append(keys, k)
+			}
+		}
+	}
+	knownHosts := q.Get("known_hosts")
+	if knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	config, err := sftp.NewClientConfig(name, keys, knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("new client config: %w", err)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	return sftp.New(sftp.Dialer(addr, config), u.Path)
+}
@@ -0,0 +1,154 @@
+// Package gc removes expired entries, and files which have no entry.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/scrub"
+	"github.com/uhthomas/kipp/internal/thumbnail"
+	"github.com/uhthomas/kipp/internal/view"
+)
+
+// A Result is the result of a collection.
+type Result struct {
+	// Expired are the expired entries which were removed, along with their
+	// files, thumbnails and views.
+	Expired []database.Entry
+	// Orphans are the files with no entry which were removed, including any
+	// other files derived from expired entries. They're only found if the
+	// filesystem can list its objects.
+	Orphans []filesystem.Object
+}
+
+// A Collector removes expired entries and orphaned files.
+type Collector struct {
+	Database   database.Database
+	FileSystem filesystem.FileSystem
+	// Grace is how long a file must be unmodified before it's considered
+	// orphaned. Files are written before their entries, so it should be
+	// much longer than an upload takes.
+	Grace time.Duration
+	// DryRun, if true, reports what would be removed without removing
+	// anything.
+	DryRun bool
+
+	notWalker sync.Once
+}
+
+// Collect removes expired entries, their files, thumbnails and views, then
+// removes orphaned files. Files with a name of the form "slug.suffix" belong
+// to the entry with that slug, so are removed with it, however new. Quarantined files are never removed. Every file
+// the filesystem lists is considered, so it mustn't be shared with anything
+// else.
+func (c *Collector) Collect(ctx context.Context) (Result, error) {
+	now := time.Now()
+	var res Result
+	// live is true for the slugs of unexpired entries, and false for the
+	// slugs of expired entries.
+	live := make(map[string]bool)
+	if err := c.Database.Walk(ctx, func(e database.Entry) error {
+		expired := e.Lifetime != nil && e.Lifetime.Before(now)
+		if expired {
+			res.Expired = append(res.Expired, e)
+		}
+		live[e.Slug] = !expired
+		return nil
+	}); err != nil {
+		return res, fmt.Errorf("walk database: %w", err)
+	}
+
+	if err := filesystem.Walk(ctx, c.FileSystem, func(o filesystem.Object) error {
+		if strings.HasSuffix(o.Name, scrub.QuarantineSuffix) {
+			return nil
+		}
+		slug := o.Name
+		if i := strings.Index(slug, "."); i > -1 {
+			slug = slug[:i]
+		}
+		l, ok := live[slug]
+		switch {
+		case l:
+			return nil
+		case ok:
+			// The files of expired entries are removed with them,
+			// and any other derived files now.
+			if slug == o.Name {
+				return nil
+			}
+		case o.ModTime.After(now.Add(-c.Grace)):
+			return nil
+		}
+		res.Orphans = append(res.Orphans, o)
+		return nil
+	}); errors.Is(err, filesystem.ErrNotWalker) {
+		c.notWalker.Do(func() {
+			log.Print("gc: the filesystem can't list its files, so orphans won't be removed")
+		})
+	} else if err != nil {
+		return res, fmt.Errorf("walk filesystem: %w", err)
+	}
+
+	if c.DryRun {
+		return res, nil
+	}
+	for _, e := range res.Expired {
+		if err := c.Database.Remove(ctx, e.Slug); err != nil {
+			return res, fmt.Errorf("remove entry %s: %w", e.Slug, err)
+		}
+		// Should this fail, the file is orphaned, and will be removed
+		// by a later collection.
+		if err := c.FileSystem.Remove(ctx, e.FileName()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return res, fmt.Errorf("remove file %s: %w", e.Slug, err)
+		}
+		if err := thumbnail.Remove(ctx, c.FileSystem, e); err != nil {
+			return res, fmt.Errorf("remove thumbnails of %s: %w", e.Slug, err)
+		}
+		if err := view.Remove(ctx, c.FileSystem, e); err != nil {
+			return res, fmt.Errorf("remove view of %s: %w", e.Slug, err)
+		}
+	}
+	for _, o := range res.Orphans {
+		if err := c.FileSystem.Remove(ctx, o.Name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return res, fmt.Errorf("remove file %s: %w", o.Name, err)
+		}
+	}
+	return res, nil
+}
+
+// Loop collects every interval until ctx is done, logging the results.
+func (c *Collector) Loop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		res, err := c.Collect(ctx)
+		if err != nil {
+			log.Printf("gc: %v", err)
+		}
+		res.Log(log.Printf)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Log writes a summary of r, followed by each removed file, to logf.
+func (r Result) Log(logf func(format string, v ...interface{})) {
+	logf("gc: %d expired, %d orphaned", len(r.Expired), len(r.Orphans))
+	for _, e := range r.Expired {
+		logf("gc: expired %s (expired %s)", e.Slug, e.Lifetime.Format(time.RFC3339))
+	}
+	for _, o := range r.Orphans {
+		logf("gc: orphaned %s (%d bytes, modified %s)", o.Name, o.Size, o.ModTime.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,106 @@
+package gc_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/memory"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/internal/gc"
+	"github.com/uhthomas/kipp/internal/scrub"
+	"github.com/uhthomas/kipp/internal/thumbnail"
+	"github.com/uhthomas/kipp/internal/view"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	db, fs := memory.New(0), memoryfs.New(0)
+
+	expired, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for _, e := range []database.Entry{
+		{Slug: "permanent"},
+		{Slug: "temporary", Lifetime: &future},
+		{Slug: "expired", Lifetime: &expired},
+	} {
+		if err := db.Create(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{
+		"permanent",
+		"permanent.thumb",
+		"temporary",
+		"expired",
+		"orphan",
+		"orphan.thumb",
+		"corrupt" + scrub.QuarantineSuffix,
+	} {
+		if err := fs.Create(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	// Files modified within the grace period are not orphans yet.
+	if err := fs.Create(ctx, "uploading", strings.NewReader("uploading")); err != nil {
+		t.Fatal(err)
+	}
+	// But thumbnails and views are removed with their entry, however new.
+	thumb := thumbnail.Name(database.Entry{Slug: "expired"}, 320)
+	pasteView := view.Name(database.Entry{Slug: "expired"})
+	for _, name := range []string{thumb, pasteView} {
+		if err := fs.Create(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &gc.Collector{Database: db, FileSystem: fs, Grace: 5 * time.Millisecond, DryRun: true}
+	res, err := c.Collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Expired) != 1 || res.Expired[0].Slug != "expired" {
+		t.Fatalf("unexpected expired entries: %+v", res.Expired)
+	}
+	orphans := map[string]bool{}
+	for _, o := range res.Orphans {
+		orphans[o.Name] = true
+	}
+	if len(orphans) != 4 || !orphans["orphan"] || !orphans["orphan.thumb"] || !orphans[thumb] || !orphans[pasteView] {
+		t.Fatalf("unexpected orphans: %+v", res.Orphans)
+	}
+	// A dry run removes nothing.
+	if _, err := fs.Open(ctx, "orphan"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.DryRun = false
+	if _, err := c.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Lookup(ctx, "expired"); err != database.ErrNoResults {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+	for name, want := range map[string]bool{
+		"permanent":                        true,
+		"permanent.thumb":                  true,
+		"temporary":                        true,
+		"expired":                          false,
+		"orphan":                           false,
+		"orphan.thumb":                     false,
+		"corrupt" + scrub.QuarantineSuffix: true,
+		"uploading":                        true,
+		thumb:                              false,
+		pasteView:                          false,
+	} {
+		f, err := fs.Open(ctx, name)
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %t, want %t", name, got, want)
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package gcstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Server is a minimal, in-process stand-in for Google Cloud Storage's JSON
+// API. It implements just enough of the API for kipp's tests, and buckets are
+// created implicitly on first use.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]object
+}
+
+type object struct {
+	b       []byte
+	modTime time.Time
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{objects: make(map[string]object)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.EscapedPath()
+	if strings.HasPrefix(p, "/upload/storage/v1/b/") {
+		s.upload(w, r, strings.TrimPrefix(p, "/upload/storage/v1/b/"))
+		return
+	}
+	if !strings.HasPrefix(p, "/storage/v1/b/") {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/storage/v1/b/"), "/", 3)
+	if len(parts) != 3 || parts[1] != "o" {
+		writeError(w, http.StatusNotImplemented, "unsupported operation")
+		return
+	}
+	bucket, err := url.PathUnescape(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := url.PathUnescape(parts[2])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key := bucket + "/" + name
+
+	s.mu.Lock()
+	o, ok := s.objects[key]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such object: "+key)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("alt") == "media" {
+			http.ServeContent(w, r, "", o.modTime, bytes.NewReader(o.b))
+			return
+		}
+		writeObject(w, bucket, name, o)
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "unsupported operation")
+	}
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, p string) {
+	q := r.URL.Query()
+	if r.Method != http.MethodPost || q.Get("uploadType") != "media" || !strings.HasSuffix(p, "/o") {
+		writeError(w, http.StatusNotImplemented, "only simple media uploads are supported")
+		return
+	}
+	bucket, err := url.PathUnescape(strings.TrimSuffix(p, "/o"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := q.Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "missing name")
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	o := object{b: b, modTime: time.Now()}
+
+	s.mu.Lock()
+	s.objects[bucket+"/"+name] = o
+	s.mu.Unlock()
+
+	writeObject(w, bucket, name, o)
+}
+
+func writeObject(w http.ResponseWriter, bucket, name string, o object) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"kind":    "storage#object",
+		"bucket":  bucket,
+		"name":    name,
+		"size":    strconv.Itoa(len(o.b)),
+		"updated": o.modTime.Format(time.RFC3339Nano),
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
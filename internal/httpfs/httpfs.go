@@ -0,0 +1,153 @@
+// Package httpfs implements the parts of filesystems which are common to
+// object stores spoken to over HTTP.
+package httpfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Do sends req with client, and returns the response if its status is one of
+// want. Not found responses are reported as an *os.PathError wrapping
+// os.ErrNotExist.
+func Do(client *http.Client, req *http.Request, want ...int) (*http.Response, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range want {
+		if res.StatusCode == status {
+			return res, nil
+		}
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(req.Method), Path: req.URL.Path, Err: os.ErrNotExist}
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+	return nil, fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(b)))
+}
+
+// A GetFunc gets an object, from offset to its end if offset is positive. It
+// should accept both 200 (OK) and 206 (Partial Content) responses.
+type GetFunc func(offset int64) (*http.Response, error)
+
+// A Reader reads an object, getting it again from the new offset whenever it
+// reads after seeking elsewhere. Seeks alone make no requests.
+type Reader struct {
+	get  GetFunc
+	body io.ReadCloser
+	// offset is the offset of the next read, and pos is that of body.
+	offset, pos, size int64
+}
+
+// NewReader gets the object with get, and returns a Reader of it.
+func NewReader(get GetFunc) (*Reader, error) {
+	r := &Reader{get: get, size: -1}
+	if err := r.reset(); err != nil {
+		return nil, fmt.Errorf("reset: %w", err)
+	}
+	return r, nil
+}
+
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.body == nil || r.pos != r.offset {
+		if err := r.reset(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("invalid offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// reset gets the object again, from r.offset.
+func (r *Reader) reset() error {
+	if r.body != nil {
+		r.Close()
+		r.body = nil
+	}
+	r.pos = r.offset
+
+	// Stores reject ranges which start at or beyond the end of the object.
+	if r.size >= 0 && r.offset >= r.size {
+		r.body = ioutil.NopCloser(strings.NewReader(""))
+		return nil
+	}
+
+	res, err := r.get(r.offset)
+	if err != nil {
+		return err
+	}
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+		if r.size < 0 {
+			if r.size = contentRangeSize(res.Header.Get("Content-Range")); r.size < 0 && res.ContentLength >= 0 {
+				r.size = r.offset + res.ContentLength
+			}
+		}
+	case r.offset > 0:
+		// The range was ignored, so the body starts at the beginning of
+		// the object.
+		if _, err := io.CopyN(ioutil.Discard, res.Body, r.offset); err != nil {
+			res.Body.Close()
+			return fmt.Errorf("discard to offset %d: %w", r.offset, err)
+		}
+		fallthrough
+	default:
+		if r.size < 0 {
+			r.size = res.ContentLength
+		}
+	}
+	if r.size < 0 {
+		res.Body.Close()
+		return errors.New("unknown content length")
+	}
+	r.body = res.Body
+	return nil
+}
+
+// contentRangeSize returns the complete length from a Content-Range header, of
+// the form "bytes first-last/length", or -1 if it's unknown.
+func contentRangeSize(v string) int64 {
+	i := strings.LastIndex(v, "/")
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(v[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,130 @@
+package httpfs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/internal/httpfs"
+)
+
+func TestReader(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	for name, h := range map[string]http.HandlerFunc{
+		"ranged": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		},
+		// Some servers ignore ranges, and respond with the whole object.
+		"unranged": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			io.WriteString(w, content)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			r, err := httpfs.NewReader(func(offset int64) (*http.Response, error) {
+				req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+				if err != nil {
+					return nil, err
+				}
+				if offset > 0 {
+					req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+				}
+				return httpfs.Do(srv.Client(), req, http.StatusOK, http.StatusPartialContent)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			for _, tt := range []struct {
+				offset int64
+				whence int
+				want   int64
+			}{
+				{offset: 123, whence: io.SeekStart, want: 123},
+				{offset: 10, whence: io.SeekCurrent, want: 138},
+				{offset: -10, whence: io.SeekEnd, want: 990},
+			} {
+				n, err := r.Seek(tt.offset, tt.whence)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != tt.want {
+					t.Fatalf("seek(%d, %d); got offset %d, want %d", tt.offset, tt.whence, n, tt.want)
+				}
+				got := make([]byte, 5)
+				if _, err := io.ReadFull(r, got); err != nil {
+					t.Fatal(err)
+				}
+				if want := content[tt.want : tt.want+5]; !bytes.Equal(got, []byte(want)) {
+					t.Fatalf("read after seek(%d, %d); got %q, want %q", tt.offset, tt.whence, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDoNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := httpfs.Do(srv.Client(), req, http.StatusOK); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestReaderSeekWithoutReading(t *testing.T) {
+	var gets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("some content"))
+	}))
+	defer srv.Close()
+
+	r, err := httpfs.NewReader(func(offset int64) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return httpfs.Do(srv.Client(), req, http.StatusOK, http.StatusPartialContent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Finding the size, and seeking back, needn't get the object again.
+	if n, err := r.Seek(0, io.SeekEnd); err != nil || n != 12 {
+		t.Fatalf("seek to end; got (%d, %v), want (12, nil)", n, err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "some content" {
+		t.Fatalf("unexpected content; got %q, want %q", b, "some content")
+	}
+	if gets != 1 {
+		t.Fatalf("unexpected number of requests; got %d, want 1", gets)
+	}
+}
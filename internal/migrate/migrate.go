@@ -0,0 +1,216 @@
+// Package migrate copies entries and their files between backends.
+package migrate
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/zeebo/blake3"
+)
+
+// A Failure is an entry which couldn't be copied.
+type Failure struct {
+	Entry database.Entry
+	Err   error
+}
+
+// A Result is the result of a migration.
+type Result struct {
+	// Copied is the number of entries copied, or which would be copied
+	// by a dry run, and Bytes is the total size of their files.
+	Copied int
+	Bytes  int64
+	// Skipped is the number of entries which had already been copied.
+	Skipped int
+	// Conflicts are entries whose slug is used by a different file at
+	// the destination. They're never overwritten.
+	Conflicts []database.Entry
+	Failed    []Failure
+}
+
+// A Migrator copies every entry, and its file, from one database and
+// filesystem to another. Entries which already exist at the destination with
+// the same sum are skipped, so an interrupted migration can be resumed by
+// running it again.
+type Migrator struct {
+	FromDatabase   database.Database
+	FromFileSystem filesystem.FileSystem
+	ToDatabase     database.Database
+	ToFileSystem   filesystem.FileSystem
+	// Concurrency is the number of entries copied at once. It defaults to
+	// one.
+	Concurrency int
+	// DryRun, if true, reports what would be copied without copying
+	// anything.
+	DryRun bool
+}
+
+// Migrate copies every entry. Files are verified against the sum and size of
+// their entry as they're copied, and are copied before their entry, so an
+// entry is never copied without its file.
+func (m *Migrator) Migrate(ctx context.Context) (Result, error) {
+	n := m.Concurrency
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		res Result
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+	)
+	entries := make(chan database.Entry)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				copied, err := m.migrate(ctx, e)
+
+				mu.Lock()
+				switch {
+				case errors.Is(err, errConflict):
+					res.Conflicts = append(res.Conflicts, e)
+				case err != nil:
+					res.Failed = append(res.Failed, Failure{Entry: e, Err: err})
+				case copied:
+					res.Copied++
+					res.Bytes += e.Size
+				default:
+					res.Skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := m.FromDatabase.Walk(ctx, func(e database.Entry) error {
+		select {
+		case entries <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(entries)
+	wg.Wait()
+	if err != nil {
+		return res, fmt.Errorf("walk database: %w", err)
+	}
+	return res, nil
+}
+
+var errConflict = errors.New("slug is used by a different file")
+
+// migrate copies e, and reports whether it was copied. Links have no file, so
+// only their entry is copied.
+func (m *Migrator) migrate(ctx context.Context, e database.Entry) (bool, error) {
+	switch existing, err := m.ToDatabase.Lookup(ctx, e.Slug); {
+	case err == nil && existing.Sum == e.Sum && existing.URL == e.URL:
+		return false, nil
+	case err == nil:
+		return false, errConflict
+	case !errors.Is(err, database.ErrNoResults):
+		return false, fmt.Errorf("lookup: %w", err)
+	}
+	if m.DryRun {
+		return true, nil
+	}
+	if e.URL != "" {
+		if err := m.ToDatabase.Create(ctx, e); err != nil {
+			return false, fmt.Errorf("create entry: %w", err)
+		}
+		return true, nil
+	}
+
+	// A previous migration may have copied the file, but failed to create
+	// its entry, so it's only copied again if it doesn't match.
+	copied := !m.copied(ctx, e)
+	if copied {
+		f, err := m.FromFileSystem.Open(ctx, e.FileName())
+		if err != nil {
+			return false, fmt.Errorf("open: %w", err)
+		}
+		defer f.Close()
+		fctx := ctx
+		if e.Lifetime != nil {
+			fctx = filesystem.WithExpires(ctx, *e.Lifetime)
+		}
+		if err := m.ToFileSystem.Create(fctx, e.FileName(), Verify(f, e)); err != nil {
+			return false, fmt.Errorf("create: %w", err)
+		}
+	}
+	if err := m.ToDatabase.Create(ctx, e); err != nil {
+		// Should the entry have been created since, the file is its.
+		if copied && !errors.Is(err, database.ErrExists) {
+			m.ToFileSystem.Remove(ctx, e.FileName())
+		}
+		return false, fmt.Errorf("create entry: %w", err)
+	}
+	return true, nil
+}
+
+// copied reports whether the destination filesystem already has the file of
+// e, matching its sum and size.
+func (m *Migrator) copied(ctx context.Context, e database.Entry) bool {
+	f, err := m.ToFileSystem.Open(ctx, e.FileName())
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = io.Copy(ioutil.Discard, Verify(f, e))
+	return err == nil
+}
+
+// Verify returns a reader which reads from r, and fails at io.EOF if what was
+// read doesn't match the sum and size of e. Filesystems discard objects whose
+// reader fails, so corrupt files are never copied.
+func Verify(r io.Reader, e database.Entry) io.Reader {
+	return &verifyReader{r: r, h: blake3.New(), sum: e.Sum, size: e.Size}
+}
+
+type verifyReader struct {
+	r    io.Reader
+	h    hash.Hash
+	sum  string
+	size int64
+	n    int64
+}
+
+func (r *verifyReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	if err != io.EOF {
+		return n, err
+	}
+	if r.n != r.size {
+		return n, fmt.Errorf("size mismatch: got %d, want %d", r.n, r.size)
+	}
+	if sum := base64.RawURLEncoding.EncodeToString(r.h.Sum(nil)); sum != r.sum {
+		return n, fmt.Errorf("sum mismatch: got %s, want %s", sum, r.sum)
+	}
+	return n, io.EOF
+}
+
+// Log writes a summary of r, followed by each problem, to logf.
+func (r Result) Log(logf func(format string, v ...interface{})) {
+	logf(
+		"migrate: %d copied (%d bytes), %d already copied, %d conflicting, %d failed",
+		r.Copied, r.Bytes, r.Skipped, len(r.Conflicts), len(r.Failed),
+	)
+	for _, e := range r.Conflicts {
+		logf("migrate: conflicting %s: slug is used by a different file", e.Slug)
+	}
+	for _, f := range r.Failed {
+		logf("migrate: failed %s: %v", f.Entry.Slug, f.Err)
+	}
+}
@@ -0,0 +1,181 @@
+package migrate_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/memory"
+	"github.com/uhthomas/kipp/filesystem"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/internal/migrate"
+	"github.com/zeebo/blake3"
+)
+
+func entry(slug, content string) database.Entry {
+	h := blake3.New()
+	h.Write([]byte(content))
+	return database.Entry{
+		Slug:      slug,
+		Name:      slug + ".txt",
+		Sum:       base64.RawURLEncoding.EncodeToString(h.Sum(nil)),
+		Size:      int64(len(content)),
+		Timestamp: time.Now(),
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	m := &migrate.Migrator{
+		FromDatabase:   memory.New(0),
+		FromFileSystem: memoryfs.New(0),
+		ToDatabase:     memory.New(0),
+		ToFileSystem:   memoryfs.New(0),
+		Concurrency:    4,
+		DryRun:         true,
+	}
+	for _, v := range []struct{ slug, content, stored string }{
+		{"a", "hello", "hello"},
+		{"b", "world", "world"},
+		{"corrupt", "hello", "hellp"},
+		{"conflict", "hello", "hello"},
+	} {
+		if err := m.FromDatabase.Create(ctx, entry(v.slug, v.content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.FromFileSystem.Create(ctx, v.slug, strings.NewReader(v.stored)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.ToDatabase.Create(ctx, entry("conflict", "other")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := m.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 3 || res.Bytes != 15 || len(res.Conflicts) != 1 || len(res.Failed) != 0 {
+		t.Fatalf("unexpected dry run result: %+v", res)
+	}
+	if _, err := m.ToDatabase.Lookup(ctx, "a"); err != database.ErrNoResults {
+		t.Fatalf("dry run copied an entry: %v", err)
+	}
+
+	m.DryRun = false
+	if res, err = m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 2 || len(res.Conflicts) != 1 || len(res.Failed) != 1 || res.Failed[0].Entry.Slug != "corrupt" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	for slug, want := range map[string]string{"a": "hello", "b": "world"} {
+		if _, err := m.ToDatabase.Lookup(ctx, slug); err != nil {
+			t.Fatal(err)
+		}
+		f, err := m.ToFileSystem.Open(ctx, slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("unexpected content for %s; got %q, want %q", slug, b, want)
+		}
+	}
+	// Corrupt files are neither copied, nor have their entries copied.
+	if _, err := m.ToDatabase.Lookup(ctx, "corrupt"); err != database.ErrNoResults {
+		t.Fatalf("corrupt entry was copied: %v", err)
+	}
+	if _, err := m.ToFileSystem.Open(ctx, "corrupt"); err == nil {
+		t.Fatal("corrupt file was copied")
+	}
+
+	// Running again resumes, skipping what has been copied.
+	if res, err = m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 0 || res.Skipped != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+// failingDatabase fails to create entries while fail is set.
+type failingDatabase struct {
+	database.Database
+	fail bool
+}
+
+func (db *failingDatabase) Create(ctx context.Context, e database.Entry) error {
+	if db.fail {
+		return errors.New("create failed")
+	}
+	return db.Database.Create(ctx, e)
+}
+
+// exclusiveFileSystem refuses to overwrite objects, as some backends do.
+type exclusiveFileSystem struct{ filesystem.FileSystem }
+
+func (fs exclusiveFileSystem) Create(ctx context.Context, name string, r io.Reader) error {
+	if f, err := fs.Open(ctx, name); err == nil {
+		f.Close()
+		return fmt.Errorf("%s exists", name)
+	}
+	return fs.FileSystem.Create(ctx, name, r)
+}
+
+func TestMigrateEntryFailure(t *testing.T) {
+	ctx := context.Background()
+	to := &failingDatabase{Database: memory.New(0), fail: true}
+	m := &migrate.Migrator{
+		FromDatabase:   memory.New(0),
+		FromFileSystem: memoryfs.New(0),
+		ToDatabase:     to,
+		ToFileSystem:   exclusiveFileSystem{memoryfs.New(0)},
+		Concurrency:    1,
+	}
+	for slug, content := range map[string]string{"a": "hello", "b": "world"} {
+		if err := m.FromDatabase.Create(ctx, entry(slug, content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.FromFileSystem.Create(ctx, slug, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b was copied by an earlier migration, which failed to create its
+	// entry.
+	if err := m.ToFileSystem.Create(ctx, "b", strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := m.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 0 || len(res.Failed) != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	// The file copied for a is removed, as its entry wasn't created.
+	if _, err := m.ToFileSystem.Open(ctx, "a"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error; got %v, want %v", err, os.ErrNotExist)
+	}
+
+	to.fail = false
+	if res, err = m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 2 || len(res.Failed) != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
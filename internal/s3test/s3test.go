@@ -0,0 +1,404 @@
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// A Server is a minimal, in-process stand-in for S3. It implements just enough
+// of the API for kipp's tests, and buckets are created implicitly on first use.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]object
+	uploads map[string]*upload
+	next    int
+	log     []string
+}
+
+type object struct {
+	b       []byte
+	modTime time.Time
+	header  http.Header
+}
+
+type upload struct {
+	parts  map[int][]byte
+	header http.Header
+}
+
+// storedHeaders are the request headers kept with objects, which describe
+// how they're stored.
+var storedHeaders = []string{
+	"Expires",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Customer-Algorithm",
+	"X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+	"X-Amz-Storage-Class",
+	"X-Amz-Tagging",
+}
+
+func storedHeader(h http.Header) http.Header {
+	stored := make(http.Header)
+	for _, k := range storedHeaders {
+		if v := h.Get(k); v != "" {
+			stored.Set(k, v)
+		}
+	}
+	return stored
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		objects: make(map[string]object),
+		uploads: make(map[string]*upload),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// NewTLSServer starts and returns a new Server using TLS, which is needed for
+// server-side encryption with customer keys. The caller should call Close
+// when finished, to shut it down.
+func NewTLSServer() *Server {
+	s := &Server{
+		objects: make(map[string]object),
+		uploads: make(map[string]*upload),
+	}
+	s.Server = httptest.NewTLSServer(s)
+	return s
+}
+
+// Config returns an aws.Config which directs requests to s.
+func (s *Server) Config() *aws.Config {
+	return &aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(s.URL),
+		Region:           aws.String("us-east-1"),
+		DisableSSL:       aws.Bool(s.TLS == nil),
+		HTTPClient:       s.Client(),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+}
+
+// Header returns the headers describing how the object with the given key,
+// which includes the bucket, is stored, or nil if it doesn't exist.
+func (s *Server) Header(key string) http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil
+	}
+	return o.header.Clone()
+}
+
+// Requests returns the requests served so far, in order, each formatted as
+// the method and path, followed by the range if one was requested.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// ServeHTTP implements http.Handler. Requests must use path style addressing.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := r.Method + " " + r.URL.Path
+	if v := r.Header.Get("Range"); v != "" {
+		req += " " + v
+	}
+	s.mu.Lock()
+	s.log = append(s.log, req)
+	s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		s.listObjects(w, r, strings.TrimSuffix(key, "/"))
+		return
+	}
+	if i := strings.Index(key, "/"); i < 0 || i == len(key)-1 {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "bucket operations are not supported")
+		return
+	}
+
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		s.createMultipartUpload(w, r, key)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		s.uploadPart(w, r, q.Get("uploadId"), q.Get("partNumber"))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		s.completeMultipartUpload(w, r, key, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		s.mu.Lock()
+		delete(s.uploads, q.Get("uploadId"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, key)
+	case r.Method == http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		s.put(w, key, b, storedHeader(r.Header))
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.mu.Lock()
+		o, ok := s.objects[key]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if !customerKeyMatches(o, r.Header, "X-Amz-Server-Side-Encryption-Customer-Key-Md5") {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "The customer key is missing or wrong.")
+			return
+		}
+		w.Header().Set("ETag", etag(o.b))
+		// Presigned requests may override response headers.
+		for k, v := range map[string]string{
+			"response-content-type":        "Content-Type",
+			"response-content-disposition": "Content-Disposition",
+		} {
+			if q.Get(k) != "" {
+				w.Header().Set(v, q.Get(k))
+			}
+		}
+		http.ServeContent(w, r, "", o.modTime, bytes.NewReader(o.b))
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported operation")
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, key string, b []byte, header http.Header) {
+	s.mu.Lock()
+	s.objects[key] = object{b: b, modTime: time.Now(), header: header}
+	s.mu.Unlock()
+	w.Header().Set("ETag", etag(b))
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	s.next++
+	id := strconv.Itoa(s.next)
+	s.uploads[id] = &upload{parts: make(map[int][]byte), header: storedHeader(r.Header)}
+	s.mu.Unlock()
+
+	i := strings.Index(key, "/")
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{Bucket: key[:i], Key: key[i+1:], UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id, part string) {
+	n, err := strconv.Atoi(part)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	u.parts[n] = b
+	w.Header().Set("ETag", etag(b))
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key, id string) {
+	s.mu.Lock()
+	u, ok := s.uploads[id]
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	ns := make([]int, 0, len(u.parts))
+	for n := range u.parts {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+
+	var buf bytes.Buffer
+	for _, n := range ns {
+		buf.Write(u.parts[n])
+	}
+	s.put(w, key, buf.Bytes(), u.header)
+
+	i := strings.Index(key, "/")
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: key[:i], Key: key[i+1:], ETag: etag(buf.Bytes())})
+}
+
+// copyObject implements CopyObject, within or between buckets. The copy keeps
+// the tags and other headers of the source, unless their directives are
+// REPLACE.
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	s.mu.Lock()
+	o, ok := s.objects[strings.TrimPrefix(src, "/")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if !customerKeyMatches(o, r.Header, "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-Md5") {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "The customer key is missing or wrong.")
+		return
+	}
+
+	header, replace := o.header.Clone(), storedHeader(r.Header)
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		tagging := header.Get("X-Amz-Tagging")
+		header = replace.Clone()
+		header.Del("X-Amz-Tagging")
+		if tagging != "" {
+			header.Set("X-Amz-Tagging", tagging)
+		}
+	}
+	if r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+		header.Del("X-Amz-Tagging")
+		if v := replace.Get("X-Amz-Tagging"); v != "" {
+			header.Set("X-Amz-Tagging", v)
+		}
+	}
+	s.mu.Lock()
+	s.objects[key] = object{b: o.b, modTime: time.Now(), header: header}
+	s.mu.Unlock()
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: etag(o.b), LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+// listObjects implements ListObjectsV2. Continuation tokens are the last key
+// of the previous page.
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	max := 1000
+	if v := q.Get("max-keys"); v != "" {
+		var err error
+		if max, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+	}
+	prefix := bucket + "/" + q.Get("prefix")
+	after := bucket + "/" + q.Get("continuation-token")
+
+	type contents struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []contents
+	}{Name: bucket, Prefix: q.Get("prefix"), MaxKeys: max}
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && (q.Get("continuation-token") == "" || k > after) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(res.Contents) == max {
+			res.IsTruncated = true
+			res.NextContinuationToken = res.Contents[len(res.Contents)-1].Key
+			break
+		}
+		o := s.objects[k]
+		res.Contents = append(res.Contents, contents{
+			Key:          k[len(bucket)+1:],
+			LastModified: o.modTime.UTC().Format(time.RFC3339Nano),
+			ETag:         etag(o.b),
+			Size:         len(o.b),
+		})
+	}
+	s.mu.Unlock()
+
+	res.KeyCount = len(res.Contents)
+	writeXML(w, res)
+}
+
+// customerKeyMatches reports whether requests for o include the customer key
+// it was encrypted with, if any, by comparing the MD5 of the key in the named
+// header.
+func customerKeyMatches(o object, h http.Header, name string) bool {
+	return o.header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") == h.Get(name)
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return strconv.Quote(hex.EncodeToString(sum[:]))
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message)
+}
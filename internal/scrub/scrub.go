@@ -0,0 +1,225 @@
+// Package scrub verifies stored files against the sums and sizes recorded in
+// the database.
+package scrub
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/zeebo/blake3"
+)
+
+// QuarantineSuffix is appended to the names of corrupt files when they're
+// quarantined. Slugs never contain a ".", so quarantined files can't be
+// served.
+const QuarantineSuffix = ".quarantine"
+
+// A Corruption is an entry whose file doesn't match its sum or size.
+type Corruption struct {
+	Entry database.Entry
+	Sum   string
+	Size  int64
+}
+
+// A Failure is an entry whose file couldn't be read.
+type Failure struct {
+	Entry database.Entry
+	Err   error
+}
+
+// A Result is the result of a scrub.
+type Result struct {
+	// Verified is the number of entries whose files matched.
+	Verified int
+	// Expired is the number of expired entries, which were skipped.
+	Expired int
+	// Links is the number of links, which have no file to verify.
+	Links   int
+	Corrupt []Corruption
+	// Quarantined is the number of corrupt files which were quarantined.
+	Quarantined int
+	Failed      []Failure
+	// Missing are entries whose file doesn't exist.
+	Missing []database.Entry
+	// Orphans are files with no entry. They're only detected if the
+	// filesystem implements filesystem.Walker.
+	Orphans []filesystem.Object
+}
+
+// A Scrubber verifies every file in a filesystem against its entry in a
+// database.
+type Scrubber struct {
+	Database   database.Database
+	FileSystem filesystem.FileSystem
+	// Quarantine, if true, moves corrupt files to their name with
+	// QuarantineSuffix appended and removes their entries, so they're
+	// no longer served.
+	Quarantine bool
+
+	notWalker sync.Once
+}
+
+// Scrub verifies every unexpired entry, and looks for orphaned files.
+func (s *Scrubber) Scrub(ctx context.Context) (Result, error) {
+	start := time.Now()
+	var res Result
+	slugs := make(map[string]struct{})
+	if err := s.Database.Walk(ctx, func(e database.Entry) error {
+		slugs[e.Slug] = struct{}{}
+		if e.Lifetime != nil && e.Lifetime.Before(start) {
+			res.Expired++
+			return nil
+		}
+		if e.URL != "" {
+			res.Links++
+			return nil
+		}
+		sum, size, err := s.verify(ctx, e.FileName())
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			res.Missing = append(res.Missing, e)
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			res.Failed = append(res.Failed, Failure{Entry: e, Err: err})
+		case sum != e.Sum || size != e.Size:
+			res.Corrupt = append(res.Corrupt, Corruption{Entry: e, Sum: sum, Size: size})
+		default:
+			res.Verified++
+		}
+		return nil
+	}); err != nil {
+		return res, fmt.Errorf("walk database: %w", err)
+	}
+
+	if s.Quarantine {
+		for _, c := range res.Corrupt {
+			switch err := s.quarantine(ctx, c.Entry); {
+			case errors.Is(err, database.ErrConflict):
+				// The entry was replaced or removed since it was
+				// verified, so its file is no longer served.
+			case err != nil:
+				return res, fmt.Errorf("quarantine %s: %w", c.Entry.Slug, err)
+			default:
+				res.Quarantined++
+			}
+		}
+	}
+
+	if err := filesystem.Walk(ctx, s.FileSystem, func(o filesystem.Object) error {
+		// Files are written before their entries, so ignore any
+		// written since the scrub started.
+		if !o.ModTime.Before(start) {
+			return nil
+		}
+		slug := o.Name
+		if i := strings.Index(slug, "."); i > -1 {
+			if strings.HasSuffix(slug, QuarantineSuffix) {
+				return nil
+			}
+			slug = slug[:i]
+		}
+		if _, ok := slugs[slug]; !ok {
+			res.Orphans = append(res.Orphans, o)
+		}
+		return nil
+	}); errors.Is(err, filesystem.ErrNotWalker) {
+		s.notWalker.Do(func() {
+			log.Print("scrub: the filesystem can't list its files, so orphans won't be found")
+		})
+	} else if err != nil {
+		return res, fmt.Errorf("walk filesystem: %w", err)
+	}
+	return res, nil
+}
+
+// verify streams the named file through BLAKE3, and returns its sum and size.
+func (s *Scrubber) verify(ctx context.Context, name string) (sum string, size int64, err error) {
+	f, err := s.FileSystem.Open(ctx, name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := blake3.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return "", 0, err
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// quarantine copies the file of e aside, then removes e and the original file.
+// Should e have been replaced or removed since it was verified, it returns
+// database.ErrConflict, and leaves the entry and file be.
+func (s *Scrubber) quarantine(ctx context.Context, e database.Entry) error {
+	f, err := s.FileSystem.Open(ctx, e.FileName())
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	if err := s.FileSystem.Create(ctx, e.Slug+QuarantineSuffix, f); err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if err := s.Database.Discard(ctx, e.Slug, e.File); errors.Is(err, database.ErrConflict) {
+		s.FileSystem.Remove(ctx, e.Slug+QuarantineSuffix)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("remove entry: %w", err)
+	}
+	if err := s.FileSystem.Remove(ctx, e.FileName()); err != nil {
+		return fmt.Errorf("remove file: %w", err)
+	}
+	return nil
+}
+
+// Loop scrubs every interval until ctx is done, logging the results.
+func (s *Scrubber) Loop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		res, err := s.Scrub(ctx)
+		if err != nil {
+			log.Printf("scrub: %v", err)
+		}
+		res.Log(log.Printf)
+	}
+}
+
+// Log writes a summary of r, followed by each problem, to logf.
+func (r Result) Log(logf func(format string, v ...interface{})) {
+	logf(
+		"scrub: %d verified, %d expired, %d links, %d corrupt (%d quarantined), %d failed, %d missing, %d orphaned",
+		r.Verified, r.Expired, r.Links, len(r.Corrupt), r.Quarantined, len(r.Failed), len(r.Missing), len(r.Orphans),
+	)
+	for _, c := range r.Corrupt {
+		logf("scrub: corrupt %s: got sum %s and size %d, want sum %s and size %d", c.Entry.Slug, c.Sum, c.Size, c.Entry.Sum, c.Entry.Size)
+	}
+	for _, f := range r.Failed {
+		logf("scrub: failed %s: %v", f.Entry.Slug, f.Err)
+	}
+	for _, e := range r.Missing {
+		logf("scrub: missing %s", e.Slug)
+	}
+	for _, o := range r.Orphans {
+		logf("scrub: orphaned %s (%d bytes, modified %s)", o.Name, o.Size, o.ModTime.Format(time.RFC3339))
+	}
+}
+
+// OK reports whether r found no problems.
+func (r Result) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Failed) == 0 && len(r.Missing) == 0 && len(r.Orphans) == 0
+}
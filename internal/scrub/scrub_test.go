@@ -0,0 +1,159 @@
+package scrub_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/memory"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/internal/scrub"
+	"github.com/zeebo/blake3"
+)
+
+func sum(s string) string {
+	h := blake3.New()
+	h.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	db, fs := memory.New(0), memoryfs.New(0)
+
+	expired := time.Now().Add(-time.Hour)
+	for _, v := range []struct {
+		slug, stored, content string
+		lifetime              *time.Time
+	}{
+		{slug: "good", stored: "hello", content: "hello"},
+		{slug: "corrupt", stored: "hellp", content: "hello"},
+		{slug: "truncated", stored: "hel", content: "hello"},
+		{slug: "missing", content: "hello"},
+		{slug: "expired", stored: "hellp", content: "hello", lifetime: &expired},
+		{slug: "orphan", stored: "hello"},
+	} {
+		if v.stored != "" {
+			if err := fs.Create(ctx, v.slug, strings.NewReader(v.stored)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if v.content != "" {
+			if err := db.Create(ctx, database.Entry{
+				Slug:      v.slug,
+				Sum:       sum(v.content),
+				Size:      int64(len(v.content)),
+				Lifetime:  v.lifetime,
+				Timestamp: time.Now(),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Files written during the scrub must not be reported as orphans.
+	time.Sleep(time.Millisecond)
+
+	s := &scrub.Scrubber{Database: db, FileSystem: fs, Quarantine: true}
+	res, err := s.Scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK() {
+		t.Fatal("scrub found no problems")
+	}
+	if res.Verified != 1 || res.Expired != 1 || res.Quarantined != 2 || len(res.Failed) != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	corrupt := map[string]bool{}
+	for _, c := range res.Corrupt {
+		corrupt[c.Entry.Slug] = true
+	}
+	if !corrupt["corrupt"] || !corrupt["truncated"] || len(corrupt) != 2 {
+		t.Fatalf("unexpected corrupt entries: %+v", res.Corrupt)
+	}
+	if len(res.Missing) != 1 || res.Missing[0].Slug != "missing" {
+		t.Fatalf("unexpected missing entries: %+v", res.Missing)
+	}
+	if len(res.Orphans) != 1 || res.Orphans[0].Name != "orphan" {
+		t.Fatalf("unexpected orphans: %+v", res.Orphans)
+	}
+
+	// Quarantined files are moved aside, and their entries removed.
+	if _, err := db.Lookup(ctx, "corrupt"); err != database.ErrNoResults {
+		t.Fatalf("unexpected error; got %v, want %v", err, database.ErrNoResults)
+	}
+	if _, err := fs.Open(ctx, "corrupt"); err == nil {
+		t.Fatal("corrupt file was not removed")
+	}
+	f, err := fs.Open(ctx, "corrupt"+scrub.QuarantineSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A second scrub ignores the quarantined files.
+	if res, err = s.Scrub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Corrupt) != 0 || len(res.Orphans) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+// replacingDatabase replaces the entry with the given entry before the first
+// discard, as if it was replaced while being scrubbed.
+type replacingDatabase struct {
+	database.Database
+	e database.Entry
+}
+
+func (db *replacingDatabase) Discard(ctx context.Context, slug, file string) error {
+	if db.e.Slug != "" {
+		if err := db.Swap(ctx, db.e, file); err != nil {
+			return err
+		}
+		db.e = database.Entry{}
+	}
+	return db.Database.Discard(ctx, slug, file)
+}
+
+func TestScrubQuarantineReplaced(t *testing.T) {
+	ctx := context.Background()
+	fs := memoryfs.New(0)
+	db := &replacingDatabase{Database: memory.New(0)}
+	if err := fs.Create(ctx, "slug", strings.NewReader("hellp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(ctx, database.Entry{Slug: "slug", Sum: sum("hello"), Size: 5, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Create(ctx, "slug.file-new", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	db.e = database.Entry{Slug: "slug", Sum: sum("other"), Size: 5, Timestamp: time.Now(), File: "slug.file-new"}
+
+	s := &scrub.Scrubber{Database: db, FileSystem: fs, Quarantine: true}
+	res, err := s.Scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Corrupt) != 1 || res.Quarantined != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	// The replacement is kept.
+	e, err := db.Lookup(ctx, "slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.File != "slug.file-new" {
+		t.Fatalf("unexpected file; got %q, want %q", e.File, "slug.file-new")
+	}
+	f, err := fs.Open(ctx, "slug.file-new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
@@ -0,0 +1,144 @@
+// Package thumbnail generates thumbnails of images, and names the files they're
+// cached in.
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register GIF, so thumbnails can be generated from it
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register WebP, as above
+)
+
+const (
+	// MaxDimension is the largest width or height of images which
+	// thumbnails are generated from.
+	MaxDimension = 16384
+	// MaxPixels is the largest number of pixels of images which thumbnails
+	// are generated from. Decoded images take four bytes per pixel, so
+	// this bounds the memory used by decompression bombs, which are small
+	// files of huge images.
+	MaxPixels = 25 << 20
+)
+
+// Widths are the widths of thumbnails. Only these are generated, so few files
+// are cached for each entry.
+var Widths = []int{80, 160, 320, 640, 1280}
+
+var (
+	// ErrUnsupported is returned when a file isn't an image, or is in a
+	// format which isn't supported.
+	ErrUnsupported = errors.New("unsupported image format")
+	// ErrTooLarge is returned for images whose dimensions are larger than
+	// MaxDimension or MaxPixels.
+	ErrTooLarge = errors.New("image is too large")
+)
+
+// generating limits how many thumbnails are generated at once, and so how much
+// memory they use.
+var generating = make(chan struct{}, 4)
+
+// Width returns the width of the thumbnail to use for images shown at most w
+// pixels wide, which is the smallest which is at least as wide, or the widest.
+func Width(w int) int {
+	for _, width := range Widths {
+		if width >= w {
+			return width
+		}
+	}
+	return Widths[len(Widths)-1]
+}
+
+// Name returns the name of the file the thumbnail of e, of the given width, is
+// cached in. Names contain the sum of e, so thumbnails of files which are
+// replaced are never served.
+func Name(e database.Entry, width int) string {
+	sum := e.Sum
+	if len(sum) > 16 {
+		sum = sum[:16]
+	}
+	return e.Slug + ".thumb-" + strconv.Itoa(width) + "-" + sum
+}
+
+// Remove removes every thumbnail of e which was cached in fs.
+func Remove(ctx context.Context, fs filesystem.FileSystem, e database.Entry) error {
+	if e.URL != "" {
+		return nil
+	}
+	for _, width := range Widths {
+		name := Name(e, width)
+		if err := fs.Remove(ctx, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the thumbnail, width pixels wide, of an image of w
+// by h pixels. Images are never enlarged, so it's no larger than the image.
+func Size(w, h, width int) (int, int) {
+	if width > w {
+		width = w
+	}
+	height := (h*width + w/2) / w
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// Generate writes a thumbnail of the image read from r to w, which is width
+// pixels wide, or as wide as the image if it's narrower, and returns its
+// content type. Thumbnails of images which may be transparent are PNGs, and
+// the rest are JPEGs.
+func Generate(ctx context.Context, w io.Writer, r io.ReadSeeker, width int) (string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return "", ErrUnsupported
+	}
+	if err != nil {
+		return "", fmt.Errorf("decode config: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return "", ErrUnsupported
+	}
+	if cfg.Width > MaxDimension || cfg.Height > MaxDimension || cfg.Width*cfg.Height > MaxPixels {
+		return "", ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("seek: %w", err)
+	}
+
+	select {
+	case generating <- struct{}{}:
+		defer func() { <-generating }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return "", fmt.Errorf("decode: %w", err)
+	}
+	b := src.Bounds()
+	width, height := Size(b.Dx(), b.Dy(), width)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	switch format {
+	case "png", "gif", "webp":
+		return "image/png", png.Encode(w, dst)
+	default:
+		return "image/jpeg", jpeg.Encode(w, dst, &jpeg.Options{Quality: 85})
+	}
+}
@@ -0,0 +1,121 @@
+package thumbnail_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/database"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/internal/thumbnail"
+)
+
+func TestWidth(t *testing.T) {
+	for _, tt := range []struct{ w, want int }{
+		{w: 1, want: 80},
+		{w: 80, want: 80},
+		{w: 300, want: 320},
+		{w: 320, want: 320},
+		{w: 100000, want: 1280},
+	} {
+		if got := thumbnail.Width(tt.w); got != tt.want {
+			t.Fatalf("unexpected width for %d; got %d, want %d", tt.w, got, tt.want)
+		}
+	}
+}
+
+func encode(t *testing.T, w, h int, enc func(*bytes.Buffer, image.Image) error) *bytes.Reader {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := enc(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestGenerate(t *testing.T) {
+	ctx := context.Background()
+	pngEnc := func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) }
+	jpegEnc := func(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) }
+	for _, tt := range []struct {
+		name         string
+		r            *bytes.Reader
+		width        int
+		ctype        string
+		wantW, wantH int
+	}{
+		{name: "png", r: encode(t, 1000, 500, pngEnc), width: 320, ctype: "image/png", wantW: 320, wantH: 160},
+		{name: "jpeg", r: encode(t, 300, 900, jpegEnc), width: 80, ctype: "image/jpeg", wantW: 80, wantH: 240},
+		// Images aren't enlarged.
+		{name: "small", r: encode(t, 50, 20, pngEnc), width: 320, ctype: "image/png", wantW: 50, wantH: 20},
+		{name: "thin", r: encode(t, 1000, 1, pngEnc), width: 80, ctype: "image/png", wantW: 80, wantH: 1},
+	} {
+		var buf bytes.Buffer
+		ctype, err := thumbnail.Generate(ctx, &buf, tt.r, tt.width)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ctype != tt.ctype {
+			t.Fatalf("%s: unexpected content type; got %q, want %q", tt.name, ctype, tt.ctype)
+		}
+		cfg, _, err := image.DecodeConfig(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+			t.Fatalf("%s: unexpected size; got %dx%d, want %dx%d", tt.name, cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name    string
+		content string
+		err     error
+	}{
+		{name: "text", content: "hello, world", err: thumbnail.ErrUnsupported},
+		// A GIF of 65535x65535 pixels, which would take 16 GiB to decode.
+		{name: "bomb", content: "GIF89a\xff\xff\xff\xff\x00\x00\x00;", err: thumbnail.ErrTooLarge},
+	} {
+		var buf bytes.Buffer
+		if _, err := thumbnail.Generate(ctx, &buf, strings.NewReader(tt.content), 320); err != tt.err {
+			t.Fatalf("%s: unexpected error; got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	ctx := context.Background()
+	fs := memoryfs.New(0)
+	e := database.Entry{Slug: "slug", Sum: "abcdefghijklmnopqrstuvwxyz"}
+	for _, name := range []string{"slug", thumbnail.Name(e, 80), thumbnail.Name(e, 1280)} {
+		if err := fs.Create(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := thumbnail.Name(e, 80), "slug.thumb-80-abcdefghijklmnop"; got != want {
+		t.Fatalf("unexpected name; got %q, want %q", got, want)
+	}
+	if err := thumbnail.Remove(ctx, fs, e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(ctx, thumbnail.Name(e, 80)); err == nil {
+		t.Fatal("thumbnail was not removed")
+	}
+	f, err := fs.Open(ctx, "slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
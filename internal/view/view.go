@@ -0,0 +1,32 @@
+// Package view names the files the highlighted views of pastes are cached in.
+package view
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// Name returns the name of the file the view of e is cached in. Names contain
+// the sum of e, so views of files which are replaced are never served.
+func Name(e database.Entry) string {
+	sum := e.Sum
+	if len(sum) > 16 {
+		sum = sum[:16]
+	}
+	return e.Slug + ".view-" + sum
+}
+
+// Remove removes the view of e, if it was cached in fs.
+func Remove(ctx context.Context, fs filesystem.FileSystem, e database.Entry) error {
+	if e.URL != "" {
+		return nil
+	}
+	if err := fs.Remove(ctx, Name(e)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package kipp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/uhthomas/kipp/database"
+)
+
+// maxURLLength is the length of the longest URL which can be linked to.
+const maxURLLength = 2048
+
+// checkLink returns an error if link can't be linked to. Only absolute http
+// and https URLs can, so links can't run scripts.
+func checkLink(link string) error {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid url: must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// createLink creates an entry which links to link. If slug is empty, one is
+// generated. Otherwise, an existing entry with the slug may be replaced, as
+// with createVanity.
+func (s Server) createLink(ctx context.Context, link, slug, uploader string, replace bool) (database.Entry, error) {
+	e := s.newEntry(slug, "", nil, 0)
+	e.URL, e.Uploader = link, uploader
+	if slug == "" {
+		return s.create(ctx, e)
+	}
+
+	switch err := s.Database.Create(ctx, e); {
+	case err == nil:
+		return e, nil
+	case !errors.Is(err, database.ErrExists):
+		return database.Entry{}, fmt.Errorf("create entity: %w", err)
+	}
+
+	existing, err := s.Database.Lookup(ctx, slug)
+	if err != nil {
+		return database.Entry{}, fmt.Errorf("lookup: %w", err)
+	}
+	if !replaceable(existing, uploader, replace) {
+		return database.Entry{}, errSlugTaken
+	}
+	if err := s.Database.Swap(ctx, e, existing.File); errors.Is(err, database.ErrConflict) {
+		return database.Entry{}, errSlugChanged
+	} else if err != nil {
+		return database.Entry{}, fmt.Errorf("swap entity: %w", err)
+	}
+	if err := s.removeReplaced(ctx, existing, e); err != nil {
+		return database.Entry{}, err
+	}
+	return e, nil
+}
+
+// linkPreview is the page shown instead of redirecting to the target of a
+// link.
+var linkPreview = template.Must(template.New("link").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>kipp - link</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+p.url { word-break: break-all; font-family: monospace; background: #f4f4f4; padding: 1em; }
+</style>
+</head>
+<body>
+<h1>This link goes to</h1>
+<p class="url">{{.URL}}</p>
+<p><a href="{{.URL}}" rel="noopener noreferrer">Continue</a></p>
+</body>
+</html>
+`))
+
+// serveLink redirects to the target of e, or shows it on a page, if the
+// server always previews links, or the request has a preview parameter.
+func (s Server) serveLink(w http.ResponseWriter, r *http.Request, e database.Entry) {
+	setCacheHeaders(w.Header(), e)
+	if _, preview := r.URL.Query()["preview"]; !preview && !s.LinkPreview {
+		http.Redirect(w, r, e.URL, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	linkPreview.Execute(w, e)
+}
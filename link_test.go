@@ -0,0 +1,172 @@
+package kipp
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFormRequest returns a request to upload a form with the given fields,
+// and no file, authorised by token if it's not empty.
+func newFormRequest(t *testing.T, token string, fields ...string) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i := 0; i < len(fields); i += 2 {
+		if err := mw.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestServerLink(t *testing.T) {
+	s := newTestServer()
+	const target = "https://example.com/dashboards/some-dashboard?from=now-6h&to=now"
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newFormRequest(t, "", "url", target))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	if !regexp.MustCompile(`^/[A-Za-z0-9_-]+$`).MatchString(loc) {
+		t.Fatalf("unexpected location; got %q", loc)
+	}
+
+	for _, path := range []string{loc, loc + ".txt"} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("%s: unexpected status; got %d, want %d", path, w.Code, http.StatusFound)
+		}
+		if got := w.Header().Get("Location"); got != target {
+			t.Fatalf("%s: unexpected location; got %q, want %q", path, got, target)
+		}
+		if got := w.Header().Get("Expires"); got == "" {
+			t.Fatalf("%s: missing expires header", path)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc+"?preview", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected preview status; got %d, want %d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Fatalf("unexpected content type; got %q, want %q", got, want)
+	}
+	if got, want := w.Body.String(), `href="https://example.com/dashboards/some-dashboard?from=now-6h&amp;to=now"`; !strings.Contains(got, want) {
+		t.Fatalf("preview doesn't link to the target; got %q, want it to contain %q", got, want)
+	}
+
+	// Expired links don't exist.
+	e, err := s.Database.Lookup(context.Background(), strings.TrimPrefix(loc, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.URL != target || e.Name != "" || e.Size != 0 {
+		t.Fatalf("unexpected entry; got %+v", e)
+	}
+	expired := time.Now().Add(-time.Minute)
+	e.Lifetime = &expired
+	if err := s.Database.Update(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status for an expired link; got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServerLinkInvalid(t *testing.T) {
+	s := newTestServer()
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+	}{
+		{name: "javascript", r: newFormRequest(t, "", "url", "javascript:alert(1)")},
+		{name: "relative", r: newFormRequest(t, "", "url", "/some/path")},
+		{name: "too long", r: newFormRequest(t, "", "url", "https://example.com/"+strings.Repeat("a", maxURLLength))},
+		{name: "and file", r: newVanityRequest(t, "", "hello.txt", "hello", "url", "https://example.com")},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, tt.r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: unexpected status; got %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestServerLinkPreview(t *testing.T) {
+	s := newTestServer()
+	s.LinkPreview = true
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newFormRequest(t, "", "url", "https://example.com"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+
+	w2 := httptest.NewRecorder()
+	s.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, w.Header().Get("Location"), nil))
+	if w2.Code != http.StatusOK {
+		t.Fatalf("unexpected status; got %d, want %d", w2.Code, http.StatusOK)
+	}
+	if got := w2.Header().Get("Content-Security-Policy"); !strings.HasPrefix(got, "default-src 'none'") {
+		t.Fatalf("unexpected content security policy; got %q", got)
+	}
+}
+
+func TestServerVanityLink(t *testing.T) {
+	s := newTestServer()
+	s.Uploaders = map[string]string{"alice-token": "alice"}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newVanityRequest(t, "alice-token", "dashboard.txt", "v1", "slug", "dashboard"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+
+	// Replacing a file with a link removes the file.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, newFormRequest(t, "alice-token", "slug", "dashboard", "replace", "true", "url", "https://example.com"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	if got, want := w.Header().Get("Location"), "/dashboard"; got != want {
+		t.Fatalf("unexpected location; got %q, want %q", got, want)
+	}
+	if _, err := s.FileSystem.Open(context.Background(), "dashboard"); err == nil {
+		t.Fatal("replaced file exists")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if got, want := w.Header().Get("Location"), "https://example.com"; w.Code != http.StatusFound || got != want {
+		t.Fatalf("unexpected response; got %d %q, want %d %q", w.Code, got, http.StatusFound, want)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, newFormRequest(t, "", "slug", "other", "url", "https://example.com"))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status; got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,286 @@
+package kipp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/view"
+)
+
+// maxViewSize is the size of the largest file which is highlighted. Larger
+// files are served raw.
+const maxViewSize = 1 << 20
+
+// maxLangViewSize is the size of the largest file whose language can be
+// chosen. Highlighting is slow, so views are cached, but only in the language
+// files are highlighted as by default.
+const maxLangViewSize = 64 << 10
+
+// pasteForm is the form pastes are submitted with.
+var pasteForm = template.Must(template.New("paste").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>kipp - paste</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #222; }
+textarea { width: 100%; height: 60vh; font-family: monospace; box-sizing: border-box; }
+input[type=text] { width: 20em; }
+</style>
+</head>
+<body>
+<h1>Paste</h1>
+<form method="post" action="/paste" enctype="multipart/form-data">
+<p><textarea name="text" required autofocus spellcheck="false"></textarea></p>
+<p><label>Name <input type="text" name="name" placeholder="paste.txt" maxlength="255"></label> <button type="submit">Paste</button></p>
+</form>
+</body>
+</html>
+`))
+
+// PasteHandler serves the paste form, and creates an entry for the "text"
+// field of pastes submitted with it. The entry is named by the "name" field,
+// whose extension chooses how the paste is highlighted, and is "paste.txt" by
+// default. The response redirects to the highlighted view of the paste.
+func (s Server) PasteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Method == http.MethodGet {
+			pasteForm.Execute(w, nil)
+		}
+		return
+	}
+
+	if r.ContentLength > s.Limit {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.Limit)
+	if err := r.ParseMultipartForm(maxViewSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Browsers submit text with CRLF line endings.
+	text := strings.ReplaceAll(r.PostFormValue("text"), "\r\n", "\n")
+	if text == "" {
+		http.Error(w, "text: required", http.StatusBadRequest)
+		return
+	}
+	name := r.PostFormValue("name")
+	if name == "" {
+		name = "paste.txt"
+	}
+	if len(name) > 255 {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	var replace bool
+	if v := r.PostFormValue("replace"); v != "" {
+		var err error
+		if replace, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "replace: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	slug := r.PostFormValue("slug")
+	uploader, ok := s.authoriseSlug(w, r, slug)
+	if !ok {
+		return
+	}
+
+	e, err := s.createFile(r.Context(), strings.NewReader(text), name, slug, uploader, replace)
+	if err != nil {
+		createError(w, err)
+		return
+	}
+
+	location := "/" + e.Slug + "/view"
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	w.Write([]byte(location + "\n"))
+}
+
+var (
+	viewStyle     = styles.Get("github")
+	viewFormatter = html.New(
+		html.WithClasses(true),
+		html.WithLineNumbers(true),
+		html.LinkableLineNumbers(true, "L"),
+		html.TabWidth(4),
+	)
+	viewCSS = func() template.CSS {
+		var b strings.Builder
+		if err := viewFormatter.WriteCSS(&b, viewStyle); err != nil {
+			panic(err)
+		}
+		return template.CSS(b.String())
+	}()
+)
+
+// viewPage is the page text files are highlighted on.
+var viewPage = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0; font-family: sans-serif; }
+header { display: flex; justify-content: space-between; padding: .5em 1em; border-bottom: 1px solid #ddd; }
+header a { color: inherit; }
+.chroma { margin: 0; padding: .5em 0; overflow-x: auto; }
+.chroma .ln:target { background-color: #fff8c5; }
+{{.CSS}}
+</style>
+</head>
+<body>
+<header><span>{{.Name}} &middot; {{.Language}}</span><a href="{{.Raw}}">raw</a></header>
+{{.Code}}
+</body>
+</html>
+`))
+
+// serveView serves text files highlighted, with numbered and linkable lines.
+// The language is chosen by the "lang" parameter, for smaller files, or the
+// extension of the file, or is detected from its contents. Files which are too
+// large, or aren't text, are redirected to their raw contents.
+func (s Server) serveView(w http.ResponseWriter, r *http.Request, e database.Entry) {
+	if e.URL != "" {
+		http.NotFound(w, r)
+		return
+	}
+	raw := "/" + e.Slug + filepath.Ext(e.Name)
+	if e.Size > maxViewSize {
+		http.Redirect(w, r, raw, http.StatusFound)
+		return
+	}
+
+	lexer := lexers.Get(r.URL.Query().Get("lang"))
+	if e.Size > maxLangViewSize {
+		lexer = nil
+	}
+	var (
+		language string
+		code     template.HTML
+		ok       bool
+	)
+	if lexer == nil {
+		language, code, ok = s.cachedView(r.Context(), e)
+	}
+	if !ok {
+		f, err := s.open(r.Context(), e)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(f, maxViewSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !utf8.Valid(b) || bytes.IndexByte(b, 0) > -1 {
+			http.Redirect(w, r, raw, http.StatusFound)
+			return
+		}
+
+		chosen := lexer != nil
+		if lexer == nil {
+			lexer = lexers.Match(e.Name)
+		}
+		if lexer == nil {
+			lexer = lexers.Analyse(string(b))
+		}
+		if lexer == nil {
+			lexer = lexers.Fallback
+		}
+		if code, err = highlight(lexer, string(b)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		language = lexer.Config().Name
+		if !chosen {
+			s.cacheView(r.Context(), e, language, code)
+		}
+	}
+
+	setCacheHeaders(w.Header(), e)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	viewPage.Execute(w, struct {
+		Name, Raw, Language string
+		CSS                 template.CSS
+		Code                template.HTML
+	}{
+		Name:     e.Name,
+		Raw:      raw,
+		Language: language,
+		CSS:      viewCSS,
+		Code:     code,
+	})
+}
+
+// cachedView returns the language and highlighted code of e, if its view was
+// cached. Cached views are the name of the language, followed by a newline
+// and the code.
+func (s Server) cachedView(ctx context.Context, e database.Entry) (string, template.HTML, bool) {
+	f, err := s.FileSystem.Open(ctx, view.Name(e))
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", "", false
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(b[:i]), template.HTML(b[i+1:]), true
+}
+
+// cacheView caches the language and highlighted code of e. Should caching
+// fail, the view is highlighted again next time.
+func (s Server) cacheView(ctx context.Context, e database.Entry, language string, code template.HTML) {
+	if e.Lifetime != nil {
+		ctx = filesystem.WithExpires(ctx, *e.Lifetime)
+	}
+	s.FileSystem.Create(ctx, view.Name(e), strings.NewReader(language+"\n"+string(code)))
+}
+
+// highlight returns text, highlighted as lexer's language, with numbered and
+// linkable lines.
+func highlight(lexer chroma.Lexer, text string) (template.HTML, error) {
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := viewFormatter.Format(&b, viewStyle, it); err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
@@ -0,0 +1,150 @@
+package kipp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/internal/view"
+)
+
+func paste(t *testing.T, s *Server, form url.Values) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/paste", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func TestServerPaste(t *testing.T) {
+	s := newTestServer()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/paste", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<form method="post" action="/paste"`) {
+		t.Fatalf("unexpected form; got %d: %s", w.Code, w.Body)
+	}
+
+	const text = "package main\n\nfunc main() {\n\tprintln(\"<hello>\")\n}\n"
+	loc := paste(t, s, url.Values{"text": {strings.ReplaceAll(text, "\n", "\r\n")}, "name": {"main.go"}})
+	m := regexp.MustCompile(`^/([A-Za-z0-9_-]+)/view$`).FindStringSubmatch(loc)
+	if m == nil {
+		t.Fatalf("unexpected location; got %q", loc)
+	}
+
+	// The raw file is unchanged, but for line endings.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+m[1]+".go", nil))
+	if got := w.Body.String(); got != text {
+		t.Fatalf("unexpected raw body; got %q, want %q", got, text)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status; got %d, want %d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Fatalf("unexpected content type; got %q, want %q", got, want)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); !strings.HasPrefix(got, "default-src 'none'") {
+		t.Fatalf("unexpected content security policy; got %q", got)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`id="L5"`,
+		`href="#L5"`,
+		`<span class="kd">func</span>`,
+		`&lt;hello&gt;`,
+		`href="/` + m[1] + `.go"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("view doesn't contain %q: %s", want, body)
+		}
+	}
+	if strings.Contains(body, "<hello>") {
+		t.Fatal("view contains unescaped text")
+	}
+}
+
+func TestServerView(t *testing.T) {
+	s := newTestServer()
+	txt := strings.TrimPrefix(strings.TrimSuffix(upload(t, s, "config.txt", "key: value\n"), ".txt"), "/")
+	bin := strings.TrimPrefix(strings.TrimSuffix(upload(t, s, "blob.bin", "\x00\x01\x02"), ".bin"), "/")
+
+	for _, tt := range []struct {
+		path, location, contains string
+		status                   int
+	}{
+		{path: "/" + txt + "/view", status: http.StatusOK, contains: "key: value"},
+		{path: "/" + txt + ".txt/view", status: http.StatusOK, contains: "key: value"},
+		// The language can be chosen.
+		{path: "/" + txt + "/view?lang=yaml", status: http.StatusOK, contains: `<span class="nt">key</span>`},
+		{path: "/" + bin + "/view", status: http.StatusFound, location: "/" + bin + ".bin"},
+		{path: "/missing/view", status: http.StatusNotFound},
+		{path: "/js/view", status: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Fatalf("%s: unexpected status; got %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Location"); got != tt.location {
+			t.Fatalf("%s: unexpected location; got %q, want %q", tt.path, got, tt.location)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Fatalf("%s: body doesn't contain %q: %s", tt.path, tt.contains, w.Body)
+		}
+	}
+}
+
+func TestServerViewCache(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer()
+	small := strings.TrimPrefix(strings.TrimSuffix(upload(t, s, "config.txt", "key: value\n"), ".txt"), "/")
+	large := strings.TrimPrefix(strings.TrimSuffix(upload(t, s, "large.txt", strings.Repeat("key: value\n", 8<<10)), ".txt"), "/")
+
+	get := func(path string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status; got %d, want %d", path, w.Code, http.StatusOK)
+		}
+		return w.Body.String()
+	}
+
+	// Views are cached the first time they're highlighted, and served
+	// from the cache after.
+	for _, slug := range []string{small, large} {
+		get("/" + slug + "/view")
+		e, err := s.Database.Lookup(ctx, slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.FileSystem.Create(ctx, view.Name(e), strings.NewReader("Cached\n<pre>cached</pre>")); err != nil {
+			t.Fatal(err)
+		}
+		if body := get("/" + slug + "/view"); !strings.Contains(body, "<pre>cached</pre>") {
+			t.Fatalf("%s: view wasn't cached: %s", slug, body)
+		}
+	}
+
+	// The language of small files can be chosen, but larger files are
+	// always served from the cache.
+	if body := get("/" + small + "/view?lang=yaml"); !strings.Contains(body, `<span class="nt">key</span>`) {
+		t.Fatalf("small file wasn't highlighted in the chosen language: %s", body)
+	}
+	if body := get("/" + large + "/view?lang=yaml"); !strings.Contains(body, "<pre>cached</pre>") {
+		t.Fatalf("large file was highlighted in the chosen language: %s", body)
+	}
+}
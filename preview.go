@@ -0,0 +1,473 @@
+package kipp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// maxPreviewRows is the number of rows of tables, and files of
+	// archives, which are previewed.
+	maxPreviewRows = 1000
+	// maxArchiveBytes is how much of a compressed archive is decompressed
+	// to list its files.
+	maxArchiveBytes = 256 << 20
+	// maxZipFiles is the number of files a zip archive may have to be
+	// listed, as all of them are read to list any.
+	maxZipFiles = 1 << 16
+	// previewCSP is the Content-Security-Policy of previews. They're
+	// sandboxed, so they have a unique origin, even if they're not served
+	// from Server.PreviewOrigin.
+	previewCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+)
+
+// A previewer renders previews of files with any of its extensions. Files are
+// either text, which is rendered by text, or archives, which are listed by
+// list.
+type previewer struct {
+	kind string
+	exts []string
+	text func(b []byte) (template.HTML, error)
+	list func(ctx context.Context, f filesystem.Reader, e database.Entry) ([]archiveFile, error)
+}
+
+// An archiveFile is a file in an archive.
+type archiveFile struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+var previewers = []previewer{
+	{kind: "Markdown", exts: []string{".md", ".markdown"}, text: previewMarkdown},
+	{kind: "CSV", exts: []string{".csv"}, text: previewTable(',')},
+	{kind: "TSV", exts: []string{".tsv", ".tab"}, text: previewTable('\t')},
+	{kind: "JSON", exts: []string{".json"}, text: previewJSON},
+	{kind: "YAML", exts: []string{".yaml", ".yml"}, text: previewYAML},
+	{kind: "Zip archive", exts: []string{".zip"}, list: listZip},
+	{kind: "Tar archive", exts: []string{".tar", ".tar.gz", ".tgz"}, list: listTar},
+}
+
+// previewerFor returns the previewer for files named name.
+func previewerFor(name string) (previewer, bool) {
+	name = strings.ToLower(name)
+	for _, p := range previewers {
+		for _, ext := range p.exts {
+			if strings.HasSuffix(name, ext) {
+				return p, true
+			}
+		}
+	}
+	return previewer{}, false
+}
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// previewMarkdown renders Markdown. Raw HTML is omitted, and links with
+// dangerous schemes, such as javascript:, are removed, so it's safe to serve.
+func previewMarkdown(b []byte) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert(b, &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(`<article class="markdown">` + buf.String() + `</article>`), nil
+}
+
+var tablePreview = template.Must(template.New("table").Parse(`<div class="table"><table>
+{{- range $i, $row := .Rows}}
+<tr>{{range $row}}{{if eq $i 0}}<th>{{.}}</th>{{else}}<td>{{.}}</td>{{end}}{{end}}</tr>
+{{- end}}
+</table></div>
+{{- if .Truncated}}
+<p class="truncated">Only the first {{len .Rows}} rows are shown.</p>
+{{- end}}`))
+
+// previewTable returns a previewer of tables whose fields are separated by
+// comma. The first row is the header.
+func previewTable(comma rune) func([]byte) (template.HTML, error) {
+	return func(b []byte) (template.HTML, error) {
+		r := csv.NewReader(bytes.NewReader(b))
+		r.Comma = comma
+		r.FieldsPerRecord = -1
+		r.LazyQuotes = true
+		var (
+			rows      [][]string
+			truncated bool
+		)
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if len(rows) == maxPreviewRows {
+				truncated = true
+				break
+			}
+			rows = append(rows, row)
+		}
+		var buf strings.Builder
+		if err := tablePreview.Execute(&buf, struct {
+			Rows      [][]string
+			Truncated bool
+		}{Rows: rows, Truncated: truncated}); err != nil {
+			return "", err
+		}
+		return template.HTML(buf.String()), nil
+	}
+}
+
+// previewJSON pretty prints JSON.
+func previewJSON(b []byte) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		return "", err
+	}
+	return highlight(lexers.Get("json"), buf.String())
+}
+
+// previewYAML pretty prints YAML, which may have many documents, in block
+// style. Comments and the order of keys are kept.
+func previewYAML(b []byte) (template.HTML, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var n yaml.Node
+		if err := dec.Decode(&n); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		blockStyle(&n)
+		if err := enc.Encode(&n); err != nil {
+			return "", err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return highlight(lexers.Get("yaml"), buf.String())
+}
+
+// blockStyle makes the collections in n use block style, rather than flow
+// style.
+func blockStyle(n *yaml.Node) {
+	n.Style &^= yaml.FlowStyle
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// errTruncated is returned by lists of archives with more files than are
+// previewed.
+var errTruncated = errors.New("truncated")
+
+// listZip lists the files of a zip archive. Only its central directory, at the
+// end of the archive, is read, and only if it has at most maxZipFiles files.
+func listZip(_ context.Context, f filesystem.Reader, e database.Entry) ([]archiveFile, error) {
+	ra := &readerAt{r: f}
+	n, err := zipFiles(ra, e.Size)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxZipFiles {
+		return nil, fmt.Errorf("too many files: %d", n)
+	}
+	zr, err := zip.NewReader(ra, e.Size)
+	if err != nil {
+		return nil, err
+	}
+	var files []archiveFile
+	for _, zf := range zr.File {
+		if len(files) == maxPreviewRows {
+			return files, errTruncated
+		}
+		files = append(files, archiveFile{
+			Name:     zf.Name,
+			Size:     int64(zf.UncompressedSize64),
+			Modified: zf.Modified,
+		})
+	}
+	return files, nil
+}
+
+// zipFiles returns the number of files in a zip archive of the given size,
+// according to its end of central directory record, or that of zip64.
+func zipFiles(r io.ReaderAt, size int64) (uint64, error) {
+	const (
+		endSize        = 22
+		endSig         = "PK\x05\x06"
+		locatorSize    = 20
+		locatorSig     = "PK\x06\x07"
+		end64Size      = 56
+		end64Sig       = "PK\x06\x06"
+		maxCommentSize = 1<<16 - 1
+	)
+	// The record is at the end of the archive, but for a comment.
+	n := int64(endSize + maxCommentSize)
+	if n > size {
+		n = size
+	}
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, size-n); err != nil && err != io.EOF {
+		return 0, err
+	}
+	i := bytes.LastIndex(b, []byte(endSig))
+	if i < 0 || len(b)-i < endSize {
+		return 0, zip.ErrFormat
+	}
+	if n := binary.LittleEndian.Uint16(b[i+10:]); n != 0xffff {
+		return uint64(n), nil
+	}
+
+	// The number of files doesn't fit, so it's in the zip64 record, which
+	// is found by the locator before the end of central directory record.
+	off := size - n + int64(i) - locatorSize
+	if off < 0 {
+		return 0, zip.ErrFormat
+	}
+	b = make([]byte, end64Size)
+	if _, err := r.ReadAt(b[:locatorSize], off); err != nil {
+		return 0, err
+	}
+	if string(b[:4]) != locatorSig {
+		return 0, zip.ErrFormat
+	}
+	off = int64(binary.LittleEndian.Uint64(b[8:]))
+	if off < 0 || off > size-end64Size {
+		return 0, zip.ErrFormat
+	}
+	if _, err := r.ReadAt(b, off); err != nil {
+		return 0, err
+	}
+	if string(b[:4]) != end64Sig {
+		return 0, zip.ErrFormat
+	}
+	return binary.LittleEndian.Uint64(b[32:]), nil
+}
+
+// listTar lists the files of a tar archive, which may be compressed with
+// gzip. Uncompressed archives are skipped through by seeking, but compressed
+// archives must be decompressed, so at most maxArchiveBytes are. The listing
+// stops once ctx is done.
+func listTar(ctx context.Context, f filesystem.Reader, e database.Entry) ([]archiveFile, error) {
+	var (
+		r  io.Reader = f
+		lr *io.LimitedReader
+	)
+	if name := strings.ToLower(e.Name); strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		lr = &io.LimitedReader{R: zr, N: maxArchiveBytes}
+		r = lr
+	}
+	tr := tar.NewReader(r)
+	var files []archiveFile
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF && (lr == nil || lr.N > 0) {
+			return files, nil
+		}
+		if err != nil && lr != nil && lr.N <= 0 {
+			return files, errTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == maxPreviewRows {
+			return files, errTruncated
+		}
+		files = append(files, archiveFile{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Modified: hdr.ModTime,
+		})
+	}
+}
+
+// readerAt reads from a ReadSeeker at offsets. It's safe for concurrent use,
+// but reads are serialised.
+type readerAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+var archivePreview = template.Must(template.New("archive").Parse(`<div class="table"><table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{- range .Files}}
+<tr><td>{{.Name}}</td><td class="size">{{.Size}}</td><td>{{if not .Modified.IsZero}}{{.Modified.UTC.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{- end}}
+</table></div>
+{{- if .Truncated}}
+<p class="truncated">Only the first {{len .Files}} files are shown.</p>
+{{- end}}`))
+
+// previewPage is the page previews are shown on.
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0; font-family: sans-serif; color: #222; }
+header { display: flex; justify-content: space-between; padding: .5em 1em; border-bottom: 1px solid #ddd; }
+header a { color: inherit; }
+main { padding: 0 1em 1em; }
+.markdown { max-width: 50em; line-height: 1.5; }
+.markdown img { max-width: 100%; }
+.markdown pre, .markdown code { background: #f6f8fa; }
+.markdown pre { padding: 1em; overflow-x: auto; }
+.table { overflow-x: auto; margin-top: 1em; }
+table { border-collapse: collapse; font-size: .9em; }
+th, td { border: 1px solid #ddd; padding: .25em .5em; text-align: left; white-space: pre; }
+th { background: #f6f8fa; }
+td.size { text-align: right; }
+.chroma { margin: 1em -1em 0; padding: .5em 0; overflow-x: auto; }
+{{.CSS}}
+</style>
+</head>
+<body>
+<header><span>{{.Name}} &middot; {{.Kind}}</span><a href="{{.Raw}}">raw</a></header>
+<main>{{.Body}}</main>
+</body>
+</html>
+`))
+
+// servePreview serves a preview of e, rendered according to the extension of
+// its name. Previews are sandboxed, and if the server has a preview origin,
+// they're only served from it.
+func (s Server) servePreview(w http.ResponseWriter, r *http.Request, e database.Entry) {
+	if s.PreviewOrigin != "" {
+		u, err := url.Parse(s.PreviewOrigin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Host != u.Host {
+			http.Redirect(w, r, strings.TrimSuffix(s.PreviewOrigin, "/")+r.URL.RequestURI(), http.StatusFound)
+			return
+		}
+	}
+	p, ok := previewerFor(e.Name)
+	if e.URL != "" || !ok {
+		http.Error(w, "no preview for this file", http.StatusNotFound)
+		return
+	}
+	if p.text != nil && e.Size > maxViewSize {
+		http.Error(w, "file is too large to preview", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	f, err := s.open(r.Context(), e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	var body template.HTML
+	if p.text != nil {
+		var b []byte
+		if b, err = ioutil.ReadAll(io.LimitReader(f, maxViewSize)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !utf8.Valid(b) {
+			http.Error(w, "file is not text", http.StatusUnprocessableEntity)
+			return
+		}
+		body, err = p.text(b)
+	} else {
+		body, err = renderArchive(p.list(r.Context(), f, e))
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("preview %s: %v", p.kind, err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	setCacheHeaders(w.Header(), e)
+	w.Header().Set("Content-Security-Policy", previewCSP)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	previewPage.Execute(w, struct {
+		Name, Raw, Kind string
+		CSS             template.CSS
+		Body            template.HTML
+	}{
+		Name: e.Name,
+		Raw:  "/" + e.Slug + filepath.Ext(e.Name),
+		Kind: p.kind,
+		CSS:  viewCSS,
+		Body: body,
+	})
+}
+
+// renderArchive renders the listing of an archive.
+func renderArchive(files []archiveFile, err error) (template.HTML, error) {
+	truncated := errors.Is(err, errTruncated)
+	if err != nil && !truncated {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := archivePreview.Execute(&buf, struct {
+		Files     []archiveFile
+		Truncated bool
+	}{Files: files, Truncated: truncated}); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
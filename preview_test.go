@@ -0,0 +1,257 @@
+package kipp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/database"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+)
+
+func TestServerPreview(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range []string{"docs/readme.txt", "main.go"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(name))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tarred bytes.Buffer
+	gw := gzip.NewWriter(&tarred)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/config.yaml", Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("a: b"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	for _, tt := range []struct {
+		name, content string
+		status        int
+		contains      []string
+		excludes      []string
+	}{
+		{
+			name:     "readme.md",
+			content:  "# Title\n\n<script>alert(1)</script>\n\n[bad](javascript:alert(1)) | a | b |\n\n| a | b |\n|---|---|\n| 1 | 2 |\n",
+			status:   http.StatusOK,
+			contains: []string{"<h1>Title</h1>", "<td>1</td>", "Markdown"},
+			excludes: []string{"<script>", "javascript:"},
+		},
+		{
+			name:     "data.csv",
+			content:  "name,value\n<b>,\"1,5\"\n",
+			status:   http.StatusOK,
+			contains: []string{"<th>name</th>", "<td>&lt;b&gt;</td>", "<td>1,5</td>"},
+		},
+		{
+			name:     "data.tsv",
+			content:  "name\tvalue\nx\ty\n",
+			status:   http.StatusOK,
+			contains: []string{"<th>value</th>", "<td>y</td>"},
+		},
+		{
+			name:     "data.json",
+			content:  `{"a":[1,2],"b":"<c>"}`,
+			status:   http.StatusOK,
+			contains: []string{`<span class="nt">&#34;a&#34;</span>`, "&lt;c&gt;", `id="L4"`},
+		},
+		{
+			name:     "config.yml",
+			content:  "# comment\na: {b: 1, c: [x, y]}\n---\nd: e\n",
+			status:   http.StatusOK,
+			contains: []string{"# comment", `<span class="nt">b</span>`, "---"},
+		},
+		{
+			name:     "files.zip",
+			content:  zipped.String(),
+			status:   http.StatusOK,
+			contains: []string{"<td>docs/readme.txt</td>", "<td>main.go</td>"},
+		},
+		{
+			name:     "files.tar.gz",
+			content:  tarred.String(),
+			status:   http.StatusOK,
+			contains: []string{"<td>etc/config.yaml</td>", `<td class="size">4</td>`},
+		},
+		{name: "invalid.json", content: "{", status: http.StatusUnprocessableEntity},
+		{name: "binary.md", content: "\xff\xfe", status: http.StatusUnprocessableEntity},
+		{name: "notes.txt", content: "hello", status: http.StatusNotFound},
+	} {
+		loc := upload(t, s, tt.name, tt.content)
+		path := loc[:strings.Index(loc, ".")] + "/preview"
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != tt.status {
+			t.Fatalf("%s: unexpected status; got %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Security-Policy"); got != previewCSP {
+			t.Fatalf("%s: unexpected content security policy; got %q, want %q", tt.name, got, previewCSP)
+		}
+		body := w.Body.String()
+		for _, want := range tt.contains {
+			if !strings.Contains(body, want) {
+				t.Fatalf("%s: preview doesn't contain %q: %s", tt.name, want, body)
+			}
+		}
+		for _, want := range tt.excludes {
+			if strings.Contains(body, want) {
+				t.Fatalf("%s: preview contains %q: %s", tt.name, want, body)
+			}
+		}
+
+		// The raw file is served as it always was.
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+		if got := w.Body.String(); got != tt.content {
+			t.Fatalf("%s: unexpected raw body; got %q, want %q", tt.name, got, tt.content)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Fatalf("%s: unexpected X-Content-Type-Options; got %q", tt.name, got)
+		}
+	}
+}
+
+func TestServerPreviewOrigin(t *testing.T) {
+	s := newTestServer()
+	s.PreviewOrigin = "https://preview.example.com"
+	loc := upload(t, s, "readme.md", "# Title")
+	path := strings.TrimSuffix(loc, ".md") + "/preview"
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://kipp.example.com"+path, nil))
+	if got, want := w.Header().Get("Location"), "https://preview.example.com"+path; w.Code != http.StatusFound || got != want {
+		t.Fatalf("unexpected response; got %d %q, want %d %q", w.Code, got, http.StatusFound, want)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://preview.example.com"+path, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<h1>Title</h1>") {
+		t.Fatalf("unexpected response; got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestListTarLimits(t *testing.T) {
+	// The first file is as large as can be decompressed, so the second
+	// is never listed.
+	var tarred bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&tarred, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(gw)
+	for _, hdr := range []*tar.Header{
+		{Name: "large", Mode: 0644, Size: maxArchiveBytes},
+		{Name: "small", Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(tw, zeros{}, hdr.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	fs := memoryfs.New(0)
+	if err := fs.Create(ctx, "files", bytes.NewReader(tarred.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	e := database.Entry{Name: "files.tar.gz", Size: int64(tarred.Len())}
+	list := func(ctx context.Context) ([]archiveFile, error) {
+		f, err := fs.Open(ctx, "files")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return listTar(ctx, f, e)
+	}
+
+	files, err := list(ctx)
+	if !errors.Is(err, errTruncated) {
+		t.Fatalf("unexpected error; got %v, want %v", err, errTruncated)
+	}
+	if len(files) != 1 || files[0].Name != "large" {
+		t.Fatalf("unexpected files; got %+v, want only large", files)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := list(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error; got %v, want %v", err, context.Canceled)
+	}
+}
+
+// zeros reads zeros forever.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestListZipTooManyFiles(t *testing.T) {
+	// The number of files doesn't fit in the end of central directory
+	// record, so it's read from that of zip64.
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for i := 0; i <= maxZipFiles; i++ {
+		if _, err := zw.CreateHeader(&zip.FileHeader{Name: strconv.Itoa(i), Method: zip.Store}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	fs := memoryfs.New(0)
+	if err := fs.Create(ctx, "files", bytes.NewReader(zipped.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open(ctx, "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := zipFiles(&readerAt{r: f}, int64(zipped.Len())); err != nil || n != maxZipFiles+1 {
+		t.Fatalf("unexpected number of files; got (%d, %v), want (%d, nil)", n, err, maxZipFiles+1)
+	}
+	if _, err := listZip(ctx, f, database.Entry{Size: int64(zipped.Len())}); err == nil {
+		t.Fatal("listed an archive with too many files")
+	}
+}
@@ -1,11 +1,12 @@
 package kipp
 
 import (
-	"crypto/rand"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
@@ -29,6 +30,36 @@ type Server struct {
 	Lifetime   time.Duration
 	Limit      int64
 	PublicPath string
+	// Redirect, if non-zero, redirects downloads to URLs from which they
+	// can be downloaded directly, and which expire after Redirect. It's
+	// only used if FileSystem implements filesystem.Redirector.
+	Redirect time.Duration
+	// DirectUpload, if non-zero, lets clients upload files directly to
+	// URLs which expire after DirectUpload. It's only used if FileSystem
+	// implements filesystem.Uploader.
+	DirectUpload time.Duration
+	// Slugs generates the slugs of new entries. RandomSlugs is used if
+	// nil.
+	Slugs SlugGenerator
+	// Uploaders maps bearer tokens to the names of uploaders, who may
+	// choose the slugs of their uploads.
+	Uploaders map[string]string
+	// LinkPreview, if true, shows the targets of links on a page, rather
+	// than redirecting to them.
+	LinkPreview bool
+	// PreviewOrigin, if set, is the origin previews are served from, such
+	// as https://preview.example.com, which should be served by the same
+	// server. Requests for previews from other hosts are redirected to it,
+	// so previews never share an origin with kipp.
+	PreviewOrigin string
+	// Unfurl, if true, serves the embed page of files, rather than the
+	// files, to the bots which chat services use to unfurl links.
+	Unfurl bool
+	// BaseURL, if set, is the URL kipp is served from, such as
+	// https://kipp.example.com, which the absolute URLs of embeds are made
+	// from. Otherwise, they're made from the host and scheme of requests,
+	// which clients control.
+	BaseURL string
 }
 
 // ServeHTTP will serve HTTP requests. It first tries to determine if the
@@ -38,14 +69,24 @@ func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
 	case http.MethodPost:
-		if r.URL.Path == "/" {
+		switch {
+		case r.URL.Path == "/":
 			s.UploadHandler(w, r)
 			return
+		case r.URL.Path == "/paste":
+			s.PasteHandler(w, r)
+			return
+		case r.URL.Path == "/uploads":
+			s.UploadSlotHandler(w, r)
+			return
+		case strings.HasPrefix(r.URL.Path, "/uploads/"):
+			s.FinalizeUploadHandler(w, r)
+			return
 		}
 		fallthrough
 	default:
 		allow := "GET, HEAD, OPTIONS"
-		if r.URL.Path == "/" {
+		if r.URL.Path == "/" || r.URL.Path == "/paste" || r.URL.Path == "/uploads" || strings.HasPrefix(r.URL.Path, "/uploads/") {
 			allow = "GET, HEAD, OPTIONS, POST"
 		}
 		if r.Method == http.MethodOptions {
@@ -57,6 +98,53 @@ func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch r.URL.Path {
+	case "/paste":
+		s.PasteHandler(w, r)
+		return
+	case "/oembed":
+		s.OEmbedHandler(w, r)
+		return
+	}
+
+	// Pages about entries are at /{slug}/{page}, unless they're shadowed
+	// by public files.
+	upath := path.Clean("/" + r.URL.Path)
+	if dir, page := path.Split(upath); dir != "/" && entryPages[page] != nil {
+		switch e, err := s.entry(r.Context(), path.Clean(dir)); {
+		case err == nil:
+			entryPages[page](s, w, r, e)
+			return
+		case !errors.Is(err, os.ErrNotExist):
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Entries are looked up once, unless the file server asks for a
+	// different name.
+	entry, entryErr := s.entry(r.Context(), upath)
+	if entryErr == nil && entry.URL != "" {
+		s.serveLink(w, r, entry)
+		return
+	}
+
+	// Unfurlers are shown a page describing the file, rather than the
+	// file, unless they ask for the file itself.
+	if entryErr == nil && s.Unfurl {
+		w.Header().Add("Vary", "User-Agent")
+		if _, raw := r.URL.Query()["raw"]; !raw && isUnfurler(r.UserAgent()) {
+			s.serveEmbed(w, r, entry)
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet && s.Redirect > 0 && entryErr == nil {
+		if rd, ok := s.FileSystem.(filesystem.Redirector); ok && s.redirect(w, r, rd, entry) {
+			return
+		}
+	}
+
 	http.FileServer(fileSystemFunc(func(name string) (http.File, error) {
 		if f, err := http.Dir(s.PublicPath).Open(name); !os.IsNotExist(err) {
 			d, err := f.Stat()
@@ -74,71 +162,206 @@ func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return f, nil
 		}
 
-		dir, name := path.Split(name)
-		if dir != "/" {
+		e, err := entry, entryErr
+		if name != upath {
+			e, err = s.lookup(r.Context(), name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.URL != "" {
 			return nil, os.ErrNotExist
 		}
 
-		// trim anything after the first "."
-		if i := strings.Index(name, "."); i > -1 {
-			name = name[:i]
+		f, err := s.open(r.Context(), e)
+		if err != nil {
+			return nil, err
 		}
 
-		e, err := s.Database.Lookup(r.Context(), name)
+		ctype, err := contentType(e, f)
 		if err != nil {
-			if errors.Is(err, database.ErrNoResults) {
-				return nil, os.ErrNotExist
-			}
+			f.Close()
 			return nil, err
 		}
 
-		cache := "max-age=31536000" // ~ 1 year
-		if e.Lifetime != nil {
-			now := time.Now()
-			if e.Lifetime.Before(now) {
-				return nil, os.ErrNotExist
+		etag := e.Sum
+		if er, ok := f.(filesystem.EncodedReader); ok {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if enc := er.Encoding(); acceptsEncoding(r.Header.Get("Accept-Encoding"), enc) {
+				ef, n, err := er.Encoded()
+				if err != nil {
+					f.Close()
+					return nil, err
+				}
+				f, e.Size, etag = ef, n, e.Sum+"-"+enc
+				w.Header().Set("Content-Encoding", enc)
 			}
-			cache = fmt.Sprintf(
-				"public, must-revalidate, max-age=%d",
-				int(e.Lifetime.Sub(now).Seconds()),
-			)
 		}
 
-		f, err := s.FileSystem.Open(r.Context(), e.Slug)
-		if err != nil {
-			return nil, err
+		setCacheHeaders(w.Header(), e)
+		w.Header().Set("Content-Disposition", contentDisposition(e))
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Etag", strconv.Quote(etag))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		return &file{Reader: f, entry: e}, nil
+	})).ServeHTTP(w, r)
+}
+
+// entryPages serve pages about entries, by name.
+var entryPages = map[string]func(Server, http.ResponseWriter, *http.Request, database.Entry){
+	"embed":   Server.serveEmbed,
+	"preview": Server.servePreview,
+	"thumb":   Server.serveThumbnail,
+	"view":    Server.serveView,
+}
+
+// setCacheHeaders sets the headers which let clients cache e until it
+// expires.
+func setCacheHeaders(h http.Header, e database.Entry) {
+	cache := "max-age=31536000" // ~ 1 year
+	if e.Lifetime != nil {
+		now := time.Now()
+		cache = fmt.Sprintf(
+			"public, must-revalidate, max-age=%d",
+			int(e.Lifetime.Sub(now).Seconds()),
+		)
+		h.Set("Expires", e.Lifetime.Format(http.TimeFormat))
+	}
+	h.Set("Cache-Control", cache)
+}
+
+// entry looks up the entry for the named file, unless it's a public file.
+func (s Server) entry(ctx context.Context, name string) (database.Entry, error) {
+	if f, err := http.Dir(s.PublicPath).Open(name); err == nil {
+		f.Close()
+		return database.Entry{}, os.ErrNotExist
+	}
+	return s.lookup(ctx, name)
+}
+
+// lookup looks up the entry for the named file, which may have an extension.
+// Expired entries do not exist.
+func (s Server) lookup(ctx context.Context, name string) (database.Entry, error) {
+	dir, name := path.Split(name)
+	if dir != "/" {
+		return database.Entry{}, os.ErrNotExist
+	}
+
+	// trim anything after the first "."
+	if i := strings.Index(name, "."); i > -1 {
+		name = name[:i]
+	}
+
+	e, err := s.Database.Lookup(ctx, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNoResults) {
+			return database.Entry{}, os.ErrNotExist
 		}
+		return database.Entry{}, err
+	}
+	if e.Lifetime != nil && e.Lifetime.Before(time.Now()) {
+		return database.Entry{}, os.ErrNotExist
+	}
+	return e, nil
+}
 
-		// Detect content type before serving content to filter html files
-		ctype := mime.TypeByExtension(filepath.Ext(e.Name))
-		if ctype == "" {
-			var b [512]byte
-			n, _ := io.ReadFull(f, b[:])
-			ctype = http.DetectContentType(b[:n])
-			if _, err := f.Seek(0, io.SeekStart); err != nil {
-				return nil, errors.New("seeker can't seek")
-			}
+// withExpires tells the filesystem when files created with ctx expire. The
+// entry is created after the file, so expires no earlier.
+func (s Server) withExpires(ctx context.Context) context.Context {
+	if s.Lifetime > 0 {
+		return filesystem.WithExpires(ctx, time.Now().Add(s.Lifetime))
+	}
+	return ctx
+}
+
+// open opens the file for e. Filesystems which can make use of its size are
+// given it, so that they needn't look it up themselves.
+func (s Server) open(ctx context.Context, e database.Entry) (filesystem.Reader, error) {
+	if so, ok := s.FileSystem.(filesystem.SizedOpener); ok {
+		return so.OpenSize(ctx, e.FileName(), e.Size)
+	}
+	return s.FileSystem.Open(ctx, e.FileName())
+}
+
+// redirect redirects the client to a URL from which e can be downloaded
+// directly, with the same content type and disposition it would otherwise be
+// served with. It reports whether it did so; if not, the request should be
+// served as usual.
+func (s Server) redirect(w http.ResponseWriter, r *http.Request, rd filesystem.Redirector, e database.Entry) bool {
+	// The contents are only needed to sniff the content type.
+	var (
+		f   filesystem.Reader
+		err error
+	)
+	if mime.TypeByExtension(filepath.Ext(e.Name)) == "" {
+		if f, err = s.open(r.Context(), e); err != nil {
+			return false
 		}
+		defer f.Close()
+	}
+	ctype, err := contentType(e, f)
+	if err != nil {
+		return false
+	}
+
+	u, err := rd.RedirectURL(r.Context(), e.FileName(), s.Redirect, ctype, contentDisposition(e))
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	return true
+}
 
-		// catches text/html and text/html; charset=utf-8
-		const prefix = "text/html"
-		if strings.HasPrefix(ctype, prefix) {
-			ctype = "text/plain" + ctype[len(prefix):]
+// contentType returns the content type to serve e with, sniffing the contents
+// of f if the extension of its name is unknown. HTML is served as plain text,
+// so uploads can't run scripts.
+func contentType(e database.Entry, f io.ReadSeeker) (string, error) {
+	// Detect content type before serving content to filter html files
+	ctype := mime.TypeByExtension(filepath.Ext(e.Name))
+	if ctype == "" {
+		var b [512]byte
+		n, _ := io.ReadFull(f, b[:])
+		ctype = http.DetectContentType(b[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", errors.New("seeker can't seek")
 		}
+	}
 
-		w.Header().Set("Cache-Control", cache)
-		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			"filename=%q; filename*=UTF-8''%[1]s",
-			url.PathEscape(e.Name),
-		))
-		w.Header().Set("Content-Type", ctype)
-		w.Header().Set("Etag", strconv.Quote(e.Sum))
-		if e.Lifetime != nil {
-			w.Header().Set("Expires", e.Lifetime.Format(http.TimeFormat))
+	// catches text/html and text/html; charset=utf-8
+	const prefix = "text/html"
+	if strings.HasPrefix(ctype, prefix) {
+		ctype = "text/plain" + ctype[len(prefix):]
+	}
+	return ctype, nil
+}
+
+func contentDisposition(e database.Entry) string {
+	return fmt.Sprintf(
+		"filename=%q; filename*=UTF-8''%[1]s",
+		url.PathEscape(e.Name),
+	)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header accepts enc.
+func acceptsEncoding(header, enc string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v, params := strings.TrimSpace(v), ""
+		if i := strings.Index(v, ";"); i > -1 {
+			v, params = strings.TrimSpace(v[:i]), v[i+1:]
 		}
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		return &file{Reader: f, entry: e}, nil
-	})).ServeHTTP(w, r)
+		if !strings.EqualFold(v, enc) {
+			continue
+		}
+		// An explicit weight of zero means not acceptable.
+		params = strings.ReplaceAll(params, " ", "")
+		if q := strings.TrimPrefix(params, "q="); q != params {
+			f, err := strconv.ParseFloat(q, 64)
+			return err == nil && f > 0
+		}
+		return true
+	}
+	return false
 }
 
 // UploadHandler write the contents of the "file" part to a filesystem.Reader,
@@ -164,71 +387,216 @@ func (s Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var p *multipart.Part
+	// Fields must precede the file, as it's read as it's uploaded. Links
+	// have no file.
+	var (
+		p          *multipart.Part
+		slug, link string
+		replace    bool
+	)
 	for {
-		if p, err = mr.NextPart(); err != nil {
+		if p, err = mr.NextPart(); err == io.EOF && link != "" {
+			break
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		if p.FormName() == "file" {
 			break
 		}
+		switch p.FormName() {
+		case "slug":
+			slug, err = formValue(p, maxFieldSize)
+		case "replace":
+			var v string
+			if v, err = formValue(p, maxFieldSize); err == nil {
+				replace, err = strconv.ParseBool(v)
+			}
+		case "url":
+			if link, err = formValue(p, maxURLLength); err == nil {
+				err = checkLink(link)
+			}
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", p.FormName(), err), http.StatusBadRequest)
+			return
+		}
+	}
+	if p != nil {
+		defer p.Close()
+		if link != "" {
+			http.Error(w, "a url and a file can't both be uploaded", http.StatusBadRequest)
+			return
+		}
 	}
-	defer p.Close()
 
-	name := p.FileName()
-	if len(name) > 255 {
-		http.Error(w, "invalid name", http.StatusBadRequest)
+	uploader, ok := s.authoriseSlug(w, r, slug)
+	if !ok {
 		return
 	}
 
-	var b [9]byte
-	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var (
+		e    database.Entry
+		name string
+	)
+	if link != "" {
+		e, err = s.createLink(r.Context(), link, slug, uploader, replace)
+	} else {
+		if name = p.FileName(); len(name) > 255 {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		e, err = s.createFile(r.Context(), p, name, slug, uploader, replace)
+	}
+	if err != nil {
+		createError(w, err)
 		return
 	}
 
-	slug := base64.RawURLEncoding.EncodeToString(b[:])
+	ext := filepath.Ext(name)
 
-	if err := s.FileSystem.Create(r.Context(), slug, filesystem.PipeReader(func(w io.Writer) error {
+	var buf strings.Builder
+	buf.Grow(len(e.Slug) + len(ext) + 2)
+	buf.WriteRune('/')
+	buf.WriteString(e.Slug)
+	buf.WriteString(ext)
+
+	http.Redirect(w, r, buf.String(), http.StatusSeeOther)
+
+	buf.WriteRune('\n')
+	w.Write([]byte(buf.String()))
+}
+
+// createFile creates an entry, and file, for r. It has the chosen slug, if
+// any.
+func (s Server) createFile(ctx context.Context, r io.Reader, name, slug, uploader string, replace bool) (database.Entry, error) {
+	switch {
+	case slug != "":
+		return s.createVanity(ctx, r, name, slug, uploader, replace)
+	case s.needsSum():
+		return s.createBuffered(ctx, r, name)
+	default:
+		return s.createStreamed(ctx, r, name)
+	}
+}
+
+// createError responds to a request to create an entry which failed with err.
+func createError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSlugTaken) || errors.Is(err, errSlugChanged) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// createStreamed writes r to the filesystem as it's read, and then creates
+// its entry.
+func (s Server) createStreamed(ctx context.Context, r io.Reader, name string) (database.Entry, error) {
+	slug, err := s.newSlug(ctx, database.Entry{Name: name})
+	if err != nil {
+		return database.Entry{}, err
+	}
+
+	var e database.Entry
+	if err := s.FileSystem.Create(s.withExpires(ctx), slug, filesystem.PipeReader(func(w io.Writer) error {
 		h := blake3.New()
-		n, err := io.Copy(io.MultiWriter(w, h), p)
+		n, err := io.Copy(io.MultiWriter(w, h), r)
 		if err != nil {
 			return fmt.Errorf("copy: %w", err)
 		}
 
-		e := database.Entry{
-			Slug:      slug,
-			Name:      name,
-			Sum:       base64.RawURLEncoding.EncodeToString(h.Sum(nil)),
-			Size:      n,
-			Timestamp: time.Now(),
-		}
-
-		if s.Lifetime > 0 {
-			l := e.Timestamp.Add(s.Lifetime)
-			e.Lifetime = &l
-		}
-
-		if err := s.Database.Create(r.Context(), e); err != nil {
+		e = s.newEntry(slug, name, h.Sum(nil), n)
+		if err := s.Database.Create(ctx, e); err != nil {
 			return fmt.Errorf("create entity: %w", err)
 		}
 		return nil
 	})); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return database.Entry{}, err
 	}
+	return e, nil
+}
 
-	ext := filepath.Ext(name)
+// createBuffered writes r to a temporary file, so its slug can be generated
+// from its sum, and then creates its entry, followed by the file. The entry
+// is created first to claim the slug, so files of entries which are created
+// concurrently with the same slug are never replaced.
+func (s Server) createBuffered(ctx context.Context, r io.Reader, name string) (database.Entry, error) {
+	f, e, err := s.spool(r, name)
+	if err != nil {
+		return database.Entry{}, err
+	}
+	defer removeTemp(f)
 
-	var buf strings.Builder
-	buf.Grow(len(slug) + len(ext) + 2)
-	buf.WriteRune('/')
-	buf.WriteString(slug)
-	buf.WriteString(ext)
+	if e, err = s.create(ctx, e); err != nil {
+		return database.Entry{}, err
+	}
+	if err := s.store(ctx, f, e); err != nil {
+		s.Database.Remove(ctx, e.Slug)
+		return database.Entry{}, err
+	}
+	return e, nil
+}
 
-	http.Redirect(w, r, buf.String(), http.StatusSeeOther)
+// create generates a slug for e, and creates it. Should another entry be
+// created with the same slug first, another slug is generated.
+func (s Server) create(ctx context.Context, e database.Entry) (database.Entry, error) {
+	for attempt := 0; ; attempt++ {
+		slug, err := s.newSlug(ctx, e)
+		if err != nil {
+			return database.Entry{}, err
+		}
+		e.Slug = slug
+		err = s.Database.Create(ctx, e)
+		if err == nil {
+			return e, nil
+		}
+		if !errors.Is(err, database.ErrExists) || attempt == maxSlugAttempts {
+			return database.Entry{}, fmt.Errorf("create entity: %w", err)
+		}
+	}
+}
 
-	buf.WriteRune('\n')
-	w.Write([]byte(buf.String()))
+// spool writes r to a temporary file, and returns it with its entry, which
+// has no slug. The file should be removed with removeTemp.
+func (s Server) spool(r io.Reader, name string) (*os.File, database.Entry, error) {
+	f, err := ioutil.TempFile("", "kipp-upload-")
+	if err != nil {
+		return nil, database.Entry{}, fmt.Errorf("temp file: %w", err)
+	}
+	h := blake3.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		removeTemp(f)
+		return nil, database.Entry{}, fmt.Errorf("copy: %w", err)
+	}
+	return f, s.newEntry("", name, h.Sum(nil), n), nil
+}
+
+// store writes the spooled file f to the filesystem, for e.
+func (s Server) store(ctx context.Context, f *os.File, e database.Entry) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	return s.FileSystem.Create(s.withExpires(ctx), e.FileName(), f)
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// newEntry returns the entry for a file uploaded now.
+func (s Server) newEntry(slug, name string, sum []byte, size int64) database.Entry {
+	e := database.Entry{
+		Slug:      slug,
+		Name:      name,
+		Sum:       base64.RawURLEncoding.EncodeToString(sum),
+		Size:      size,
+		Timestamp: time.Now(),
+	}
+	if s.Lifetime > 0 {
+		l := e.Timestamp.Add(s.Lifetime)
+		e.Lifetime = &l
+	}
+	return e
 }
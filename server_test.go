@@ -0,0 +1,422 @@
+package kipp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database/memory"
+	"github.com/uhthomas/kipp/filesystem/compress"
+	memoryfs "github.com/uhthomas/kipp/filesystem/memory"
+	"github.com/uhthomas/kipp/filesystem/s3"
+	"github.com/uhthomas/kipp/internal/s3test"
+)
+
+func newTestServer() *Server {
+	return &Server{
+		Database:   memory.New(0),
+		FileSystem: memoryfs.New(0),
+		Lifetime:   time.Hour,
+		Limit:      1 << 20,
+		PublicPath: "web",
+	}
+}
+
+func upload(t *testing.T, h http.Handler, name, content string) string {
+	t.Helper()
+
+	r := newUploadRequest(t, name, content)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("unexpected status; got %d, want %d: %s", got, want, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+// newUploadRequest returns a request to upload content, named name.
+func newUploadRequest(t *testing.T, name, content string) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestServerUploadAndServe(t *testing.T) {
+	s := newTestServer()
+
+	loc := upload(t, s, "hello.html", "<h1>hello</h1>")
+	if !strings.HasSuffix(loc, ".html") {
+		t.Fatalf("location %q does not preserve the extension", loc)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "<h1>hello</h1>"; got != want {
+		t.Fatalf("unexpected body; got %q, want %q", got, want)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Fatalf("unexpected content type; got %q, want %q", got, want)
+	}
+	if w.Header().Get("Expires") == "" {
+		t.Fatal("missing expires header")
+	}
+}
+
+func TestServerNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	newTestServer().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing.txt", nil))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+}
+
+func TestServerContentEncoding(t *testing.T) {
+	s := newTestServer()
+	fs, err := compress.New(s.FileSystem, "gzip", 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.FileSystem = fs
+
+	content := strings.Repeat("level=info msg=\"request served\"\n", 1<<10)
+	loc := upload(t, s, "server.log", content)
+
+	for _, tt := range []struct {
+		accept, encoding string
+	}{
+		{"", ""},
+		{"gzip, deflate", "gzip"},
+		{"br;q=1.0, gzip;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"zstd", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, loc, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Encoding", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if got, want := w.Code, http.StatusOK; got != want {
+			t.Fatalf("%q: unexpected status; got %d, want %d", tt.accept, got, want)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Fatalf("%q: unexpected content encoding; got %q, want %q", tt.accept, got, tt.encoding)
+		}
+		if got, want := w.Header().Get("Vary"), "Accept-Encoding"; got != want {
+			t.Fatalf("%q: unexpected vary; got %q, want %q", tt.accept, got, want)
+		}
+		body := io.Reader(w.Body)
+		if tt.encoding == "gzip" {
+			if w.Body.Len() >= len(content) {
+				t.Fatalf("%q: body was not compressed", tt.accept)
+			}
+			if body, err = gzip.NewReader(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Fatalf("%q: unexpected body", tt.accept)
+		}
+	}
+}
+
+func TestServerRedirect(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.FileSystem = fs
+	s.Redirect = time.Minute
+
+	loc := upload(t, s, "hello.html", "<h1>hello</h1>")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+	if got, want := w.Code, http.StatusTemporaryRedirect; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+	res, err := http.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "<h1>hello</h1>"; got != want {
+		t.Fatalf("unexpected body; got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Fatalf("unexpected content type; got %q, want %q", got, want)
+	}
+	if got, want := res.Header.Get("Content-Disposition"), `filename="hello.html"; filename*=UTF-8''hello.html`; got != want {
+		t.Fatalf("unexpected content disposition; got %q, want %q", got, want)
+	}
+
+	// HEAD requests, static files and missing entries are never redirected.
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodHead, loc, nil),
+		httptest.NewRequest(http.MethodGet, "/index.html", nil),
+		httptest.NewRequest(http.MethodGet, "/missing.txt", nil),
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code == http.StatusTemporaryRedirect {
+			t.Fatalf("%s %s was redirected", r.Method, r.URL)
+		}
+	}
+}
+
+func TestServerS3Requests(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.FileSystem = fs
+
+	content := strings.Repeat("some text\n", 1000)
+	loc := upload(t, s, "hello.txt", content)
+	n := len(srv.Requests())
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodHead, loc, nil))
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(len(content)); got != want {
+		t.Fatalf("unexpected content length; got %q, want %q", got, want)
+	}
+	if got := srv.Requests()[n:]; len(got) > 0 {
+		t.Fatalf("HEAD made requests: %q", got)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, loc, nil)
+	r.Header.Set("Range", "bytes=100-199")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got, want := w.Body.String(), content[100:200]; got != want {
+		t.Fatalf("unexpected body; got %q, want %q", got, want)
+	}
+	if got := srv.Requests()[n:]; len(got) != 1 {
+		t.Fatalf("unexpected requests; got %q, want 1", got)
+	}
+}
+
+func TestServerUploadExpires(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.NewWithOptions("kipp", srv.Config(), s3.Options{Tags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.FileSystem = fs
+
+	loc := upload(t, s, "hello.txt", "hello")
+	slug := strings.TrimSuffix(strings.TrimPrefix(loc, "/"), ".txt")
+	e, err := s.Database.Lookup(context.Background(), slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := srv.Header("kipp/" + slug)
+	expires, err := http.ParseTime(h.Get("Expires"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.After(*e.Lifetime) || e.Lifetime.Sub(expires) > time.Minute {
+		t.Fatalf("unexpected expiry; got %s, want about %s", expires, e.Lifetime)
+	}
+	if !strings.Contains(h.Get("X-Amz-Tagging"), s3.ExpiresTag+"=") {
+		t.Fatalf("object not tagged with its expiry: %q", h.Get("X-Amz-Tagging"))
+	}
+}
+
+func TestServerDirectUpload(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.FileSystem = fs
+	s.DirectUpload = time.Minute
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+
+	if got, want := post("/uploads", `{"size":2097152}`).Code, http.StatusRequestEntityTooLarge; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+
+	const content = "hello, world"
+	w := post("/uploads", fmt.Sprintf(`{"size":%d}`, len(content)))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected status; got %d, want %d: %s", got, want, w.Body)
+	}
+	var slot struct {
+		Slug, Method, URL, Finalize string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&slot); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(slot.URL, "content-length") {
+		t.Fatalf("upload url does not sign the content length: %s", slot.URL)
+	}
+
+	// Finalizing before uploading fails.
+	if got, want := post(slot.Finalize, `{"name":"hello.txt"}`).Code, http.StatusNotFound; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+
+	req, err := http.NewRequest(slot.Method, slot.URL, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("unexpected upload status; got %d, want %d", got, want)
+	}
+
+	w = post(slot.Finalize, `{"name":"hello.txt"}`)
+	if got, want := w.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("unexpected status; got %d, want %d: %s", got, want, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	if want := "/" + slot.Slug + ".txt"; loc != want {
+		t.Fatalf("unexpected location; got %q, want %q", loc, want)
+	}
+	if got, want := post(slot.Finalize, `{"name":"hello.txt"}`).Code, http.StatusConflict; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+	if got := w.Body.String(); got != content {
+		t.Fatalf("unexpected body; got %q, want %q", got, content)
+	}
+	e, err := s.Database.Lookup(context.Background(), slot.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != int64(len(content)) || e.Sum == "" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}
+
+func TestServerDirectUploadConcurrentFinalize(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	fs, err := s3.New("kipp", srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	s.FileSystem = fs
+	s.DirectUpload = time.Minute
+
+	const content = "hello, world"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(fmt.Sprintf(`{"size":%d}`, len(content)))))
+	var slot struct {
+		Slug, Method, URL, Finalize string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&slot); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(slot.Method, slot.URL, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	const n = 8
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, slot.Finalize, strings.NewReader(`{"name":"hello.txt"}`)))
+			codes <- w.Code
+		}()
+	}
+	var finalized int
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case http.StatusSeeOther:
+			finalized++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if finalized != 1 {
+		t.Fatalf("upload finalized %d times, want once", finalized)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+slot.Slug+".txt", nil))
+	if got := w.Body.String(); got != content {
+		t.Fatalf("unexpected body; got %q, want %q", got, content)
+	}
+	// Only the file of the entry remains.
+	e, err := s.Database.Lookup(context.Background(), slot.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := walkNames(t, fs), []string{e.File}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected files; got %q, want %q", got, want)
+	}
+}
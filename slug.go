@@ -0,0 +1,249 @@
+package kipp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/uhthomas/kipp/database"
+)
+
+// A SlugGenerator generates slugs for new entries. Slugs must not be empty,
+// or contain "." or "/".
+type SlugGenerator interface {
+	// Slug returns a slug for e. Its Sum is empty unless the generator is
+	// a SumSlugGenerator, and its Name is empty for direct uploads.
+	// attempt is the number of slugs already generated for e which were
+	// taken.
+	Slug(ctx context.Context, e database.Entry, attempt int) (string, error)
+}
+
+// A SumSlugGenerator is a SlugGenerator which derives slugs from sums, so
+// uploads are buffered until their sum is known.
+type SumSlugGenerator interface {
+	SlugGenerator
+	NeedsSum() bool
+}
+
+// maxSlugAttempts is how many slugs are generated for an entry before giving
+// up on finding one which isn't taken.
+const maxSlugAttempts = 8
+
+// errNoSlug is returned when every slug generated for an entry was taken.
+var errNoSlug = errors.New("no free slug")
+
+// RandomSlugs generates slugs of Length random, URL safe characters. The
+// default Length is 12.
+type RandomSlugs struct{ Length int }
+
+// Slug implements SlugGenerator.
+func (g RandomSlugs) Slug(context.Context, database.Entry, int) (string, error) {
+	n := g.Length
+	if n <= 0 {
+		n = 12
+	}
+	b := make([]byte, (n*6+7)/8)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n], nil
+}
+
+// WordSlugs generates slugs of a random word from each of Lists, joined by
+// hyphens. The default lists give slugs of four words, such as
+// glad-orbit-tunnel-velvet, which are easy to read aloud, from some 2^44
+// combinations. That's fewer than the 2^72 of random slugs, despite being
+// longer, and fewer or shorter lists make slugs easier still to guess.
+type WordSlugs struct{ Lists [][]string }
+
+// DefaultWordLists are the lists used by WordSlugs by default.
+var DefaultWordLists = [][]string{words, words, words, words}
+
+// Slug implements SlugGenerator.
+func (g WordSlugs) Slug(context.Context, database.Entry, int) (string, error) {
+	lists := g.Lists
+	if lists == nil {
+		lists = DefaultWordLists
+	}
+	words := make([]string, len(lists))
+	for i, list := range lists {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(list))))
+		if err != nil {
+			return "", err
+		}
+		words[i] = list[n.Int64()]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+// base62 is the alphabet of sequential slugs.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// maxSequentialLength is the length of the longest slug considered to be
+// sequential, when finding where to continue from. It's shorter than random
+// slugs, so they're never mistaken for sequential ones.
+const maxSequentialLength = 8
+
+// sequentialCounter is the name of the counter of sequential slugs.
+const sequentialCounter = "sequential-slugs"
+
+// SequentialSlugs generates slugs which count up in base62, so they're as
+// short as possible.
+type SequentialSlugs struct {
+	// counter, if set, persists the count, so slugs aren't generated
+	// again once their entries are removed.
+	counter database.Counter
+
+	mu   sync.Mutex
+	next uint64
+}
+
+// NewSequentialSlugs returns SequentialSlugs which continue from the highest
+// sequential slug in db. Other slugs which happen to be valid base62, and no
+// longer than 8 characters, are counted too, so it may skip ahead. If db is a
+// database.Counter, the count is kept there, and continues from wherever it
+// was, even if those entries have since been removed.
+func NewSequentialSlugs(ctx context.Context, db database.Database) (*SequentialSlugs, error) {
+	var max uint64
+	if err := db.Walk(ctx, func(e database.Entry) error {
+		if n, ok := parseBase62(e.Slug); ok && n > max {
+			max = n
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+	c, ok := db.(database.Counter)
+	if !ok {
+		return &SequentialSlugs{next: max + 1}, nil
+	}
+	n, err := c.Add(ctx, sequentialCounter, 0)
+	if err != nil {
+		return nil, fmt.Errorf("add: %w", err)
+	}
+	if n < max {
+		if _, err := c.Add(ctx, sequentialCounter, max-n); err != nil {
+			return nil, fmt.Errorf("add: %w", err)
+		}
+	}
+	return &SequentialSlugs{counter: c}, nil
+}
+
+// Slug implements SlugGenerator. Each slug is generated once, so taken slugs
+// are skipped.
+func (g *SequentialSlugs) Slug(ctx context.Context, _ database.Entry, _ int) (string, error) {
+	var n uint64
+	if g.counter != nil {
+		var err error
+		if n, err = g.counter.Add(ctx, sequentialCounter, 1); err != nil {
+			return "", fmt.Errorf("add: %w", err)
+		}
+	} else {
+		g.mu.Lock()
+		n = g.next
+		g.next++
+		g.mu.Unlock()
+	}
+
+	var b []byte
+	for ; n > 0; n /= 62 {
+		b = append(b, base62[n%62])
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b), nil
+}
+
+func parseBase62(s string) (uint64, bool) {
+	if s == "" || len(s) > maxSequentialLength {
+		return 0, false
+	}
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base62, s[i])
+		if d < 0 {
+			return 0, false
+		}
+		n = n*62 + uint64(d)
+	}
+	return n, true
+}
+
+// SumSlugs derives slugs from the first Length characters of the sum of
+// files, so the same file gets the same slug wherever it's uploaded. Should
+// that be taken, a few random characters are appended. The default Length is
+// 8. Files whose sum isn't known when they're uploaded, which are direct
+// uploads, get random slugs.
+type SumSlugs struct{ Length int }
+
+// Slug implements SlugGenerator.
+func (g SumSlugs) Slug(ctx context.Context, e database.Entry, attempt int) (string, error) {
+	n := g.Length
+	if n <= 0 {
+		n = 8
+	}
+	if e.Sum == "" {
+		return RandomSlugs{Length: n}.Slug(ctx, e, attempt)
+	}
+	if n > len(e.Sum) {
+		n = len(e.Sum)
+	}
+	if attempt == 0 {
+		return e.Sum[:n], nil
+	}
+	suffix, err := RandomSlugs{Length: 4}.Slug(ctx, e, attempt)
+	if err != nil {
+		return "", err
+	}
+	return e.Sum[:n] + "-" + suffix, nil
+}
+
+// NeedsSum implements SumSlugGenerator.
+func (SumSlugs) NeedsSum() bool { return true }
+
+// slugs returns the slug generator, which is RandomSlugs by default.
+func (s Server) slugs() SlugGenerator {
+	if s.Slugs == nil {
+		return RandomSlugs{}
+	}
+	return s.Slugs
+}
+
+// needsSum reports whether slugs can only be generated once the sum of a
+// file is known.
+func (s Server) needsSum() bool {
+	g, ok := s.slugs().(SumSlugGenerator)
+	return ok && g.NeedsSum()
+}
+
+// newSlug generates a slug for e which isn't taken.
+func (s Server) newSlug(ctx context.Context, e database.Entry) (string, error) {
+	g := s.slugs()
+	for attempt := 0; attempt < maxSlugAttempts; attempt++ {
+		slug, err := g.Slug(ctx, e, attempt)
+		if err != nil {
+			return "", fmt.Errorf("generate slug: %w", err)
+		}
+		if slug == "" || strings.ContainsAny(slug, "./") {
+			return "", fmt.Errorf("invalid slug %q", slug)
+		}
+		if reserved, err := s.reserved(slug); err != nil {
+			return "", err
+		} else if reserved {
+			continue
+		}
+		if _, err := s.Database.Lookup(ctx, slug); errors.Is(err, database.ErrNoResults) {
+			return slug, nil
+		} else if err != nil {
+			return "", fmt.Errorf("lookup: %w", err)
+		}
+	}
+	return "", errNoSlug
+}
@@ -0,0 +1,201 @@
+package kipp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/database/memory"
+)
+
+func TestRandomSlugs(t *testing.T) {
+	for _, tt := range []struct{ length, want int }{
+		{length: 0, want: 12},
+		{length: 1, want: 1},
+		{length: 7, want: 7},
+		{length: 32, want: 32},
+	} {
+		slug, err := RandomSlugs{Length: tt.length}.Slug(context.Background(), database.Entry{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(`^[A-Za-z0-9_-]*$`).MatchString(slug) || len(slug) != tt.want {
+			t.Fatalf("unexpected slug for length %d; got %q, want %d URL safe characters", tt.length, slug, tt.want)
+		}
+	}
+}
+
+func TestWordSlugs(t *testing.T) {
+	slug, err := WordSlugs{}.Slug(context.Background(), database.Entry{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[a-z]+-[a-z]+-[a-z]+-[a-z]+$`).MatchString(slug) {
+		t.Fatalf("unexpected slug; got %q, want four words", slug)
+	}
+
+	slug, err = WordSlugs{Lists: [][]string{{"a"}, {"b"}}}.Slug(context.Background(), database.Entry{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a-b"; slug != want {
+		t.Fatalf("unexpected slug; got %q, want %q", slug, want)
+	}
+}
+
+func TestSequentialSlugs(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New(0)
+	for _, slug := range []string{"1", "Zy", "notbase62_", "abcdefghijkl"} {
+		if err := db.Create(ctx, database.Entry{Slug: slug}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := NewSequentialSlugs(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Zz", "a0", "a1"} {
+		slug, err := g.Slug(context.Background(), database.Entry{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slug != want {
+			t.Fatalf("unexpected slug; got %q, want %q", slug, want)
+		}
+	}
+
+	g, err = NewSequentialSlugs(ctx, memory.New(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slug, err := g.Slug(context.Background(), database.Entry{}, 0); err != nil || slug != "1" {
+		t.Fatalf("unexpected first slug; got (%q, %v), want (%q, nil)", slug, err, "1")
+	}
+
+	// The count is kept by the database, so slugs aren't generated again
+	// once their entries are removed.
+	for _, slug := range []string{"1", "Zy"} {
+		if err := db.Remove(ctx, slug); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g, err = NewSequentialSlugs(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if slug, err := g.Slug(ctx, database.Entry{}, 0); err != nil || slug != "a2" {
+		t.Fatalf("unexpected slug after a restart; got (%q, %v), want (%q, nil)", slug, err, "a2")
+	}
+
+	// Databases which can't count only continue from their entries, so
+	// reissue the slugs of those removed.
+	g, err = NewSequentialSlugs(ctx, struct{ database.Database }{db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slug, err := g.Slug(ctx, database.Entry{}, 0); err != nil || slug != "1" {
+		t.Fatalf("unexpected slug without a counter; got (%q, %v), want (%q, nil)", slug, err, "1")
+	}
+}
+
+func TestSumSlugs(t *testing.T) {
+	e := database.Entry{Sum: "abcdefghijklmnop"}
+	slug, err := SumSlugs{}.Slug(context.Background(), e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "abcdefgh"; slug != want {
+		t.Fatalf("unexpected slug; got %q, want %q", slug, want)
+	}
+	slug, err = SumSlugs{Length: 4}.Slug(context.Background(), e, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^abcd-[A-Za-z0-9_-]{4}$`).MatchString(slug) {
+		t.Fatalf("unexpected slug after a collision; got %q", slug)
+	}
+	slug, err = SumSlugs{}.Slug(context.Background(), database.Entry{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slug) != 8 {
+		t.Fatalf("unexpected slug without a sum; got %q, want 8 random characters", slug)
+	}
+}
+
+type slugFunc func(database.Entry, int) (string, error)
+
+func (f slugFunc) Slug(_ context.Context, e database.Entry, attempt int) (string, error) {
+	return f(e, attempt)
+}
+
+func TestServerSlugCollision(t *testing.T) {
+	s := newTestServer()
+	if err := s.Database.Create(context.Background(), database.Entry{
+		Slug:      "taken",
+		Timestamp: time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.Slugs = slugFunc(func(_ database.Entry, attempt int) (string, error) {
+		if attempt == 0 {
+			return "taken", nil
+		}
+		return "free", nil
+	})
+	if got, want := upload(t, s, "hello.txt", "hello"), "/free.txt"; got != want {
+		t.Fatalf("unexpected location; got %q, want %q", got, want)
+	}
+
+	// Slugs shadowed by public files are skipped.
+	s.Slugs = slugFunc(func(_ database.Entry, attempt int) (string, error) {
+		if attempt == 0 {
+			return "js", nil
+		}
+		return "notjs", nil
+	})
+	if got, want := upload(t, s, "hello.txt", "hello"), "/notjs.txt"; got != want {
+		t.Fatalf("unexpected location; got %q, want %q", got, want)
+	}
+
+	// Give up if every slug is taken.
+	s.Slugs = slugFunc(func(database.Entry, int) (string, error) { return "taken", nil })
+	r := newUploadRequest(t, "hello.txt", "hello")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got, want := w.Code, http.StatusInternalServerError; got != want {
+		t.Fatalf("unexpected status; got %d, want %d", got, want)
+	}
+}
+
+func TestServerSumSlugs(t *testing.T) {
+	s := newTestServer()
+	s.Slugs = SumSlugs{Length: 6}
+
+	first := upload(t, s, "hello.txt", "hello")
+	second := upload(t, s, "again.txt", "hello")
+	if !regexp.MustCompile(`^/[A-Za-z0-9_-]{6}\.txt$`).MatchString(first) {
+		t.Fatalf("unexpected location; got %q", first)
+	}
+	if !strings.HasPrefix(second, first[:7]+"-") {
+		t.Fatalf("unexpected location for the same content; got %q, want a suffixed %q", second, first)
+	}
+
+	for _, loc := range []string{first, second} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, loc, nil))
+		b, err := ioutil.ReadAll(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "hello"; got != want {
+			t.Fatalf("unexpected body for %s; got %q, want %q", loc, got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package kipp
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/uhthomas/kipp/internal/thumbnail"
+)
+
+// serveThumbnail serves a thumbnail of the image e, at least as wide as the
+// "w" parameter, which is 320 by default. Thumbnails are generated when
+// they're first requested, and cached in the filesystem, alongside the file.
+func (s Server) serveThumbnail(w http.ResponseWriter, r *http.Request, e database.Entry) {
+	if e.URL != "" {
+		http.NotFound(w, r)
+		return
+	}
+	width := 320
+	if v := r.URL.Query().Get("w"); v != "" {
+		var err error
+		if width, err = strconv.Atoi(v); err != nil || width <= 0 {
+			http.Error(w, "invalid width", http.StatusBadRequest)
+			return
+		}
+	}
+	width = thumbnail.Width(width)
+	name := thumbnail.Name(e, width)
+
+	setCacheHeaders(w.Header(), e)
+	w.Header().Set("Etag", strconv.Quote(e.Sum+"-thumb-"+strconv.Itoa(width)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	f, err := s.FileSystem.Open(r.Context(), name)
+	if err == nil {
+		defer f.Close()
+		// The content type is sniffed, as it's either a PNG or JPEG.
+		http.ServeContent(w, r, "", e.Timestamp, f)
+		return
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	src, err := s.open(r.Context(), e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+	var buf bytes.Buffer
+	ctype, err := thumbnail.Generate(r.Context(), &buf, src, width)
+	switch {
+	case errors.Is(err, thumbnail.ErrUnsupported):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errors.Is(err, thumbnail.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Should caching fail, the thumbnail is generated again next time.
+	ctx := r.Context()
+	if e.Lifetime != nil {
+		ctx = filesystem.WithExpires(ctx, *e.Lifetime)
+	}
+	s.FileSystem.Create(ctx, name, bytes.NewReader(buf.Bytes()))
+
+	w.Header().Set("Content-Type", ctype)
+	http.ServeContent(w, r, "", e.Timestamp, bytes.NewReader(buf.Bytes()))
+}
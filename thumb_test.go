@@ -0,0 +1,120 @@
+package kipp
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/internal/thumbnail"
+)
+
+func TestServerThumbnail(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1000, 400))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer()
+	slug := strings.TrimSuffix(strings.TrimPrefix(upload(t, s, "image.png", img.String()), "/"), ".png")
+	e, err := s.Database.Lookup(context.Background(), slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first request generates the thumbnail, and the second is served
+	// from the cache.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+slug+"/thumb?w=300", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		if got, want := w.Header().Get("Content-Type"), "image/png"; got != want {
+			t.Fatalf("unexpected content type; got %q, want %q", got, want)
+		}
+		cfg, err := png.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 320 || cfg.Height != 128 {
+			t.Fatalf("unexpected size; got %dx%d, want 320x128", cfg.Width, cfg.Height)
+		}
+		if i == 0 {
+			f, err := s.FileSystem.Open(context.Background(), thumbnail.Name(e, 320))
+			if err != nil {
+				t.Fatalf("thumbnail was not cached: %v", err)
+			}
+			f.Close()
+		}
+	}
+
+	txt := strings.TrimSuffix(strings.TrimPrefix(upload(t, s, "hello.txt", "hello"), "/"), ".txt")
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{path: "/" + txt + "/thumb", status: http.StatusUnsupportedMediaType},
+		{path: "/" + slug + "/thumb?w=0", status: http.StatusBadRequest},
+		{path: "/" + slug + "/thumb?w=wide", status: http.StatusBadRequest},
+		{path: "/missing/thumb", status: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Fatalf("%s: unexpected status; got %d, want %d", tt.path, w.Code, tt.status)
+		}
+	}
+}
+
+func TestServerThumbnailReplaced(t *testing.T) {
+	s := newTestServer()
+	s.Uploaders = map[string]string{"alice-token": "alice"}
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newVanityRequest(t, "alice-token", "image.png", img.String(), "slug", "avatar"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/avatar/thumb?w=80", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	old, err := s.Database.Lookup(context.Background(), "avatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the image removes its thumbnails.
+	img.Reset()
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, newVanityRequest(t, "alice-token", "image.png", img.String(), "slug", "avatar", "replace", "true"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	if _, err := s.FileSystem.Open(context.Background(), thumbnail.Name(old, 80)); err == nil {
+		t.Fatal("thumbnail of the replaced image exists")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/avatar/thumb?w=80", nil))
+	cfg, err := png.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 80 || cfg.Height != 40 {
+		t.Fatalf("unexpected size; got %dx%d, want 80x40", cfg.Width, cfg.Height)
+	}
+}
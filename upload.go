@@ -0,0 +1,212 @@
+package kipp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+	"github.com/zeebo/blake3"
+)
+
+// stagingSuffix is appended to the slug of a direct upload, which is staged
+// until it's finalised. The staged object remains writable until its upload
+// URL expires, so it's copied to the slug, which isn't.
+const stagingSuffix = ".upload"
+
+// An uploadSlot is the response to a request for a direct upload.
+type uploadSlot struct {
+	Slug    string            `json:"slug"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+	// Finalize is the path to POST to once the upload is complete.
+	Finalize string `json:"finalize"`
+}
+
+// UploadSlotHandler responds with a URL to which the client can upload a file
+// of the requested size directly, and the path at which to finalise it.
+func (s Server) UploadSlotHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.FileSystem.(filesystem.Uploader)
+	if !ok || s.DirectUpload <= 0 {
+		http.Error(w, "direct uploads are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	var req struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Size < 0 {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	if req.Size > s.Limit {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	slug, err := s.newSlug(r.Context(), database.Entry{Size: req.Size})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := u.UploadURL(r.Context(), slug+stagingSuffix, req.Size, s.DirectUpload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadSlot{
+		Slug:   slug,
+		Method: http.MethodPut,
+		URL:    url,
+		Headers: map[string]string{
+			"Content-Length": fmt.Sprint(req.Size),
+		},
+		Expires:  time.Now().Add(s.DirectUpload),
+		Finalize: "/uploads/" + slug,
+	})
+}
+
+// FinalizeUploadHandler creates an entry for a direct upload, once the
+// client has uploaded it. The file is copied from where it was staged, and
+// its sum is computed from the copy.
+func (s Server) FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.FileSystem.(filesystem.Uploader)
+	if !ok || s.DirectUpload <= 0 {
+		http.Error(w, "direct uploads are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	slug := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if slug == "" || strings.ContainsAny(slug, "/.") {
+		http.Error(w, "invalid slug", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > 255 {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if _, err := s.Database.Lookup(ctx, slug); err == nil {
+		http.Error(w, "upload already finalized", http.StatusConflict)
+		return
+	} else if !errors.Is(err, database.ErrNoResults) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	staged := slug + stagingSuffix
+	f, err := s.FileSystem.Open(ctx, staged)
+	if errors.Is(err, os.ErrNotExist) {
+		s.uploadGone(w, r, slug)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if size > s.Limit {
+		s.FileSystem.Remove(ctx, staged)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The upload is copied to a name of its own, so concurrent finalises
+	// can't overwrite each other's copies. Only one creates the entry.
+	file, err := newFileName(ctx, slug)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := u.Copy(s.withExpires(ctx), staged, file); errors.Is(err, os.ErrNotExist) {
+		s.uploadGone(w, r, slug)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e, err := s.finalize(r, slug, file, req.Name)
+	if err != nil {
+		s.FileSystem.Remove(ctx, file)
+		if errors.Is(err, database.ErrExists) {
+			http.Error(w, "upload already finalized", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Should this fail, the staged object is orphaned, and will be
+	// removed by garbage collection.
+	s.FileSystem.Remove(ctx, staged)
+
+	location := "/" + e.Slug + filepath.Ext(e.Name)
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	w.Write([]byte(location + "\n"))
+}
+
+// uploadGone responds to a request to finalise an upload which isn't staged,
+// either because it was never uploaded, or because it was finalised since.
+func (s Server) uploadGone(w http.ResponseWriter, r *http.Request, slug string) {
+	if _, err := s.Database.Lookup(r.Context(), slug); err == nil {
+		http.Error(w, "upload already finalized", http.StatusConflict)
+		return
+	}
+	http.Error(w, "upload not found", http.StatusNotFound)
+}
+
+// finalize computes the sum and size of the named file, and creates the
+// entry for slug with it.
+func (s Server) finalize(r *http.Request, slug, file, name string) (database.Entry, error) {
+	f, err := s.FileSystem.Open(r.Context(), file)
+	if err != nil {
+		return database.Entry{}, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	h := blake3.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return database.Entry{}, fmt.Errorf("copy: %w", err)
+	}
+	if n > s.Limit {
+		return database.Entry{}, errors.New("upload exceeds limit")
+	}
+
+	e := s.newEntry(slug, name, h.Sum(nil), n)
+	e.File = file
+	if err := s.Database.Create(r.Context(), e); err != nil {
+		return database.Entry{}, fmt.Errorf("create entity: %w", err)
+	}
+	return e, nil
+}
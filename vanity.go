@@ -0,0 +1,221 @@
+package kipp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/internal/thumbnail"
+	"github.com/uhthomas/kipp/internal/view"
+)
+
+// vanitySlug matches the slugs uploaders may choose.
+var vanitySlug = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// reservedSlugs are the paths the server handles, other than public files.
+var reservedSlugs = map[string]bool{
+	"oembed":  true,
+	"paste":   true,
+	"uploads": true,
+}
+
+// errSlugTaken is returned when a chosen slug is used by another entry, which
+// can't be replaced.
+var errSlugTaken = errors.New("slug is taken")
+
+// errSlugChanged is returned when the entry with a chosen slug changed while
+// it was being replaced.
+var errSlugChanged = errors.New("slug was changed by another upload")
+
+// uploader returns the name of the uploader authorised by the bearer token of
+// r, if any.
+func (s Server) uploader(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+	token := []byte(auth[len(prefix):])
+	for t, name := range s.Uploaders {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// authoriseSlug checks that the uploader of r may choose slug, and responds
+// with an error if not. It returns the name of the uploader, which is empty if
+// no slug was chosen.
+func (s Server) authoriseSlug(w http.ResponseWriter, r *http.Request, slug string) (string, bool) {
+	if slug == "" {
+		return "", true
+	}
+	uploader, ok := s.uploader(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "choosing a slug requires authorisation", http.StatusUnauthorized)
+		return "", false
+	}
+	if err := s.checkVanitySlug(slug); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return uploader, true
+}
+
+// checkVanitySlug returns an error if slug can't be chosen by an uploader,
+// because it's invalid, or would be shadowed by a public file.
+func (s Server) checkVanitySlug(slug string) error {
+	if !vanitySlug.MatchString(slug) {
+		return errors.New("invalid slug: must be 1 to 64 letters, digits, hyphens or underscores")
+	}
+	reserved, err := s.reserved(slug)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return fmt.Errorf("slug %q is reserved", slug)
+	}
+	return nil
+}
+
+// reserved reports whether slug is a path the server handles, or would be
+// shadowed by a public file.
+func (s Server) reserved(slug string) (bool, error) {
+	if reservedSlugs[slug] {
+		return true, nil
+	}
+	fis, err := ioutil.ReadDir(s.PublicPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("read public path: %w", err)
+	}
+	for _, fi := range fis {
+		if name := fi.Name(); name == slug || strings.HasPrefix(name, slug+".") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// createVanity creates an entry for r with the chosen slug. If there's an
+// entry already, and replace is true, its file is replaced, so long as it was
+// uploaded by the same uploader.
+//
+// Uploads are buffered, so the slug is claimed, or checked to be replaceable,
+// before the filesystem is touched. Replacements are written under a new name,
+// then swapped in, so long as the entry hasn't changed since. Readers never
+// see a file which doesn't match its entry, and concurrent replacements can't
+// interleave.
+func (s Server) createVanity(ctx context.Context, r io.Reader, name, slug, uploader string, replace bool) (database.Entry, error) {
+	// Fail early, rather than after reading the whole file.
+	if existing, err := s.Database.Lookup(ctx, slug); err == nil && !replaceable(existing, uploader, replace) {
+		return database.Entry{}, errSlugTaken
+	}
+
+	f, e, err := s.spool(r, name)
+	if err != nil {
+		return database.Entry{}, err
+	}
+	defer removeTemp(f)
+	e.Slug, e.Uploader = slug, uploader
+
+	switch err := s.Database.Create(ctx, e); {
+	case err == nil:
+		if err := s.store(ctx, f, e); err != nil {
+			s.Database.Remove(ctx, e.Slug)
+			return database.Entry{}, err
+		}
+		return e, nil
+	case !errors.Is(err, database.ErrExists):
+		return database.Entry{}, fmt.Errorf("create entity: %w", err)
+	}
+
+	existing, err := s.Database.Lookup(ctx, slug)
+	if err != nil {
+		return database.Entry{}, fmt.Errorf("lookup: %w", err)
+	}
+	if !replaceable(existing, uploader, replace) {
+		return database.Entry{}, errSlugTaken
+	}
+	if e.File, err = newFileName(ctx, slug); err != nil {
+		return database.Entry{}, fmt.Errorf("new file name: %w", err)
+	}
+	if err := s.store(ctx, f, e); err != nil {
+		return database.Entry{}, err
+	}
+	if err := s.Database.Swap(ctx, e, existing.File); err != nil {
+		s.FileSystem.Remove(ctx, e.File)
+		if errors.Is(err, database.ErrConflict) {
+			return database.Entry{}, errSlugChanged
+		}
+		return database.Entry{}, fmt.Errorf("swap entity: %w", err)
+	}
+	if err := s.removeReplaced(ctx, existing, e); err != nil {
+		return database.Entry{}, err
+	}
+	return e, nil
+}
+
+// newFileName returns a new name for the file of the entry with the given
+// slug. Names of the form "slug.suffix" belong to the entry with that slug.
+func newFileName(ctx context.Context, slug string) (string, error) {
+	suffix, err := RandomSlugs{Length: 12}.Slug(ctx, database.Entry{}, 0)
+	if err != nil {
+		return "", err
+	}
+	return slug + ".file-" + suffix, nil
+}
+
+// removeReplaced removes the file of existing, which e replaced, and its
+// thumbnails and view if they no longer apply. Files of live entries are never
+// collected, so they must be removed now.
+func (s Server) removeReplaced(ctx context.Context, existing, e database.Entry) error {
+	if existing.URL != "" {
+		return nil
+	}
+	if e.URL != "" || e.FileName() != existing.FileName() {
+		if err := s.FileSystem.Remove(ctx, existing.FileName()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove replaced file: %w", err)
+		}
+	}
+	if e.Sum != existing.Sum {
+		if err := thumbnail.Remove(ctx, s.FileSystem, existing); err != nil {
+			return fmt.Errorf("remove replaced thumbnails: %w", err)
+		}
+		if err := view.Remove(ctx, s.FileSystem, existing); err != nil {
+			return fmt.Errorf("remove replaced view: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaceable reports whether uploader may replace existing.
+func replaceable(existing database.Entry, uploader string, replace bool) bool {
+	return replace && existing.Uploader != "" && existing.Uploader == uploader
+}
+
+// maxFieldSize is the size of the largest form field, other than those with
+// limits of their own.
+const maxFieldSize = 1 << 10
+
+// formValue reads the value of a form field, which may be at most max bytes.
+func formValue(p *multipart.Part, max int64) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(p, max+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) > max {
+		return "", errors.New("value too long")
+	}
+	return string(b), nil
+}
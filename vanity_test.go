@@ -0,0 +1,174 @@
+package kipp
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/uhthomas/kipp/database"
+	"github.com/uhthomas/kipp/filesystem"
+)
+
+// newVanityRequest returns a request to upload content, named name, with the
+// given fields, authorised by token if it's not empty.
+func newVanityRequest(t *testing.T, token, name, content string, fields ...string) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i := 0; i < len(fields); i += 2 {
+		if err := mw.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestServerVanitySlug(t *testing.T) {
+	s := newTestServer()
+	s.Uploaders = map[string]string{
+		"alice-token": "alice",
+		"bob-token":   "bob",
+	}
+	taken := strings.TrimSuffix(strings.TrimPrefix(upload(t, s, "random.txt", "random"), "/"), ".txt")
+
+	for _, tt := range []struct {
+		name    string
+		token   string
+		content string
+		fields  []string
+		status  int
+	}{
+		{name: "unauthorised", content: "v1", fields: []string{"slug", "release-notes"}, status: http.StatusUnauthorized},
+		{name: "bad token", token: "wrong", content: "v1", fields: []string{"slug", "release-notes"}, status: http.StatusUnauthorized},
+		{name: "create", token: "alice-token", content: "v1", fields: []string{"slug", "release-notes"}, status: http.StatusSeeOther},
+		{name: "exists", token: "alice-token", content: "v2", fields: []string{"slug", "release-notes"}, status: http.StatusConflict},
+		{name: "other uploader", token: "bob-token", content: "v2", fields: []string{"slug", "release-notes", "replace", "true"}, status: http.StatusConflict},
+		{name: "random slug", token: "alice-token", content: "v2", fields: []string{"slug", taken, "replace", "true"}, status: http.StatusConflict},
+		{name: "replace", token: "alice-token", content: "v2", fields: []string{"slug", "release-notes", "replace", "true"}, status: http.StatusSeeOther},
+		{name: "invalid", token: "alice-token", content: "v1", fields: []string{"slug", "a.b"}, status: http.StatusBadRequest},
+		{name: "too long", token: "alice-token", content: "v1", fields: []string{"slug", strings.Repeat("a", 65)}, status: http.StatusBadRequest},
+		{name: "public file", token: "alice-token", content: "v1", fields: []string{"slug", "index"}, status: http.StatusBadRequest},
+		{name: "public directory", token: "alice-token", content: "v1", fields: []string{"slug", "private"}, status: http.StatusBadRequest},
+		{name: "route", token: "alice-token", content: "v1", fields: []string{"slug", "uploads"}, status: http.StatusBadRequest},
+		{name: "bad replace", token: "alice-token", content: "v1", fields: []string{"slug", "other", "replace", "maybe"}, status: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newVanityRequest(t, tt.token, "notes.pdf", tt.content, tt.fields...))
+		if w.Code != tt.status {
+			t.Fatalf("%s: unexpected status; got %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if w.Code == http.StatusSeeOther {
+			if got, want := w.Header().Get("Location"), "/release-notes.pdf"; got != want {
+				t.Fatalf("%s: unexpected location; got %q, want %q", tt.name, got, want)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/release-notes.pdf", nil))
+	if got, want := w.Body.String(), "v2"; got != want {
+		t.Fatalf("unexpected body; got %q, want %q", got, want)
+	}
+	e, err := s.Database.Lookup(context.Background(), "release-notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Uploader != "alice" || e.Size != 2 {
+		t.Fatalf("unexpected entry; got %+v", e)
+	}
+}
+
+// swapHook is a database which calls before ahead of each swap.
+type swapHook struct {
+	database.Database
+	before func()
+}
+
+func (db swapHook) Swap(ctx context.Context, e database.Entry, file string) error {
+	db.before()
+	return db.Database.Swap(ctx, e, file)
+}
+
+func TestServerVanitySlugReplace(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer()
+	s.Uploaders = map[string]string{"alice-token": "alice"}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newVanityRequest(t, "alice-token", "notes.txt", content, "slug", "notes", "replace", "true"))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+		}
+	}
+	// Replaced files are written under new names, and the files they
+	// replaced are removed.
+	e, err := s.Database.Lookup(ctx, "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(e.File, "notes.") {
+		t.Fatalf("unexpected file; got %q, want a new name for notes", e.File)
+	}
+	names := walkNames(t, s.FileSystem)
+	if want := []string{e.File}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected files; got %q, want %q", names, want)
+	}
+
+	// Should the entry change while it's being replaced, the replacement
+	// fails, and its file is removed.
+	s.Database = swapHook{Database: s.Database, before: func() {
+		changed := e
+		changed.File = "notes.changed"
+		if err := s.Database.(swapHook).Database.Update(ctx, changed); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newVanityRequest(t, "alice-token", "notes.txt", "v4", "slug", "notes", "replace", "true"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status; got %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	if got, err := s.Database.Lookup(ctx, "notes"); err != nil || got.File != "notes.changed" {
+		t.Fatalf("unexpected entry; got (%+v, %v), want the changed entry", got, err)
+	}
+	if got, want := walkNames(t, s.FileSystem), names; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected files; got %q, want %q", got, want)
+	}
+}
+
+// walkNames returns the sorted names of the files in fs.
+func walkNames(t *testing.T, fs filesystem.FileSystem) []string {
+	t.Helper()
+	var names []string
+	if err := filesystem.Walk(context.Background(), fs, func(o filesystem.Object) error {
+		names = append(names, o.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}